@@ -95,6 +95,18 @@ func (self *LRUCache) Get(key string) (v Value, ok bool) {
 	return element.Value.(*entry).value, true
 }
 
+// Peek is like Get, but doesn't make the element the most recently used.
+func (self *LRUCache) Peek(key string) (v Value, ok bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	element := self.table[key]
+	if element == nil {
+		return nil, false
+	}
+	return element.Value.(*entry).value, true
+}
+
 func (self *LRUCache) Set(key string, value Value) {
 	self.mu.Lock()
 	defer self.mu.Unlock()
@@ -174,6 +186,26 @@ func (self *LRUCache) Keys() []string {
 	return keys
 }
 
+// SampleKeys returns up to count keys without copying all of them.
+// They're the first ones of a range over the table, whose order is
+// randomized by Go: the sample is cheap, but not uniform.
+func (self *LRUCache) SampleKeys(count int) []string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if count > len(self.table) {
+		count = len(self.table)
+	}
+	keys := make([]string, 0, count)
+	for key := range self.table {
+		if len(keys) == count {
+			break
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
 func (self *LRUCache) Items() []Item {
 	self.mu.Lock()
 	defer self.mu.Unlock()
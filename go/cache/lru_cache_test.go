@@ -198,6 +198,39 @@ func TestCapacityIsObeyed(t *testing.T) {
 	}
 }
 
+func TestPeek(t *testing.T) {
+	cache := NewLRUCache(2)
+	cache.Set("key1", &CacheValue{1})
+	cache.Set("key2", &CacheValue{1})
+	// lru: [key2, key1]
+
+	if _, ok := cache.Peek("key1"); !ok {
+		t.Error("Peek didn't find key1")
+	}
+	// Peek doesn't change the LRU ordering: key1 goes
+	cache.Set("key3", &CacheValue{1})
+	if _, ok := cache.Peek("key1"); ok {
+		t.Error("Peek made key1 recently used")
+	}
+	if _, ok := cache.Peek("key0"); ok {
+		t.Error("Peek found key0")
+	}
+}
+
+func TestSampleKeys(t *testing.T) {
+	cache := NewLRUCache(100)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		cache.Set(key, &CacheValue{1})
+	}
+	if got := cache.SampleKeys(10); len(got) != 4 {
+		t.Errorf("want all 4 keys, got %v", got)
+	}
+	got := cache.SampleKeys(2)
+	if len(got) != 2 || got[0] == got[1] {
+		t.Errorf("want 2 distinct keys, got %v", got)
+	}
+}
+
 func TestLRUIsEvicted(t *testing.T) {
 	size := uint64(3)
 	cache := NewLRUCache(size)
@@ -0,0 +1,228 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"code.google.com/p/vitess/go/relog"
+	"code.google.com/p/vitess/go/stats"
+	ts "code.google.com/p/vitess/go/vt/tabletserver"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tunables maps the config fields that can be changed at runtime
+// to the SET variable that changes them.
+var tunables = map[string]string{
+	"PoolSize":            "vt_pool_size",
+	"TransactionCap":      "vt_transaction_cap",
+	"ReservedCap":         "vt_reserved_cap",
+	"TransactionTimeout":  "vt_transaction_timeout",
+	"MaxResultSize":       "vt_max_result_size",
+	"StreamBufferSize":    "vt_stream_buffer_size",
+	"DMLBatchSize":        "vt_dml_batch_size",
+	"ResultBudget":        "vt_result_budget",
+	"QueryCacheSize":      "vt_query_cache_size",
+	"SchemaReloadTime":    "vt_schema_reload_time",
+	"QueryTimeout":        "vt_query_timeout",
+	"IdleTimeout":         "vt_idle_timeout",
+	"ReservedIdleTimeout": "vt_reserved_idle_timeout",
+	"SlowQueryThreshold":  "vt_slow_query_threshold",
+	"SlowQuerySampleRate": "vt_slow_query_sample_rate",
+}
+
+// ConfigReloader re-reads the -config file and applies the changes
+// it can to the running query services. It also re-reads the
+// -queryrules and -tableacl files, which is the way to change them
+// when clients don't authenticate.
+type ConfigReloader struct {
+	mu              sync.Mutex
+	configFile      string
+	queryRulesFile  string
+	tableAclFile    string
+	lastReload      time.Time
+	lastError       string
+	applied         []string
+	skipped         map[string][]string
+	restartRequired []string
+}
+
+func NewConfigReloader(configFile, queryRulesFile, tableAclFile string) *ConfigReloader {
+	self := &ConfigReloader{configFile: configFile, queryRulesFile: queryRulesFile, tableAclFile: tableAclFile}
+	expvar.Publish("ConfigReload", stats.StrFunc(self.statsJSON))
+	return self
+}
+
+// Reload applies the tunables of the config file to the query services
+// whose running values differ, including those changed by SET since.
+// Services that are not open are skipped and reported. Other fields
+// that changed can't be applied without a restart: they are logged and
+// left unchanged. The query rules and the table acl are replaced by
+// the contents of their files. Errors don't stop the other fields
+// from being applied.
+func (self *ConfigReloader) Reload() (err error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.lastReload = time.Now()
+	self.applied = nil
+	self.skipped = make(map[string][]string)
+	self.restartRequired = nil
+	self.lastError = ""
+	defer func() {
+		if err != nil {
+			self.lastError = err.Error()
+			relog.Error("config reload failed: %v", err)
+		}
+	}()
+
+	if self.configFile == "" && self.queryRulesFile == "" && self.tableAclFile == "" {
+		return fmt.Errorf("no config file to reload")
+	}
+	errors := make([]string, 0, 4)
+	if self.configFile != "" {
+		errors = append(errors, self.reloadConfig()...)
+	}
+	if self.queryRulesFile != "" {
+		qrs := ts.NewQueryRules()
+		if err := readJSONFile(self.queryRulesFile, qrs); err != nil {
+			errors = append(errors, err.Error())
+		} else {
+			ts.SetQueryRules(qrs)
+			relog.Info("config reload: query rules loaded from %s", self.queryRulesFile)
+			self.applied = append(self.applied, "QueryRules")
+		}
+	}
+	if self.tableAclFile != "" {
+		acl := ts.NewTableAcl()
+		if err := readJSONFile(self.tableAclFile, acl); err != nil {
+			errors = append(errors, err.Error())
+		} else {
+			ts.SetTableAcl(acl)
+			relog.Info("config reload: table acl loaded from %s", self.tableAclFile)
+			self.applied = append(self.applied, "TableAcl")
+		}
+	}
+	if len(errors) != 0 {
+		return fmt.Errorf("%s", strings.Join(errors, "; "))
+	}
+	return nil
+}
+
+// reloadConfig applies the -config file, and returns the errors.
+func (self *ConfigReloader) reloadConfig() (errors []string) {
+	newConfig := config
+	if err := readJSONFile(self.configFile, &newConfig); err != nil {
+		return []string{err.Error()}
+	}
+
+	current := reflect.ValueOf(&config).Elem()
+	updated := reflect.ValueOf(newConfig)
+	for i := 0; i < current.NumField(); i++ {
+		field := current.Type().Field(i).Name
+		oldValue, newValue := current.Field(i), updated.Field(i)
+		key, ok := tunables[field]
+		if !ok {
+			if !reflect.DeepEqual(oldValue.Interface(), newValue.Interface()) {
+				relog.Warning("config reload: %s changed from %v to %v, restart required", field, oldValue.Interface(), newValue.Interface())
+				self.restartRequired = append(self.restartRequired, field)
+			}
+			continue
+		}
+		// Tunables are compared with the running values by SetTunable
+		var value float64
+		switch newValue.Kind() {
+		case reflect.Int:
+			value = float64(newValue.Int())
+		case reflect.Float64:
+			value = newValue.Float()
+		}
+		changed, skipped, setErr := ts.SetTunable(key, value)
+		if setErr != nil {
+			errors = append(errors, fmt.Sprintf("could not set %s: %v", field, setErr))
+			continue
+		}
+		if len(skipped) != 0 {
+			relog.Warning("config reload: %s not set for %v, their query service is not open", field, skipped)
+			self.skipped[field] = skipped
+		}
+		if len(changed) != 0 {
+			relog.Info("config reload: %s set to %v for %v", field, newValue.Interface(), changed)
+			self.applied = append(self.applied, field)
+		}
+		oldValue.Set(newValue)
+	}
+	return errors
+}
+
+func readJSONFile(name string, val interface{}) error {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %v", name, err)
+	}
+	if err = json.Unmarshal(data, val); err != nil {
+		return fmt.Errorf("could not parse %s: %v", name, err)
+	}
+	return nil
+}
+
+func (self *ConfigReloader) statsJSON() string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	data, _ := json.Marshal(map[string]interface{}{
+		"LastReload":      self.lastReload.Format(time.RFC3339),
+		"LastError":       self.lastError,
+		"Applied":         self.applied,
+		"Skipped":         self.skipped,
+		"RestartRequired": self.restartRequired,
+	})
+	return string(data)
+}
+
+func (self *ConfigReloader) SignalHandler(signal os.Signal) {
+	relog.Info("config reload requested by %v", signal)
+	self.Reload()
+}
+
+func (self *ConfigReloader) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if err := self.Reload(); err != nil {
+		http.Error(response, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response.Write([]byte("config reloaded"))
+}
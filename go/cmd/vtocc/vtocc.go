@@ -34,8 +34,11 @@ package main
 import (
 	"code.google.com/p/vitess/go/logfile"
 	"code.google.com/p/vitess/go/relog"
+	"code.google.com/p/vitess/go/rpcplus"
+	"code.google.com/p/vitess/go/rpcwrap/auth"
 	"code.google.com/p/vitess/go/rpcwrap/bsonrpc"
 	"code.google.com/p/vitess/go/rpcwrap/jsonrpc"
+	rpcproto "code.google.com/p/vitess/go/rpcwrap/proto"
 	"code.google.com/p/vitess/go/sighandler"
 	"code.google.com/p/vitess/go/snitch"
 	"code.google.com/p/vitess/go/umgmt"
@@ -43,7 +46,6 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"expvar"
 	"flag"
 	"fmt"
@@ -52,9 +54,9 @@ import (
 	"log"
 	"net/http"
 	_ "net/http/pprof"
-	"net/rpc"
 	"os"
 	"runtime"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -87,29 +89,61 @@ const (
 )
 
 type configType struct {
-	Port               int
-	UmgmtSocket        string
-	PoolSize           int
-	TransactionCap     int
-	TransactionTimeout float64
-	MaxResultSize      int
-	QueryCacheSize     int
-	SchemaReloadTime   float64
-	QueryTimeout       float64
-	IdleTimeout        float64
+	Port                  int
+	UmgmtSocket           string
+	PoolSize              int
+	TransactionCap        int
+	ReservedCap           int
+	TransactionTimeout    float64
+	MaxResultSize         int
+	StreamBufferSize      int
+	DMLBatchSize          int
+	ResultBudget          int
+	QueryCacheSize        int
+	SchemaReloadTime      float64
+	QueryTimeout          float64
+	IdleTimeout           float64
+	ReservedIdleTimeout   float64
+	SlowQueryThreshold    float64
+	SlowQuerySampleRate   float64
+	RowCacheAddress       string
+	RowCachePoolSize      int
+	IndexCacheSize        int
+	BinlogFile            string
+	BinlogPositionFile    string
+	CacheWarmingRate      int
+	CacheVerifyInterval   float64
+	CacheVerifySampleSize int
+	CacheVerifyEvict      bool
 }
 
 var config configType = configType{
-	6510,
-	"/tmp/vtocc-%08x-umgmt.sock",
-	16,
-	20,
-	30,
-	10000,
-	5000,
-	30 * 60,
-	0,
-	30 * 60,
+	Port:                  6510,
+	UmgmtSocket:           "/tmp/vtocc-%08x-umgmt.sock",
+	PoolSize:              16,
+	TransactionCap:        20,
+	ReservedCap:           100,
+	TransactionTimeout:    30,
+	MaxResultSize:         10000,
+	StreamBufferSize:      32 * 1024,
+	DMLBatchSize:          100,
+	ResultBudget:          512 * 1024 * 1024,
+	QueryCacheSize:        5000,
+	SchemaReloadTime:      30 * 60,
+	QueryTimeout:          0,
+	IdleTimeout:           30 * 60,
+	ReservedIdleTimeout:   30 * 60,
+	SlowQueryThreshold:    1,
+	SlowQuerySampleRate:   0,
+	RowCacheAddress:       "",
+	RowCachePoolSize:      16,
+	IndexCacheSize:        0,
+	BinlogFile:            "",
+	BinlogPositionFile:    "",
+	CacheWarmingRate:      1000,
+	CacheVerifyInterval:   0,
+	CacheVerifySampleSize: 100,
+	CacheVerifyEvict:      false,
 }
 
 var dbconfig map[string]interface{} = map[string]interface{}{
@@ -152,6 +186,12 @@ func main() {
 	maxOpenFds := flag.Uint64("max-open-fds", 32768, "max open file descriptors")
 	configFile := flag.String("config", "", "config file name")
 	dbConfigFile := flag.String("dbconfig", "", "db config file name")
+	dbConfigsFile := flag.String("dbconfigs", "", "file name of a list of db configs, one per database to serve. Each one overrides -dbconfig")
+	queryRulesFile := flag.String("queryrules", "", "query rules file name, re-read by reload_config and SIGHUP")
+	tableAclFile := flag.String("tableacl", "", "table acl file name, re-read by reload_config and SIGHUP")
+	authCredentials := flag.String("auth-credentials", "", "if set, rpc clients must authenticate with the credentials of this file")
+	admins := flag.String("admins", "", "comma separated list of the authenticated users that can change the query rules and the table acl through rpc")
+	cacheWarmingFile := flag.String("cachewarming", "", "row cache warming file name")
 	lameDuckPeriod := flag.Float64("lame-duck-period", DefaultLameDuckPeriod,
 		"how long to give in-flight transactions to finish")
 	rebindDelay := flag.Float64("rebind-delay", DefaultRebindDelay,
@@ -161,6 +201,7 @@ func main() {
 	logMaxSize := flag.Int64("logfile.maxsize", 0, "max file size in bytes")
 	logMaxFiles := flag.Int64("logfile.maxfiles", 0, "max number of log files")
 	queryLog := flag.String("querylog", "", "for testing: log all queries to this file")
+	slowQueryLog := flag.String("slowquerylog", "", "log the queries and transactions slower than SlowQueryThreshold to this file, rotated like -logfile")
 	flag.Parse()
 
 	exportBinaryVersion()
@@ -179,11 +220,35 @@ func main() {
 			ts.QueryLogger = relog.New(f, "", log.Ldate|log.Lmicroseconds, relog.DEBUG)
 		}
 	}
+	if *slowQueryLog != "" {
+		f, err := logfile.Open(*slowQueryLog, *logFrequency, *logMaxSize, *logMaxFiles)
+		if err != nil {
+			relog.Fatal("unable to open slow query log %s: %v", *slowQueryLog, err)
+		}
+		ts.SlowQueryLogger = relog.New(f, "", log.Ldate|log.Lmicroseconds, relog.DEBUG)
+	}
 	unmarshalFile(*configFile, &config)
 	unmarshalFile(*dbConfigFile, &dbconfig)
-	// work-around for jsonism
-	if v, ok := dbconfig["port"].(float64); ok {
-		dbconfig["port"] = int(v)
+	dbconfigs := []map[string]interface{}{dbconfig}
+	if *dbConfigsFile != "" {
+		var overrides []map[string]interface{}
+		unmarshalFile(*dbConfigsFile, &overrides)
+		dbconfigs = make([]map[string]interface{}, len(overrides))
+		for i, override := range overrides {
+			dbconfigs[i] = make(map[string]interface{})
+			for k, v := range dbconfig {
+				dbconfigs[i][k] = v
+			}
+			for k, v := range override {
+				dbconfigs[i][k] = v
+			}
+		}
+	}
+	for _, dbconfig := range dbconfigs {
+		// work-around for jsonism
+		if v, ok := dbconfig["port"].(float64); ok {
+			dbconfig["port"] = int(v)
+		}
 	}
 
 	fdLimit := &syscall.Rlimit{*maxOpenFds, *maxOpenFds}
@@ -193,25 +258,59 @@ func main() {
 		relog.Info("set max-open-fds = %v", *maxOpenFds)
 	}
 
+	reloader := NewConfigReloader(*configFile, *queryRulesFile, *tableAclFile)
 	snitch.RegisterCommand("reload_schema", "Rescan the schema for new tables", ReloadHandler)
+	snitch.RegisterCommand("reload_config", "Reload the config, query rules and table acl files and apply what can be changed without a restart", reloader.ServeHTTP)
 	snitch.Register()
 
-	qm := &OccManager{config, dbconfig}
-	rpc.Register(qm)
-
-	ts.StartQueryService(
-		config.PoolSize,
-		config.TransactionCap,
-		config.TransactionTimeout,
-		config.MaxResultSize,
-		config.QueryCacheSize,
-		config.SchemaReloadTime,
-		config.QueryTimeout,
-		config.IdleTimeout,
-	)
-	ts.AllowQueries(ts.GenericConnectionCreator(dbconfig), nil)
+	if *authCredentials != "" {
+		if err = auth.LoadCredentials(*authCredentials); err != nil {
+			relog.Fatal("could not load credentials: %v", err)
+		}
+	}
+
+	var adminList []string
+	if *admins != "" {
+		adminList = strings.Split(*admins, ",")
+	}
+	qm := &OccManager{config, dbconfigs, adminList}
+	rpcplus.Register(qm)
 
-	rpc.HandleHTTP()
+	qrs := ts.NewQueryRules()
+	unmarshalFile(*queryRulesFile, qrs)
+	acl := ts.NewTableAcl()
+	unmarshalFile(*tableAclFile, acl)
+	warmSpecs := make(map[string]ts.WarmSpec)
+	unmarshalFile(*cacheWarmingFile, &warmSpecs)
+	for _, dbconfig := range dbconfigs {
+		ts.StartQueryService(dbconfig["dbname"].(string), ts.Config{
+			PoolSize:            config.PoolSize,
+			TransactionCap:      config.TransactionCap,
+			ReservedCap:         config.ReservedCap,
+			TransactionTimeout:  config.TransactionTimeout,
+			MaxResultSize:       config.MaxResultSize,
+			StreamBufferSize:    config.StreamBufferSize,
+			DMLBatchSize:        config.DMLBatchSize,
+			ResultBudget:        config.ResultBudget,
+			QueryCacheSize:      config.QueryCacheSize,
+			SchemaReloadTime:    config.SchemaReloadTime,
+			QueryTimeout:        config.QueryTimeout,
+			IdleTimeout:         config.IdleTimeout,
+			ReservedIdleTimeout: config.ReservedIdleTimeout,
+			SlowQueryThreshold:  config.SlowQueryThreshold,
+			SlowQuerySampleRate: config.SlowQuerySampleRate,
+		})
+	}
+	ts.SetQueryRules(qrs)
+	ts.SetTableAcl(acl)
+	for _, dbconfig := range dbconfigs {
+		allowQueries(dbconfig, warmSpecs, len(dbconfigs) > 1)
+	}
+
+	// The gob rpc endpoint can't authenticate its clients
+	if !auth.Required() {
+		rpcplus.HandleHTTP()
+	}
 	jsonrpc.ServeHTTP()
 	jsonrpc.ServeRPC()
 	bsonrpc.ServeHTTP()
@@ -235,6 +334,8 @@ func main() {
 	umgmt.AddStartupCallback(func() {
 		sighandler.SetSignalHandler(syscall.SIGTERM,
 			umgmt.SigTermHandler)
+		sighandler.SetSignalHandler(syscall.SIGHUP,
+			reloader.SignalHandler)
 	})
 	umgmt.AddCloseCallback(func() {
 		ts.DisallowQueries()
@@ -251,6 +352,29 @@ func main() {
 	relog.Info("done")
 }
 
+// allowQueries opens the query service of dbconfig. If there are
+// several, each one keeps its binlog position in its own file.
+func allowQueries(dbconfig map[string]interface{}, warmSpecs map[string]ts.WarmSpec, several bool) {
+	dbname := dbconfig["dbname"].(string)
+	if config.BinlogFile != "" {
+		positionFile := config.BinlogPositionFile
+		if several && positionFile != "" {
+			positionFile += "." + dbname
+		}
+		ts.SetEventSource(dbname, ts.BinlogFileCreator(config.BinlogFile), positionFile)
+	}
+	ts.SetCacheWarming(dbname, warmSpecs, config.CacheWarmingRate)
+	ts.SetCacheVerification(dbname, config.CacheVerifyInterval, config.CacheVerifySampleSize, config.CacheVerifyEvict)
+	ts.SetIndexCacheSize(dbname, config.IndexCacheSize)
+	ts.AllowQueries(
+		dbname,
+		ts.GenericConnectionCreator(dbconfig),
+		nil,
+		ts.GenericRowCacheCreator(config.RowCacheAddress, config.RowCachePoolSize, dbname),
+		ts.SuperConnectionCreator(dbconfig["unix_socket"].(string), dbname),
+	)
+}
+
 func unmarshalFile(name string, val interface{}) {
 	if name != "" {
 		data, err := ioutil.ReadFile(name)
@@ -271,15 +395,71 @@ func ReloadHandler(response http.ResponseWriter, request *http.Request) {
 }
 
 type OccManager struct {
-	config   configType
-	dbconfig map[string]interface{}
+	config    configType
+	dbconfigs []map[string]interface{}
+	admins    []string
 }
 
-func (self *OccManager) GetSessionId(dbname *string, sessionId *int64) error {
-	if *dbname != self.dbconfig["dbname"].(string) {
-		return errors.New(fmt.Sprintf("db name mismatch, expecting %v, received %v", self.dbconfig["dbname"].(string), *dbname))
+// checkAdmin returns an error unless the connection authenticated
+// as one of the admins.
+func (self *OccManager) checkAdmin(context *rpcproto.Context) error {
+	if context.Username == "" {
+		return fmt.Errorf("admin access requires authentication")
+	}
+	for _, admin := range self.admins {
+		if admin == context.Username {
+			return nil
+		}
+	}
+	relog.Warning("%s (%s) denied admin access", context.Username, context.RemoteAddr)
+	return fmt.Errorf("%s is not an admin", context.Username)
+}
+
+// GetSessionId returns a session id that identifies the
+// authenticated user of the connection, if any.
+func (self *OccManager) GetSessionId(context *rpcproto.Context, dbname *string, sessionId *int64) (err error) {
+	*sessionId, err = ts.GetSessionId(*dbname, context.Username)
+	return err
+}
+
+// GetCallerSessionId returns a session id that identifies the caller,
+// whose table access is then checked against the table ACL.
+// Authenticated connections can only be their own user.
+func (self *OccManager) GetCallerSessionId(context *rpcproto.Context, sessionParams *ts.SessionParams, sessionId *int64) (err error) {
+	caller := sessionParams.Caller
+	if context.Username != "" && caller != context.Username {
+		if caller != "" {
+			return fmt.Errorf("authenticated as %s, can't be %s", context.Username, caller)
+		}
+		caller = context.Username
+	}
+	*sessionId, err = ts.GetSessionId(sessionParams.DbName, caller)
+	return err
+}
+
+func (self *OccManager) SetTableAcl(context *rpcproto.Context, tableAcl *string, unusedOutput *string) error {
+	*unusedOutput = ""
+	if err := self.checkAdmin(context); err != nil {
+		return err
+	}
+	acl := ts.NewTableAcl()
+	if err := json.Unmarshal([]byte(*tableAcl), acl); err != nil {
+		return err
+	}
+	ts.SetTableAcl(acl)
+	return nil
+}
+
+func (self *OccManager) SetQueryRules(context *rpcproto.Context, queryRules *string, unusedOutput *string) error {
+	*unusedOutput = ""
+	if err := self.checkAdmin(context); err != nil {
+		return err
+	}
+	qrs := ts.NewQueryRules()
+	if err := json.Unmarshal([]byte(*queryRules), qrs); err != nil {
+		return err
 	}
-	*sessionId = ts.GetSessionId()
+	ts.SetQueryRules(qrs)
 	return nil
 }
 
@@ -0,0 +1,230 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+// Package fakememcached is a small in-memory stand-in for memcached.
+// It understands enough of the text protocol to test clients:
+// get, gets, set, add, replace, cas, delete and flush_all.
+// Expiration times are ignored.
+package fakememcached
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type item struct {
+	flags uint16
+	value []byte
+	cas   uint64
+}
+
+type Server struct {
+	listener net.Listener
+	mu       sync.Mutex
+	items    map[string]*item
+	lastCas  uint64
+}
+
+// Start starts a server on address, which is a unix socket path
+// if it starts with a '/', and a tcp host:port otherwise.
+func Start(address string) (*Server, error) {
+	network := "tcp"
+	if strings.HasPrefix(address, "/") {
+		network = "unix"
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	self := &Server{listener: listener, items: make(map[string]*item)}
+	go self.serve()
+	return self, nil
+}
+
+func (self *Server) Close() {
+	self.listener.Close()
+}
+
+func (self *Server) serve() {
+	for {
+		conn, err := self.listener.Accept()
+		if err != nil {
+			return
+		}
+		go self.handle(conn)
+	}
+}
+
+func (self *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			fmt.Fprintf(writer, "ERROR\r\n")
+			writer.Flush()
+			continue
+		}
+		switch args[0] {
+		case "get", "gets":
+			self.get(writer, args[1:], args[0] == "gets")
+		case "set", "add", "replace", "cas":
+			if !self.store(reader, writer, args) {
+				return
+			}
+		case "delete":
+			self.delete(writer, args[1:])
+		case "flush_all":
+			self.mu.Lock()
+			self.items = make(map[string]*item)
+			self.mu.Unlock()
+			fmt.Fprintf(writer, "OK\r\n")
+		case "stats":
+			self.mu.Lock()
+			fmt.Fprintf(writer, "STAT curr_items %d\r\nEND\r\n", len(self.items))
+			self.mu.Unlock()
+		default:
+			fmt.Fprintf(writer, "ERROR\r\n")
+		}
+		if err = writer.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (self *Server) get(writer *bufio.Writer, keys []string, withCas bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for _, key := range keys {
+		it, ok := self.items[key]
+		if !ok {
+			continue
+		}
+		if withCas {
+			fmt.Fprintf(writer, "VALUE %s %d %d %d\r\n", key, it.flags, len(it.value), it.cas)
+		} else {
+			fmt.Fprintf(writer, "VALUE %s %d %d\r\n", key, it.flags, len(it.value))
+		}
+		writer.Write(it.value)
+		writer.WriteString("\r\n")
+	}
+	writer.WriteString("END\r\n")
+}
+
+// store returns false if the connection should be closed.
+func (self *Server) store(reader *bufio.Reader, writer *bufio.Writer, args []string) bool {
+	// <command name> <key> <flags> <exptime> <bytes> [<cas unique>]
+	command := args[0]
+	if len(args) < 5 || (command == "cas" && len(args) < 6) {
+		fmt.Fprintf(writer, "CLIENT_ERROR bad command line format\r\n")
+		return false
+	}
+	flags, err := strconv.ParseUint(args[2], 10, 16)
+	if err != nil {
+		fmt.Fprintf(writer, "CLIENT_ERROR bad command line format\r\n")
+		return false
+	}
+	size, err := strconv.ParseUint(args[4], 10, 32)
+	if err != nil {
+		fmt.Fprintf(writer, "CLIENT_ERROR bad command line format\r\n")
+		return false
+	}
+	var cas uint64
+	if command == "cas" {
+		if cas, err = strconv.ParseUint(args[5], 10, 64); err != nil {
+			fmt.Fprintf(writer, "CLIENT_ERROR bad command line format\r\n")
+			return false
+		}
+	}
+	data := make([]byte, size+2)
+	if _, err = io.ReadFull(reader, data); err != nil {
+		return false
+	}
+	if string(data[size:]) != "\r\n" {
+		fmt.Fprintf(writer, "CLIENT_ERROR bad data chunk\r\n")
+		return false
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	key := args[1]
+	existing, exists := self.items[key]
+	switch command {
+	case "add":
+		if exists {
+			fmt.Fprintf(writer, "NOT_STORED\r\n")
+			return true
+		}
+	case "replace":
+		if !exists {
+			fmt.Fprintf(writer, "NOT_STORED\r\n")
+			return true
+		}
+	case "cas":
+		if !exists {
+			fmt.Fprintf(writer, "NOT_FOUND\r\n")
+			return true
+		}
+		if existing.cas != cas {
+			fmt.Fprintf(writer, "EXISTS\r\n")
+			return true
+		}
+	}
+	self.lastCas++
+	self.items[key] = &item{flags: uint16(flags), value: data[:size], cas: self.lastCas}
+	fmt.Fprintf(writer, "STORED\r\n")
+	return true
+}
+
+func (self *Server) delete(writer *bufio.Writer, args []string) {
+	if len(args) < 1 {
+		fmt.Fprintf(writer, "ERROR\r\n")
+		return
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if _, ok := self.items[args[0]]; !ok {
+		fmt.Fprintf(writer, "NOT_FOUND\r\n")
+		return
+	}
+	delete(self.items, args[0])
+	fmt.Fprintf(writer, "DELETED\r\n")
+}
@@ -0,0 +1,302 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+// Package memcache is a client for servers that speak the memcached
+// text protocol. A Connection is not thread safe.
+package memcache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type MemcacheError struct {
+	Message string
+}
+
+func NewMemcacheError(format string, args ...interface{}) MemcacheError {
+	return MemcacheError{fmt.Sprintf(format, args...)}
+}
+
+func (self MemcacheError) Error() string {
+	return self.Message
+}
+
+func handleError(err *error) {
+	if x := recover(); x != nil {
+		*err = x.(MemcacheError)
+	}
+}
+
+type Connection struct {
+	conn     net.Conn
+	buffered bufio.ReadWriter
+}
+
+type GetResult struct {
+	Key   string
+	Value []byte
+	Flags uint16
+	Cas   uint64
+}
+
+// Connect connects to a memcached server. address is a unix socket
+// path if it starts with a '/', and a tcp host:port otherwise.
+func Connect(address string) (conn *Connection, err error) {
+	network := "tcp"
+	if strings.HasPrefix(address, "/") {
+		network = "unix"
+	}
+	var nc net.Conn
+	if nc, err = net.Dial(network, address); err != nil {
+		return nil, err
+	}
+	return &Connection{
+		conn: nc,
+		buffered: bufio.ReadWriter{
+			Reader: bufio.NewReader(nc),
+			Writer: bufio.NewWriter(nc),
+		},
+	}, nil
+}
+
+func (self *Connection) Close() {
+	if self.conn == nil {
+		return
+	}
+	self.conn.Close()
+	self.conn = nil
+}
+
+func (self *Connection) IsClosed() bool {
+	return self.conn == nil
+}
+
+func (self *Connection) Get(keys ...string) (results []GetResult, err error) {
+	defer handleError(&err)
+	results = self.get("get", keys)
+	return results, nil
+}
+
+// Gets is like Get, but also returns the cas value of each item.
+func (self *Connection) Gets(keys ...string) (results []GetResult, err error) {
+	defer handleError(&err)
+	results = self.get("gets", keys)
+	return results, nil
+}
+
+func (self *Connection) Set(key string, flags uint16, timeout uint64, value []byte) (stored bool, err error) {
+	defer handleError(&err)
+	return self.store("set", key, flags, timeout, value, 0), nil
+}
+
+func (self *Connection) Add(key string, flags uint16, timeout uint64, value []byte) (stored bool, err error) {
+	defer handleError(&err)
+	return self.store("add", key, flags, timeout, value, 0), nil
+}
+
+func (self *Connection) Replace(key string, flags uint16, timeout uint64, value []byte) (stored bool, err error) {
+	defer handleError(&err)
+	return self.store("replace", key, flags, timeout, value, 0), nil
+}
+
+// Cas stores value only if the item hasn't changed since cas was
+// returned by Gets. It returns false if the item was modified or deleted.
+func (self *Connection) Cas(key string, flags uint16, timeout uint64, value []byte, cas uint64) (stored bool, err error) {
+	defer handleError(&err)
+	return self.store("cas", key, flags, timeout, value, cas), nil
+}
+
+func (self *Connection) Delete(key string) (deleted bool, err error) {
+	defer handleError(&err)
+	self.writestrings("delete ", key, "\r\n")
+	reply := self.readline()
+	if strings.Contains(reply, "ERROR") {
+		panic(NewMemcacheError("%s", reply))
+	}
+	return strings.HasPrefix(reply, "DELETED"), nil
+}
+
+func (self *Connection) FlushAll() (err error) {
+	defer handleError(&err)
+	self.writestrings("flush_all\r\n")
+	reply := self.readline()
+	if !strings.HasPrefix(reply, "OK") {
+		panic(NewMemcacheError("%s", reply))
+	}
+	return nil
+}
+
+func (self *Connection) Stats(argument string) (result []byte, err error) {
+	defer handleError(&err)
+	if argument == "" {
+		self.writestrings("stats\r\n")
+	} else {
+		self.writestrings("stats ", argument, "\r\n")
+	}
+	for {
+		l := self.readline()
+		if strings.HasPrefix(l, "END") {
+			break
+		}
+		if strings.Contains(l, "ERROR") {
+			return nil, NewMemcacheError("%s", l)
+		}
+		result = append(result, l...)
+		result = append(result, '\n')
+	}
+	return result, nil
+}
+
+func (self *Connection) get(command string, keys []string) (results []GetResult) {
+	results = make([]GetResult, 0, len(keys))
+	if len(keys) == 0 {
+		return
+	}
+	self.writestrings(command)
+	for _, key := range keys {
+		self.writestrings(" ", key)
+	}
+	self.writestrings("\r\n")
+	header := self.readline()
+	var result GetResult
+	for strings.HasPrefix(header, "VALUE") {
+		// VALUE <key> <flags> <bytes> [<cas unique>]\r\n
+		chunks := strings.Split(header, " ")
+		if len(chunks) < 4 {
+			self.fail(NewMemcacheError("Malformed response: %s", header))
+		}
+		result.Key = chunks[1]
+		flags64, err := strconv.ParseUint(chunks[2], 10, 16)
+		if err != nil {
+			self.fail(err)
+		}
+		result.Flags = uint16(flags64)
+		size, err := strconv.ParseUint(chunks[3], 10, 64)
+		if err != nil {
+			self.fail(err)
+		}
+		if len(chunks) == 5 {
+			result.Cas, err = strconv.ParseUint(chunks[4], 10, 64)
+			if err != nil {
+				self.fail(err)
+			}
+		}
+		// <data block>\r\n
+		result.Value = self.read(int(size) + 2)[:size]
+		results = append(results, result)
+		header = self.readline()
+	}
+	if !strings.HasPrefix(header, "END") {
+		self.fail(NewMemcacheError("Malformed response: %s", header))
+	}
+	return
+}
+
+func (self *Connection) store(command, key string, flags uint16, timeout uint64, value []byte, cas uint64) (stored bool) {
+	if len(value) > 1000000 {
+		return false
+	}
+
+	// <command name> <key> <flags> <exptime> <bytes> [<cas unique>] [noreply]\r\n
+	self.writestrings(command, " ", key, " ")
+	self.write(strconv.AppendUint(nil, uint64(flags), 10))
+	self.writestring(" ")
+	self.write(strconv.AppendUint(nil, timeout, 10))
+	self.writestring(" ")
+	self.write(strconv.AppendInt(nil, int64(len(value)), 10))
+	if cas != 0 {
+		self.writestring(" ")
+		self.write(strconv.AppendUint(nil, cas, 10))
+	}
+	self.writestring("\r\n")
+	// <data block>\r\n
+	self.write(value)
+	self.writestring("\r\n")
+	reply := self.readline()
+	if strings.Contains(reply, "ERROR") {
+		panic(NewMemcacheError("%s", reply))
+	}
+	return strings.HasPrefix(reply, "STORED")
+}
+
+func (self *Connection) writestrings(strs ...string) {
+	for _, s := range strs {
+		self.writestring(s)
+	}
+}
+
+func (self *Connection) writestring(s string) {
+	if _, err := self.buffered.WriteString(s); err != nil {
+		self.fail(err)
+	}
+}
+
+func (self *Connection) write(b []byte) {
+	if _, err := self.buffered.Write(b); err != nil {
+		self.fail(err)
+	}
+}
+
+func (self *Connection) flush() {
+	if err := self.buffered.Flush(); err != nil {
+		self.fail(err)
+	}
+}
+
+func (self *Connection) readline() string {
+	self.flush()
+	l, isPrefix, err := self.buffered.ReadLine()
+	if isPrefix || err != nil {
+		self.fail(NewMemcacheError("Prefix: %v, %v", isPrefix, err))
+	}
+	return string(l)
+}
+
+func (self *Connection) read(count int) []byte {
+	self.flush()
+	buf := make([]byte, count)
+	if _, err := io.ReadFull(self.buffered, buf); err != nil {
+		self.fail(err)
+	}
+	return buf
+}
+
+// fail closes the connection because its state is unknown,
+// and aborts the current operation.
+func (self *Connection) fail(err error) {
+	self.Close()
+	panic(NewMemcacheError("%v", err))
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package memcache
+
+import (
+	"code.google.com/p/vitess/go/memcache/fakememcached"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func startServer(t *testing.T) (*fakememcached.Server, *Connection) {
+	address := fmt.Sprintf("/tmp/memcache_test-%d.sock", os.Getpid())
+	os.Remove(address)
+	server, err := fakememcached.Start(address)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	conn, err := Connect(address)
+	if err != nil {
+		server.Close()
+		t.Fatalf("Connect: %v", err)
+	}
+	return server, conn
+}
+
+func expect(t *testing.T, conn *Connection, key, value string) {
+	results, err := conn.Get(key)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	got := ""
+	if len(results) != 0 {
+		got = string(results[0].Value)
+	}
+	if got != value {
+		t.Errorf("Get(%s): want %q, got %q", key, value, got)
+	}
+}
+
+func TestMemcache(t *testing.T) {
+	server, conn := startServer(t)
+	defer server.Close()
+	defer conn.Close()
+
+	stored, err := conn.Set("Hello", 0, 0, []byte("world"))
+	if err != nil || !stored {
+		t.Fatalf("Set: %v %v", stored, err)
+	}
+	expect(t, conn, "Hello", "world")
+
+	stored, err = conn.Add("Hello", 0, 0, []byte("Jupiter"))
+	if err != nil || stored {
+		t.Errorf("Add of existing key: %v %v", stored, err)
+	}
+	expect(t, conn, "Hello", "world")
+
+	stored, err = conn.Replace("Hello", 0, 0, []byte("Mars"))
+	if err != nil || !stored {
+		t.Errorf("Replace: %v %v", stored, err)
+	}
+	expect(t, conn, "Hello", "Mars")
+
+	stored, err = conn.Replace("World", 0, 0, []byte("Mars"))
+	if err != nil || stored {
+		t.Errorf("Replace of missing key: %v %v", stored, err)
+	}
+	expect(t, conn, "World", "")
+
+	results, err := conn.Gets("Hello")
+	if err != nil || len(results) != 1 {
+		t.Fatalf("Gets: %v %v", results, err)
+	}
+	cas := results[0].Cas
+	stored, err = conn.Cas("Hello", 0, 0, []byte("Venus"), cas+1)
+	if err != nil || stored {
+		t.Errorf("Cas with bad value: %v %v", stored, err)
+	}
+	stored, err = conn.Cas("Hello", 0, 0, []byte("Venus"), cas)
+	if err != nil || !stored {
+		t.Errorf("Cas: %v %v", stored, err)
+	}
+	expect(t, conn, "Hello", "Venus")
+
+	deleted, err := conn.Delete("Hello")
+	if err != nil || !deleted {
+		t.Errorf("Delete: %v %v", deleted, err)
+	}
+	expect(t, conn, "Hello", "")
+	deleted, err = conn.Delete("Hello")
+	if err != nil || deleted {
+		t.Errorf("Delete of missing key: %v %v", deleted, err)
+	}
+
+	conn.Set("Hello", 3, 0, []byte("world"))
+	conn.Set("Goodbye", 0, 0, []byte("moon"))
+	results, err = conn.Get("Hello", "Missing", "Goodbye")
+	if err != nil || len(results) != 2 {
+		t.Fatalf("Get multiple: %v %v", results, err)
+	}
+	if results[0].Key != "Hello" || results[0].Flags != 3 || results[1].Key != "Goodbye" {
+		t.Errorf("Get multiple: %v", results)
+	}
+
+	if err = conn.FlushAll(); err != nil {
+		t.Errorf("FlushAll: %v", err)
+	}
+	expect(t, conn, "Hello", "")
+	expect(t, conn, "Goodbye", "")
+}
@@ -71,6 +71,7 @@ func handleError(err *error) {
 
 type Connection struct {
 	handle *C.MYSQL
+	result *C.MYSQL_RES // result of the current streaming query, if any
 }
 
 type QueryResult struct {
@@ -145,6 +146,65 @@ func (self *Connection) ExecuteFetch(query []byte, maxrows int) (qr *QueryResult
 	return qr, nil
 }
 
+// ExecuteStreamFetch starts a query whose rows are not buffered by the client
+// library. Rows must be read one at a time using FetchNext, and CloseResult
+// must be called once done. The connection cannot be used for other queries
+// till then.
+func (self *Connection) ExecuteStreamFetch(query []byte) (err error) {
+	defer handleError(&err)
+	self.validate()
+	if self.result != nil {
+		return NewSqlError(2014, "Streaming query already in progress")
+	}
+
+	if C.mysql_real_query(self.handle, (*C.char)(unsafe.Pointer(&query[0])), C.ulong(len(query))) != 0 {
+		return self.lastError(query)
+	}
+
+	result := C.mysql_use_result(self.handle)
+	if result == nil {
+		// Even a query that returns no data is an error here
+		return self.lastError(query)
+	}
+	self.result = result
+	return nil
+}
+
+// Fields returns the fields of the current streaming query.
+func (self *Connection) Fields() []Field {
+	if self.result == nil {
+		return nil
+	}
+	return self.buildFields(self.result)
+}
+
+// FetchNext returns the next row of the current streaming query.
+// It returns a nil row once there are no more rows.
+func (self *Connection) FetchNext() (row []interface{}, err error) {
+	defer handleError(&err)
+	if self.result == nil {
+		return nil, NewSqlError(2014, "No streaming query in progress")
+	}
+	rowPtr := C.mysql_fetch_row(self.result)
+	if rowPtr == nil {
+		if C.mysql_errno(self.handle) != 0 {
+			return nil, self.lastError(nil)
+		}
+		return nil, nil
+	}
+	return self.buildRow(self.result, rowPtr, int(C.mysql_num_fields(self.result))), nil
+}
+
+// CloseResult ends the current streaming query.
+// Any unread rows will be fetched and discarded.
+func (self *Connection) CloseResult() {
+	if self.result == nil {
+		return
+	}
+	C.mysql_free_result(self.result)
+	self.result = nil
+}
+
 func (self *Connection) Id() int64 {
 	if self.handle == nil {
 		return 0
@@ -156,6 +216,10 @@ func (self *Connection) Close() {
 	if self.handle == nil {
 		return
 	}
+	// The result of a streaming query must be freed while the handle
+	// is valid. This reads and discards the rows that are left, so
+	// callers that abandon a big stream should kill the query first.
+	self.CloseResult()
 	C.mysql_close(self.handle)
 	self.handle = nil
 }
@@ -193,10 +257,15 @@ func (self *Connection) fetchAll(result *C.MYSQL_RES) (rows [][]interface{}) {
 }
 
 func (self *Connection) fetchNext(result *C.MYSQL_RES, colCount int) (row []interface{}) {
-	rowPtr := (*[1 << 30]*[1 << 30]byte)(unsafe.Pointer(C.mysql_fetch_row(result)))
+	rowPtr := C.mysql_fetch_row(result)
 	if rowPtr == nil {
 		panic(self.lastError(nil))
 	}
+	return self.buildRow(result, rowPtr, colCount)
+}
+
+func (self *Connection) buildRow(result *C.MYSQL_RES, crow C.MYSQL_ROW, colCount int) (row []interface{}) {
+	rowPtr := (*[1 << 30]*[1 << 30]byte)(unsafe.Pointer(crow))
 	row = make([]interface{}, colCount)
 	lengths := (*[1 << 30]uint64)(unsafe.Pointer(C.mysql_fetch_lengths(result)))
 	totalLength := uint64(0)
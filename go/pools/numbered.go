@@ -125,6 +125,18 @@ func (self *Numbered) GetTimedout(timeout time.Duration) (vals []interface{}) {
 	return vals
 }
 
+// GetAll returns all the resources in the pool. It does not lock them,
+// and the values must be treated as read-only.
+func (self *Numbered) GetAll() (vals []interface{}) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	vals = make([]interface{}, 0, len(self.resources))
+	for _, nw := range self.resources {
+		vals = append(vals, nw.val)
+	}
+	return vals
+}
+
 // WaitForEmpty returns as soon as the pool becomes empty
 func (self *Numbered) WaitForEmpty() {
 	self.mu.Lock()
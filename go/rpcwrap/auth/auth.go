@@ -0,0 +1,206 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+// Package auth implements a CRAM-MD5 style challenge-response
+// authentication for rpcwrap. Clients get a challenge with
+// AuthenticatorCRAMMD5.GetNewChallenge, and prove they know
+// their password by answering it with AuthenticatorCRAMMD5.Authenticate.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/vitess/go/relog"
+	"code.google.com/p/vitess/go/rpcplus"
+	"code.google.com/p/vitess/go/rpcwrap/proto"
+)
+
+// CHALLENGE_TIMEOUT is how long a challenge can be answered.
+const CHALLENGE_TIMEOUT = 60 * time.Second
+
+// MAX_CHALLENGES caps the number of challenges waiting for an answer.
+const MAX_CHALLENGES = 10000
+
+// AuthenticationServer serves the requests of connections that
+// haven't authenticated yet. It only knows the authentication methods.
+var AuthenticationServer = rpcplus.NewServer()
+
+var authenticator = &AuthenticatorCRAMMD5{challenges: make(map[string]time.Time)}
+
+func init() {
+	AuthenticationServer.Register(authenticator)
+}
+
+// LoadCredentials reads the credentials file, a JSON map of user names
+// to lists of passwords, and makes authentication mandatory. A user
+// can have several passwords to allow changing them without downtime.
+func LoadCredentials(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	credentials := make(map[string][]string)
+	if err = json.Unmarshal(data, &credentials); err != nil {
+		return fmt.Errorf("could not parse %s: %v", filename, err)
+	}
+	authenticator.setCredentials(credentials)
+	relog.Info("loaded credentials of %d users from %s", len(credentials), filename)
+	return nil
+}
+
+// Required returns true if credentials were loaded, in which case
+// connections must authenticate before they can call anything else.
+func Required() bool {
+	return authenticator.required()
+}
+
+// CheckProof verifies an answer to a challenge that was handed out by
+// GetNewChallenge, and returns the user it authenticates. A challenge
+// can only be answered once.
+func CheckProof(challenge, proof string) (username string, err error) {
+	return authenticator.checkProof(challenge, proof)
+}
+
+// Proof returns the answer of username to challenge:
+// username, a space, and the hex HMAC-MD5 of challenge keyed by password.
+func Proof(username, password, challenge string) string {
+	return username + " " + digest(password, challenge)
+}
+
+func digest(password, challenge string) string {
+	h := hmac.New(md5.New, []byte(password))
+	h.Write([]byte(challenge))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type GetNewChallengeRequest struct{}
+
+type GetNewChallengeReply struct {
+	Challenge string
+}
+
+type AuthenticateRequest struct {
+	Challenge string
+	Proof     string
+}
+
+type AuthenticateReply struct{}
+
+// AuthenticatorCRAMMD5 is the RPC service of AuthenticationServer.
+type AuthenticatorCRAMMD5 struct {
+	mu          sync.Mutex
+	credentials map[string][]string
+	challenges  map[string]time.Time // by challenge, the time it expires
+}
+
+func (self *AuthenticatorCRAMMD5) setCredentials(credentials map[string][]string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.credentials = credentials
+}
+
+func (self *AuthenticatorCRAMMD5) required() bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.credentials != nil
+}
+
+func (self *AuthenticatorCRAMMD5) GetNewChallenge(context *proto.Context, request *GetNewChallengeRequest, reply *GetNewChallengeReply) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	reply.Challenge = fmt.Sprintf("<%x.%d@%s>", nonce, now.Unix(), hostname)
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if len(self.challenges) >= MAX_CHALLENGES {
+		for challenge, expiry := range self.challenges {
+			if now.After(expiry) {
+				delete(self.challenges, challenge)
+			}
+		}
+		if len(self.challenges) >= MAX_CHALLENGES {
+			return errors.New("too many pending challenges")
+		}
+	}
+	self.challenges[reply.Challenge] = now.Add(CHALLENGE_TIMEOUT)
+	return nil
+}
+
+// Authenticate sets the Username of context if the request answers
+// its challenge.
+func (self *AuthenticatorCRAMMD5) Authenticate(context *proto.Context, request *AuthenticateRequest, reply *AuthenticateReply) error {
+	username, err := self.checkProof(request.Challenge, request.Proof)
+	if err != nil {
+		relog.Warning("authentication failed for %s: %v", context.RemoteAddr, err)
+		return err
+	}
+	context.Username = username
+	return nil
+}
+
+func (self *AuthenticatorCRAMMD5) checkProof(challenge, proof string) (username string, err error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	expiry, ok := self.challenges[challenge]
+	if !ok {
+		return "", errors.New("unknown challenge")
+	}
+	delete(self.challenges, challenge)
+	if time.Now().After(expiry) {
+		return "", errors.New("challenge expired")
+	}
+	parts := strings.Split(proof, " ")
+	if len(parts) != 2 {
+		return "", errors.New("malformed proof")
+	}
+	username = parts[0]
+	for _, password := range self.credentials[username] {
+		if hmac.Equal([]byte(digest(password, challenge)), []byte(parts[1])) {
+			return username, nil
+		}
+	}
+	return "", fmt.Errorf("invalid credentials for %s", username)
+}
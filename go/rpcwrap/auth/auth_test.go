@@ -0,0 +1,81 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"code.google.com/p/vitess/go/rpcwrap/proto"
+)
+
+func TestAuthenticate(t *testing.T) {
+	a := &AuthenticatorCRAMMD5{challenges: make(map[string]time.Time)}
+	a.setCredentials(map[string][]string{"bob": []string{"old", "new"}})
+	context := &proto.Context{}
+
+	authenticate := func(username, password string) error {
+		var challenge GetNewChallengeReply
+		if err := a.GetNewChallenge(context, &GetNewChallengeRequest{}, &challenge); err != nil {
+			t.Fatalf("GetNewChallenge: %v", err)
+		}
+		request := &AuthenticateRequest{challenge.Challenge, Proof(username, password, challenge.Challenge)}
+		return a.Authenticate(context, request, &AuthenticateReply{})
+	}
+	if err := authenticate("bob", "bad"); err == nil || context.Username != "" {
+		t.Errorf("want failure for a bad password")
+	}
+	if err := authenticate("alice", "new"); err == nil || context.Username != "" {
+		t.Errorf("want failure for an unknown user")
+	}
+	for _, password := range []string{"old", "new"} {
+		context.Username = ""
+		if err := authenticate("bob", password); err != nil || context.Username != "bob" {
+			t.Errorf("password %s: %v, username %q", password, err, context.Username)
+		}
+	}
+
+	var challenge GetNewChallengeReply
+	a.GetNewChallenge(context, &GetNewChallengeRequest{}, &challenge)
+	proof := Proof("bob", "new", challenge.Challenge)
+	if _, err := a.checkProof(challenge.Challenge, proof); err != nil {
+		t.Errorf("checkProof: %v", err)
+	}
+	if _, err := a.checkProof(challenge.Challenge, proof); err == nil {
+		t.Errorf("want failure for a reused challenge")
+	}
+	a.GetNewChallenge(context, &GetNewChallengeRequest{}, &challenge)
+	a.challenges[challenge.Challenge] = time.Now().Add(-time.Second)
+	if _, err := a.checkProof(challenge.Challenge, Proof("bob", "new", challenge.Challenge)); err == nil {
+		t.Errorf("want failure for an expired challenge")
+	}
+}
@@ -34,9 +34,9 @@ package bsonrpc
 import (
 	"bytes"
 	"code.google.com/p/vitess/go/bson"
+	"code.google.com/p/vitess/go/rpcplus"
 	"code.google.com/p/vitess/go/rpcwrap"
 	"io"
-	"net/rpc"
 )
 
 const (
@@ -47,13 +47,13 @@ type ClientCodec struct {
 	rwc io.ReadWriteCloser
 }
 
-func NewClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+func NewClientCodec(conn io.ReadWriteCloser) rpcplus.ClientCodec {
 	return &ClientCodec{conn}
 }
 
 const DefaultBufferSize = 4096
 
-func (self *ClientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+func (self *ClientCodec) WriteRequest(r *rpcplus.Request, body interface{}) error {
 	buf := bytes.NewBuffer(make([]byte, 0, DefaultBufferSize))
 	if err := bson.MarshalToBuffer(buf, &RequestBson{r}); err != nil {
 		return err
@@ -65,7 +65,7 @@ func (self *ClientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
 	return err
 }
 
-func (self *ClientCodec) ReadResponseHeader(r *rpc.Response) error {
+func (self *ClientCodec) ReadResponseHeader(r *rpcplus.Response) error {
 	return bson.UnmarshalFromStream(self.rwc, &ResponseBson{r})
 }
 
@@ -81,11 +81,11 @@ type ServerCodec struct {
 	rwc io.ReadWriteCloser
 }
 
-func NewServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+func NewServerCodec(conn io.ReadWriteCloser) rpcplus.ServerCodec {
 	return &ServerCodec{conn}
 }
 
-func (self *ServerCodec) ReadRequestHeader(r *rpc.Request) error {
+func (self *ServerCodec) ReadRequestHeader(r *rpcplus.Request) error {
 	return bson.UnmarshalFromStream(self.rwc, &RequestBson{r})
 }
 
@@ -93,7 +93,7 @@ func (self *ServerCodec) ReadRequestBody(body interface{}) error {
 	return bson.UnmarshalFromStream(self.rwc, body)
 }
 
-func (self *ServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+func (self *ServerCodec) WriteResponse(r *rpcplus.Response, body interface{}, last bool) error {
 	buf := bytes.NewBuffer(make([]byte, 0, DefaultBufferSize))
 	if err := bson.MarshalToBuffer(buf, &ResponseBson{r}); err != nil {
 		return err
@@ -109,10 +109,14 @@ func (self *ServerCodec) Close() error {
 	return self.rwc.Close()
 }
 
-func DialHTTP(network, address string) (*rpc.Client, error) {
+func DialHTTP(network, address string) (*rpcplus.Client, error) {
 	return rpcwrap.DialHTTP(network, address, codecName, NewClientCodec)
 }
 
+func DialAuthHTTP(network, address, username, password string) (*rpcplus.Client, error) {
+	return rpcwrap.DialAuthHTTP(network, address, username, password, codecName, NewClientCodec)
+}
+
 func ServeRPC() {
 	rpcwrap.ServeRPC(codecName, NewServerCodec)
 }
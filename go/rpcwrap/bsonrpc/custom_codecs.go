@@ -34,11 +34,11 @@ package bsonrpc
 import (
 	"bytes"
 	"code.google.com/p/vitess/go/bson"
-	"net/rpc"
+	"code.google.com/p/vitess/go/rpcplus"
 )
 
 type RequestBson struct {
-	*rpc.Request
+	*rpcplus.Request
 }
 
 func (self *RequestBson) MarshalBson(buf *bytes.Buffer) {
@@ -73,7 +73,7 @@ func (self *RequestBson) UnmarshalBson(buf *bytes.Buffer) {
 }
 
 type ResponseBson struct {
-	*rpc.Response
+	*rpcplus.Response
 }
 
 func (self *ResponseBson) MarshalBson(buf *bytes.Buffer) {
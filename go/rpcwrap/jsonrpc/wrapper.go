@@ -32,15 +32,19 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package jsonrpc
 
 import (
+	"code.google.com/p/vitess/go/rpcplus"
+	oldjson "code.google.com/p/vitess/go/rpcplus/jsonrpc"
 	"code.google.com/p/vitess/go/rpcwrap"
-	"net/rpc"
-	oldjson "net/rpc/jsonrpc"
 )
 
-func DialHTTP(network, address string) (*rpc.Client, error) {
+func DialHTTP(network, address string) (*rpcplus.Client, error) {
 	return rpcwrap.DialHTTP(network, address, "json", oldjson.NewClientCodec)
 }
 
+func DialAuthHTTP(network, address, username, password string) (*rpcplus.Client, error) {
+	return rpcwrap.DialAuthHTTP(network, address, username, password, "json", oldjson.NewClientCodec)
+}
+
 func ServeRPC() {
 	rpcwrap.ServeRPC("json", oldjson.NewServerCodec)
 }
@@ -37,16 +37,19 @@ import (
 	"io"
 	"net"
 	"net/http"
-	"net/rpc"
+	"strings"
 
 	"code.google.com/p/vitess/go/relog"
+	"code.google.com/p/vitess/go/rpcplus"
+	"code.google.com/p/vitess/go/rpcwrap/auth"
+	"code.google.com/p/vitess/go/rpcwrap/proto"
 )
 
 const (
 	connected = "200 Connected to Go RPC"
 )
 
-type ClientCodecFactory func(conn io.ReadWriteCloser) rpc.ClientCodec
+type ClientCodecFactory func(conn io.ReadWriteCloser) rpcplus.ClientCodec
 
 type BufferedConnection struct {
 	*bufio.Reader
@@ -58,7 +61,7 @@ func NewBufferedConnection(conn io.ReadWriteCloser) *BufferedConnection {
 }
 
 // DialHTTP connects to a go HTTP RPC server using the specified codec.
-func DialHTTP(network, address, codecName string, cFactory ClientCodecFactory) (*rpc.Client, error) {
+func DialHTTP(network, address, codecName string, cFactory ClientCodecFactory) (*rpcplus.Client, error) {
 	var err error
 	conn, err := net.Dial(network, address)
 	if err != nil {
@@ -71,7 +74,7 @@ func DialHTTP(network, address, codecName string, cFactory ClientCodecFactory) (
 	buffered := NewBufferedConnection(conn)
 	resp, err := http.ReadResponse(buffered.Reader, &http.Request{Method: "CONNECT"})
 	if err == nil && resp.Status == connected {
-		return rpc.NewClientWithCodec(cFactory(buffered)), nil
+		return rpcplus.NewClientWithCodec(cFactory(buffered)), nil
 	}
 	if err == nil {
 		err = errors.New("unexpected HTTP response: " + resp.Status)
@@ -80,7 +83,30 @@ func DialHTTP(network, address, codecName string, cFactory ClientCodecFactory) (
 	return nil, &net.OpError{"dial-http", network + " " + address, nil, err}
 }
 
-type ServerCodecFactory func(conn io.ReadWriteCloser) rpc.ServerCodec
+// DialAuthHTTP is like DialHTTP, but authenticates the connection
+// as username before returning it.
+func DialAuthHTTP(network, address, username, password, codecName string, cFactory ClientCodecFactory) (*rpcplus.Client, error) {
+	client, err := DialHTTP(network, address, codecName, cFactory)
+	if err != nil {
+		return nil, err
+	}
+	var challenge auth.GetNewChallengeReply
+	if err = client.Call("AuthenticatorCRAMMD5.GetNewChallenge", &auth.GetNewChallengeRequest{}, &challenge); err != nil {
+		client.Close()
+		return nil, err
+	}
+	request := &auth.AuthenticateRequest{
+		Challenge: challenge.Challenge,
+		Proof:     auth.Proof(username, password, challenge.Challenge),
+	}
+	if err = client.Call("AuthenticatorCRAMMD5.Authenticate", request, &auth.AuthenticateReply{}); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+type ServerCodecFactory func(conn io.ReadWriteCloser) rpcplus.ServerCodec
 
 // ServeRPC handles rpc requests using the hijack scheme of rpc
 func ServeRPC(codecName string, cFactory ServerCodecFactory) {
@@ -103,7 +129,20 @@ func (self *rpcHandler) ServeHTTP(c http.ResponseWriter, req *http.Request) {
 		return
 	}
 	io.WriteString(conn, "HTTP/1.0 "+connected+"\n\n")
-	rpc.ServeCodec(self.cFactory(NewBufferedConnection(conn)))
+	codec := self.cFactory(NewBufferedConnection(conn))
+	context := &proto.Context{RemoteAddr: req.RemoteAddr}
+	// Until the connection authenticates, it can only
+	// call the methods of the AuthenticationServer.
+	for auth.Required() && context.Username == "" {
+		if err := auth.AuthenticationServer.ServeRequestWithContext(codec, context); err != nil {
+			if err != io.EOF {
+				relog.Warning("rpcwrap: closing unauthenticated connection from %s: %v", req.RemoteAddr, err)
+			}
+			codec.Close()
+			return
+		}
+	}
+	rpcplus.ServeCodecWithContext(codec, context)
 }
 
 func GetRpcPath(codecName string) string {
@@ -114,14 +153,41 @@ type httpHandler struct {
 	cFactory ServerCodecFactory
 }
 
+// ServeHTTP serves one request. If authentication is required, the
+// request must carry an answer to a challenge in an Authorization
+// header of the form "CRAM-MD5 <challenge> <username> <digest>".
+// Requests without one can only get new challenges.
 func (self *httpHandler) ServeHTTP(c http.ResponseWriter, req *http.Request) {
 	conn := &httpConnectionBroker{c, req.Body}
 	codec := self.cFactory(conn)
-	if err := rpc.ServeRequest(codec); err != nil {
+	context := &proto.Context{RemoteAddr: req.RemoteAddr}
+	server := rpcplus.DefaultServer
+	if auth.Required() {
+		if authorization := req.Header.Get("Authorization"); authorization != "" {
+			username, err := checkAuthorization(authorization)
+			if err != nil {
+				relog.Warning("rpcwrap: authentication failed for %s: %v", req.RemoteAddr, err)
+				http.Error(c, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			context.Username = username
+		} else {
+			server = auth.AuthenticationServer
+		}
+	}
+	if err := server.ServeRequestWithContext(codec, context); err != nil {
 		relog.Error("rpcwrap: %v", err)
 	}
 }
 
+func checkAuthorization(authorization string) (username string, err error) {
+	parts := strings.SplitN(authorization, " ", 3)
+	if len(parts) != 3 || parts[0] != "CRAM-MD5" {
+		return "", errors.New("malformed Authorization header")
+	}
+	return auth.CheckProof(parts[1], parts[2])
+}
+
 // Emulate a read/write connection for the server codec
 type httpConnectionBroker struct {
 	http.ResponseWriter
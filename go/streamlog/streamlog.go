@@ -0,0 +1,134 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+// Package streamlog provides a non-blocking message broadcaster.
+// Messages are typically streamed to HTTP clients. A subscriber that
+// can't keep up loses messages instead of slowing down the sender.
+package streamlog
+
+import (
+	"code.google.com/p/vitess/go/relog"
+	"code.google.com/p/vitess/go/stats"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+var (
+	sendCount = stats.NewCounters("StreamlogSend")
+	dropCount = stats.NewCounters("StreamlogDrops")
+)
+
+// Formatter is implemented by the messages sent to a StreamLogger.
+// Format returns the text to be sent to a subscriber, or "" if
+// the message should be skipped. params are the query parameters
+// of the HTTP request of the subscriber.
+type Formatter interface {
+	Format(params url.Values) string
+}
+
+type StreamLogger struct {
+	name       string
+	size       int
+	mu         sync.Mutex
+	subscribed map[chan Formatter]bool
+}
+
+// New creates a StreamLogger. size is the number of messages that
+// can be buffered for each subscriber.
+func New(name string, size int) *StreamLogger {
+	return &StreamLogger{
+		name:       name,
+		size:       size,
+		subscribed: make(map[chan Formatter]bool),
+	}
+}
+
+// Send sends message to all subscribers. It never blocks.
+func (self *StreamLogger) Send(message Formatter) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for ch := range self.subscribed {
+		select {
+		case ch <- message:
+			sendCount.Add(self.name, 1)
+		default:
+			dropCount.Add(self.name, 1)
+		}
+	}
+}
+
+func (self *StreamLogger) Subscribe() chan Formatter {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	ch := make(chan Formatter, self.size)
+	self.subscribed[ch] = true
+	return ch
+}
+
+func (self *StreamLogger) Unsubscribe(ch chan Formatter) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	delete(self.subscribed, ch)
+}
+
+// ServeHTTP streams the messages to the client till it goes away.
+func (self *StreamLogger) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if err := request.ParseForm(); err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ch := self.Subscribe()
+	defer self.Unsubscribe(ch)
+	relog.Info("%s: streaming to %s", self.name, request.RemoteAddr)
+
+	response.Header().Set("Content-Type", "text/plain")
+	// Let the client know we're ready
+	response.WriteHeader(http.StatusOK)
+	flusher, _ := response.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	for message := range ch {
+		text := message.Format(request.Form)
+		if text == "" {
+			continue
+		}
+		if _, err := io.WriteString(response, text); err != nil {
+			break
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	relog.Info("%s: stopped streaming to %s", self.name, request.RemoteAddr)
+}
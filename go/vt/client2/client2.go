@@ -30,7 +30,9 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 */
 
 // API compliant to the requirements of database/sql
-// Open expects name to be "hostname:port/dbname"
+// Open expects name to be "hostname:port/dbname", optionally
+// prefixed by "username:password@" if the server requires
+// authentication
 // For query arguments, we assume place-holders in the query string
 // in the form of :v0, :v1, etc.
 package client2
@@ -40,9 +42,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"net/rpc"
 	"strings"
 
+	"code.google.com/p/vitess/go/mysql"
+	"code.google.com/p/vitess/go/rpcplus"
+	"code.google.com/p/vitess/go/rpcwrap/bsonrpc"
 	"code.google.com/p/vitess/go/vt/tabletserver"
 )
 
@@ -51,7 +55,10 @@ type Driver struct {
 }
 
 type Conn struct {
-	rpcClient *rpc.Client
+	address   string
+	username  string
+	password  string
+	rpcClient *rpcplus.Client
 	tabletserver.Session
 }
 
@@ -69,21 +76,49 @@ type Result struct {
 	index int
 }
 
+// StreamResult is a driver.Rows that reads the rows of a streaming
+// query as they arrive from the server.
+type StreamResult struct {
+	conn   *Conn
+	call   *rpcplus.Call
+	sr     chan *tabletserver.QueryResult
+	fields []mysql.Field
+	qr     *tabletserver.QueryResult
+	index  int
+	err    error
+}
+
 func NewDriver(address string) *Driver {
 	return &Driver{address}
 }
 
 func (self Driver) Open(name string) (driver.Conn, error) {
+	// name is address/dbname, or address/dbname/caller
 	conn := &Conn{}
+	if i := strings.LastIndex(name, "@"); i != -1 {
+		credentials := strings.SplitN(name[:i], ":", 2)
+		if len(credentials) != 2 {
+			return nil, errors.New("Incorrectly formatted credentials")
+		}
+		conn.username, conn.password = credentials[0], credentials[1]
+		name = name[i+1:]
+	}
 	connValues := strings.Split(name, "/")
-	if len(connValues) != 2 {
+	if len(connValues) != 2 && len(connValues) != 3 {
 		return nil, errors.New("Incorrectly formatted name")
 	}
+	conn.address = connValues[0]
 	var err error
-	if conn.rpcClient, err = rpc.DialHTTP("tcp", connValues[0]); err != nil {
+	if conn.rpcClient, err = conn.dial(); err != nil {
 		return nil, err
 	}
-	if err = conn.rpcClient.Call("OccManager.GetSessionId", connValues[1], &conn.SessionId); err != nil {
+	if len(connValues) == 3 {
+		sessionParams := &tabletserver.SessionParams{DbName: connValues[1], Caller: connValues[2]}
+		err = conn.rpcClient.Call("OccManager.GetCallerSessionId", sessionParams, &conn.SessionId)
+	} else {
+		err = conn.rpcClient.Call("OccManager.GetSessionId", connValues[1], &conn.SessionId)
+	}
+	if err != nil {
 		return nil, err
 	}
 	return conn, nil
@@ -98,6 +133,25 @@ func (self *Conn) Close() error {
 	return self.rpcClient.Close()
 }
 
+// reconnect replaces the connection to the server. Closing the
+// connection is the only way to abort a stream. The session and
+// its transactions live on the server, so they survive.
+func (self *Conn) reconnect() (err error) {
+	self.rpcClient.Close()
+	self.rpcClient, err = self.dial()
+	return err
+}
+
+// dial uses the bson endpoint to authenticate if there are
+// credentials. The gob endpoint is off when the server requires
+// authentication.
+func (self *Conn) dial() (*rpcplus.Client, error) {
+	if self.username == "" {
+		return rpcplus.DialHTTP("tcp", self.address)
+	}
+	return bsonrpc.DialAuthHTTP("tcp", self.address, self.username, self.password)
+}
+
 func (self *Conn) Execute(query string, bindVars map[string]interface{}) (*tabletserver.QueryResult, error) {
 	var result tabletserver.QueryResult
 	req := &tabletserver.Query{
@@ -125,6 +179,38 @@ func (self *Conn) Exec(query string, args []interface{}) (*Result, error) {
 	return &Result{qr, 0}, nil
 }
 
+// StreamExecute starts a streaming query. The rows are fetched from
+// the server incrementally as the returned StreamResult is read.
+func (self *Conn) StreamExecute(query string, bindVars map[string]interface{}) (*StreamResult, error) {
+	req := &tabletserver.Query{
+		Sql:           query,
+		BindVariables: bindVars,
+		TransactionId: self.TransactionId,
+		ConnectionId:  self.ConnectionId,
+		SessionId:     self.SessionId,
+	}
+	sr := make(chan *tabletserver.QueryResult, 10)
+	call := self.rpcClient.StreamGo("SqlQuery.StreamExecute", req, sr)
+
+	// The first result contains the fields
+	first, ok := <-sr
+	if !ok {
+		if call.Error == nil {
+			return nil, errors.New("no fields returned")
+		}
+		return nil, call.Error
+	}
+	return &StreamResult{conn: self, call: call, sr: sr, fields: first.Fields}, nil
+}
+
+func (self *Conn) StreamExec(query string, args []interface{}) (*StreamResult, error) {
+	bindVars := make(map[string]interface{})
+	for i, v := range args {
+		bindVars[fmt.Sprintf("v%d", i)] = v
+	}
+	return self.StreamExecute(query, bindVars)
+}
+
 func (self *Conn) Begin() (driver.Tx, error) {
 	if self.TransactionId != 0 {
 		return Tx{}, errors.New("already in a transaction")
@@ -206,10 +292,59 @@ func (self *Result) Next(dest []interface{}) error {
 		return io.EOF
 	}
 	defer func() { self.index++ }()
-	for i, v := range self.qr.Rows[self.index] {
-		if v != nil {
-			dest[i] = convert(int(self.qr.Fields[i].Type), v.(string))
+	populateRow(dest, self.qr.Fields, self.qr.Rows[self.index])
+	return nil
+}
+
+func (self *StreamResult) Columns() (cols []string) {
+	cols = make([]string, len(self.fields))
+	for i, f := range self.fields {
+		cols[i] = f.Name
+	}
+	return cols
+}
+
+// Close stops reading the stream. If the stream isn't over, the
+// server is made to abort it by closing the connection, and the
+// Conn reconnects.
+func (self *StreamResult) Close() error {
+	self.qr = nil
+	if self.err != nil {
+		return nil
+	}
+	self.err = io.EOF
+	return self.conn.reconnect()
+}
+
+func (self *StreamResult) Next(dest []interface{}) error {
+	if len(dest) != len(self.fields) {
+		return errors.New("length mismatch")
+	}
+	if self.err != nil {
+		return self.err
+	}
+	for self.qr == nil || self.index >= len(self.qr.Rows) {
+		qr, ok := <-self.sr
+		if !ok {
+			if self.call.Error != nil {
+				self.err = self.call.Error
+			} else {
+				self.err = io.EOF
+			}
+			return self.err
 		}
+		self.qr = qr
+		self.index = 0
 	}
+	defer func() { self.index++ }()
+	populateRow(dest, self.fields, self.qr.Rows[self.index])
 	return nil
 }
+
+func populateRow(dest []interface{}, fields []mysql.Field, row []interface{}) {
+	for i, v := range row {
+		if v != nil {
+			dest[i] = convert(int(fields[i].Type), v.(string))
+		}
+	}
+}
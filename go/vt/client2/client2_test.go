@@ -33,8 +33,20 @@ package client2
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
 	"testing"
+
+	"code.google.com/p/vitess/go/mysql"
+	"code.google.com/p/vitess/go/rpcplus"
+	"code.google.com/p/vitess/go/rpcwrap/auth"
+	"code.google.com/p/vitess/go/rpcwrap/bsonrpc"
+	rpcproto "code.google.com/p/vitess/go/rpcwrap/proto"
+	"code.google.com/p/vitess/go/vt/tabletserver"
 )
 
 // This is more of an example code than a real test
@@ -60,3 +72,70 @@ func TestExec(t *testing.T) {
 		fmt.Printf("%d %s\n", id, name)
 	}
 }
+
+type OccManager struct{}
+
+func (self *OccManager) GetSessionId(context *rpcproto.Context, dbname *string, sessionId *int64) error {
+	if context.Username != "user" {
+		return errors.New("not authenticated")
+	}
+	*sessionId = 1
+	return nil
+}
+
+type SqlQuery struct{}
+
+func (self *SqlQuery) Execute(query *tabletserver.Query, reply *tabletserver.QueryResult) error {
+	reply.Fields = []mysql.Field{{Name: "id", Type: 3}}
+	reply.RowsAffected = 1
+	reply.Rows = [][]interface{}{{"1"}}
+	return nil
+}
+
+func startAuthServer(t *testing.T) string {
+	file, err := ioutil.TempFile("", "client2_test")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`{"user": ["secret"]}`)
+	file.Close()
+	if err = auth.LoadCredentials(file.Name()); err != nil {
+		t.Fatalf("LoadCredentials: %v", err)
+	}
+	rpcplus.Register(&OccManager{})
+	rpcplus.Register(&SqlQuery{})
+	bsonrpc.ServeRPC()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go http.Serve(listener, nil)
+	return listener.Addr().String()
+}
+
+func TestAuthenticatedConn(t *testing.T) {
+	address := startAuthServer(t)
+	if _, err := NewDriver("").Open("user:wrong@" + address + "/testdb"); err == nil {
+		t.Errorf("Open with a wrong password: want error")
+	}
+	dconn, err := NewDriver("").Open("user:secret@" + address + "/testdb")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	conn := dconn.(*Conn)
+	defer conn.Close()
+	if conn.SessionId != 1 {
+		t.Errorf("want session 1, got %d", conn.SessionId)
+	}
+	for i := 0; i < 2; i++ {
+		qr, err := conn.Execute("select id from t", nil)
+		if err != nil || qr.RowsAffected != 1 {
+			t.Errorf("Execute: want 1 row, got %v, %v", qr, err)
+		}
+		// Reconnecting, which aborts streams, must authenticate again
+		if err = conn.reconnect(); err != nil {
+			t.Fatalf("reconnect: %v", err)
+		}
+	}
+}
@@ -87,10 +87,11 @@ func (self *Table) AddIndex(name string) (index *Index) {
 type Index struct {
 	Name    string
 	Columns []string
+	Unique  bool
 }
 
 func NewIndex(name string) *Index {
-	return &Index{name, make([]string, 0, 8)}
+	return &Index{name, make([]string, 0, 8), false}
 }
 
 func (self *Index) AddColumn(name string) {
@@ -158,6 +158,10 @@ func (self *Node) Format(buf *TrackedBuffer) {
 		Fprintf(buf, "%s table %v", self.Value, self.At(0))
 	case RENAME:
 		Fprintf(buf, "%s table %v %v", self.Value, self.At(0), self.At(1))
+	case SAVEPOINT:
+		Fprintf(buf, "savepoint %v", self.At(0))
+	case ROLLBACK:
+		Fprintf(buf, "rollback to savepoint %v", self.At(0))
 	case WHERE, HAVING:
 		if self.Len() > 0 {
 			Fprintf(buf, " %s %v", self.Value, self.At(0))
@@ -203,12 +207,22 @@ func (self *Node) Format(buf *TrackedBuffer) {
 		if self.Len() != 0 {
 			Fprintf(buf, " on duplicate key update %v", self.At(0))
 		}
-	case NUMBER, NULL, ID, SELECT_STAR, NO_DISTINCT, COMMENT, FOR_UPDATE, NOT_FOR_UPDATE, TABLE:
+	case NUMBER:
+		if buf.normalize {
+			buf.WriteByte('?')
+			return
+		}
+		Fprintf(buf, "%s", self.Value)
+	case NULL, ID, SELECT_STAR, NO_DISTINCT, COMMENT, FOR_UPDATE, NOT_FOR_UPDATE, TABLE:
 		Fprintf(buf, "%s", self.Value)
 	case VALUE_ARG:
 		buf.bind_locations = append(buf.bind_locations, BindLocation{buf.Len(), len(self.Value)})
 		Fprintf(buf, "%s", self.Value)
 	case STRING:
+		if buf.normalize {
+			buf.WriteByte('?')
+			return
+		}
 		buf.WriteByte('\'')
 		for _, ch := range self.Value {
 			if encodedChar, ok := escapeEncodeMap[ch]; ok {
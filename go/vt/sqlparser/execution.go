@@ -51,14 +51,52 @@ const (
 	PLAN_INSERT_PK
 	PLAN_INSERT_SUBQUERY
 	PLAN_SET
+	PLAN_SAVEPOINT
+	PLAN_ROLLBACK_SAVEPOINT
+	PLAN_DDL // Only used by query rules
 )
 
+var planName = []string{
+	"PASS_SELECT",
+	"PASS_DML",
+	"SELECT_CACHE_RESULT",
+	"SELECT_PK",
+	"SELECT_SUBQUERY",
+	"DML_PK",
+	"DML_SUBQUERY",
+	"INSERT_PK",
+	"INSERT_SUBQUERY",
+	"SET",
+	"SAVEPOINT",
+	"ROLLBACK_SAVEPOINT",
+	"DDL",
+}
+
+func (self PlanType) String() string {
+	if self < 0 || int(self) >= len(planName) {
+		return ""
+	}
+	return planName[self]
+}
+
 func (self PlanType) IsSelect() bool {
 	return self == PLAN_PASS_SELECT || self == PLAN_SELECT_CACHE_RESULT || self == PLAN_SELECT_PK || self == PLAN_SELECT_SUBQUERY
 }
 
+// PlanByName returns the PlanType for a name as returned by String.
+func PlanByName(s string) (pt PlanType, ok bool) {
+	for i, v := range planName {
+		if v == s {
+			return PlanType(i), true
+		}
+	}
+	return 0, false
+}
+
+type ReasonType int
+
 const (
-	REASON_DEFAULT = iota
+	REASON_DEFAULT ReasonType = iota
 	REASON_SELECT
 	REASON_TABLE
 	REASON_NOCACHE
@@ -71,11 +109,45 @@ const (
 	REASON_PK_CHANGE
 )
 
+var reasonName = []string{
+	"DEFAULT",
+	"SELECT",
+	"TABLE",
+	"NOCACHE",
+	"SELECT_LIST",
+	"FOR_UPDATE",
+	"WHERE",
+	"ORDER",
+	"NOINDEX_MATCH",
+	"TABLE_NOINDEX",
+	"PK_CHANGE",
+}
+
+func (self ReasonType) String() string {
+	if self < 0 || int(self) >= len(reasonName) {
+		return ""
+	}
+	return reasonName[self]
+}
+
+// ReasonByName returns the ReasonType for a name as returned by String.
+func ReasonByName(s string) (rt ReasonType, ok bool) {
+	for i, v := range reasonName {
+		if v == s {
+			return ReasonType(i), true
+		}
+	}
+	return 0, false
+}
+
 type ExecPlan struct {
 	PlanId    PlanType
-	Reason    int
+	Reason    ReasonType
 	TableName string
 
+	// Name of the index used to look up rows, if any
+	IndexUsed string
+
 	// PLAN_PASS_*
 	FullQuery *ParsedQuery
 
@@ -93,6 +165,10 @@ type ExecPlan struct {
 	// For PLAN_INSERT_SUBQUERY: Location of pk values in subquery
 	PKValues []interface{}
 
+	// PLAN_SELECT_SUBQUERY: values of the unique index used,
+	// if the where clause does nothing but look them up
+	IndexValues []interface{}
+
 	// For update: set clause
 	// For insert: on duplicate key clause
 	SecondaryPKValues []interface{}
@@ -103,6 +179,17 @@ type ExecPlan struct {
 	// PLAN_SET
 	SetKey   string
 	SetValue interface{}
+
+	// PLAN_SAVEPOINT, PLAN_ROLLBACK_SAVEPOINT
+	SavepointName string
+
+	// All the tables of the statement, including those of joins, unions
+	// and subqueries. For DMLs, the first one is the table they change.
+	TableNames []string
+
+	// The statement with its literals replaced by ?, which is the
+	// same for all the queries that only differ by their values.
+	NormalizedQuery string
 }
 
 func (self *ExecPlan) Size() int {
@@ -125,12 +212,35 @@ func ExecParse(sql string, getTable TableGetter) (plan *ExecPlan, err error) {
 		return nil, err
 	}
 	plan = tree.execAnalyzeSql(getTable)
+	plan.TableNames = tree.collectTableNames(nil)
+	plan.NormalizedQuery = tree.GenerateNormalizedQuery()
 	if plan.PlanId == PLAN_PASS_DML {
 		relog.Warning("PASS_DML: %s", sql)
 	}
 	return plan, nil
 }
 
+// StreamExecParse parses a select statement meant for streaming.
+// Unlike ExecParse, the generated query does not get a limit clause.
+func StreamExecParse(sql string) (fullQuery *ParsedQuery, err error) {
+	defer handleError(&err)
+
+	tree, err := Parse(sql)
+	if err != nil {
+		return nil, err
+	}
+	switch tree.Type {
+	case SELECT:
+		if tree.At(SELECT_FOR_UPDATE_OFFSET).Type == FOR_UPDATE {
+			return nil, NewParserError("Select for update not allowed for streaming")
+		}
+	case UNION, UNION_ALL, MINUS, EXCEPT, INTERSECT:
+	default:
+		return nil, NewParserError("Invalid statement for streaming: %s", sql)
+	}
+	return tree.GenerateFullQuery(), nil
+}
+
 func DDLParse(sql string) (plan *DDLPlan) {
 	rootNode, err := Parse(sql)
 	if err != nil {
@@ -164,6 +274,10 @@ func (self *Node) execAnalyzeSql(getTable TableGetter) (plan *ExecPlan) {
 		return self.execAnalyzeDelete(getTable)
 	case SET:
 		return self.execAnalyzeSet()
+	case SAVEPOINT:
+		return &ExecPlan{PlanId: PLAN_SAVEPOINT, FullQuery: self.GenerateFullQuery(), SavepointName: string(self.At(0).Value)}
+	case ROLLBACK:
+		return &ExecPlan{PlanId: PLAN_ROLLBACK_SAVEPOINT, FullQuery: self.GenerateFullQuery(), SavepointName: string(self.At(0).Value)}
 	}
 	panic(NewParserError("Invalid DQL"))
 }
@@ -223,16 +337,21 @@ func (self *Node) execAnalyzeSelect(getTable TableGetter) (plan *ExecPlan) {
 
 	if pkValues := getPKValues(conditions, tableInfo.Indexes[0]); pkValues != nil {
 		plan.PlanId = PLAN_SELECT_PK
+		plan.IndexUsed = tableInfo.Indexes[0].Name
 		plan.OuterQuery = self.GenerateSelectOuterQuery(tableInfo.Indexes[0])
 		plan.PKValues = pkValues
 		return plan
 	}
 
-	if getIndexMatch(conditions, tableInfo.Indexes) > 0 {
+	if indexUsed := getIndexMatch(conditions, tableInfo.Indexes); indexUsed > 0 {
 		// TODO: We can further optimize. Change this to pass-through if select list matches all columns in index
 		plan.PlanId = PLAN_SELECT_SUBQUERY
+		plan.IndexUsed = tableInfo.Indexes[indexUsed].Name
 		plan.OuterQuery = self.GenerateSelectOuterQuery(tableInfo.Indexes[0])
 		plan.Subquery = self.GenerateSelectSubquery(tableInfo)
+		if tableInfo.Indexes[indexUsed].Unique && self.At(SELECT_LIMIT_OFFSET).Len() == 0 {
+			plan.IndexValues = getIndexValues(conditions, tableInfo.Indexes[indexUsed])
+		}
 		return plan
 	}
 
@@ -279,6 +398,7 @@ func (self *Node) execAnalyzeInsert(getTable TableGetter) (plan *ExecPlan) {
 	rowList := rowValues.At(0) // VALUES->NODE_LIST
 	if pkValues := getInsertPKValues(columns, rowList, tableInfo.Indexes[0]); pkValues != nil {
 		plan.PlanId = PLAN_INSERT_PK
+		plan.IndexUsed = tableInfo.Indexes[0].Name
 		plan.OuterQuery = plan.FullQuery
 		plan.PKValues = pkValues
 	}
@@ -316,6 +436,7 @@ func (self *Node) execAnalyzeUpdate(getTable TableGetter) (plan *ExecPlan) {
 
 	if pkValues := getPKValues(conditions, tableInfo.Indexes[0]); pkValues != nil {
 		plan.PlanId = PLAN_DML_PK
+		plan.IndexUsed = tableInfo.Indexes[0].Name
 		plan.OuterQuery = plan.FullQuery
 		plan.PKValues = pkValues
 		return plan
@@ -349,6 +470,7 @@ func (self *Node) execAnalyzeDelete(getTable TableGetter) (plan *ExecPlan) {
 
 	if pkValues := getPKValues(conditions, tableInfo.Indexes[0]); pkValues != nil {
 		plan.PlanId = PLAN_DML_PK
+		plan.IndexUsed = tableInfo.Indexes[0].Name
 		plan.OuterQuery = plan.FullQuery
 		plan.PKValues = pkValues
 		return plan
@@ -486,6 +608,56 @@ func (self *Node) collectTableName(list []TableInfo) []TableInfo {
 	return list
 }
 
+// collectTableNames appends the names of the tables of the statement
+// to names, without duplicates. The table of a DML comes first.
+func (self *Node) collectTableNames(names []string) []string {
+	switch self.Type {
+	case SELECT:
+		names = self.At(SELECT_FROM_OFFSET).collectFromTableNames(names)
+	case INSERT:
+		names = appendTableName(names, string(self.At(INSERT_TABLE_OFFSET).Value))
+	case UPDATE:
+		names = appendTableName(names, string(self.At(UPDATE_TABLE_OFFSET).Value))
+	case DELETE:
+		names = appendTableName(names, string(self.At(DELETE_TABLE_OFFSET).Value))
+	}
+	// Subqueries can be anywhere
+	for i := 0; i < self.Len(); i++ {
+		names = self.At(i).collectTableNames(names)
+	}
+	return names
+}
+
+// collectFromTableNames is collectTableNames for a from clause. The
+// tables of derived tables are found by collectTableNames.
+func (self *Node) collectFromTableNames(names []string) []string {
+	switch self.Type {
+	case ID:
+		names = appendTableName(names, string(self.Value))
+	case '.':
+		names = appendTableName(names, string(self.At(1).Value))
+	case NODE_LIST, '(':
+		for i := 0; i < self.Len(); i++ {
+			names = self.At(i).collectFromTableNames(names)
+		}
+	case JOIN, LEFT, RIGHT, CROSS, NATURAL:
+		names = self.At(0).collectFromTableNames(names)
+		names = self.At(1).collectFromTableNames(names)
+	case AS:
+		names = self.At(0).collectFromTableNames(names)
+	}
+	return names
+}
+
+func appendTableName(names []string, name string) []string {
+	for _, n := range names {
+		if n == name {
+			return names
+		}
+	}
+	return append(names, name)
+}
+
 //-----------------------------------------------
 // Where
 
@@ -708,25 +880,31 @@ func getPKValues(conditions []*Node, pkIndex *schema.Index) (pkValues []interfac
 		relog.Warning("Table has no primary key")
 		return nil
 	}
-	pkIndexScore := NewIndexScore(pkIndex)
-	pkValues = make([]interface{}, len(pkIndexScore.ColumnMatch))
+	return getIndexValues(conditions, pkIndex)
+}
+
+// getIndexValues returns the values of all the columns of index if
+// the conditions are only equalities or IN lists on those columns.
+func getIndexValues(conditions []*Node, index *schema.Index) (indexValues []interface{}) {
+	indexScore := NewIndexScore(index)
+	indexValues = make([]interface{}, len(indexScore.ColumnMatch))
 	for _, condition := range conditions {
 		if condition.Type != '=' && condition.Type != IN {
 			return nil
 		}
-		index := pkIndexScore.FindMatch(string(condition.At(0).Value))
-		if index == -1 {
+		i := indexScore.FindMatch(string(condition.At(0).Value))
+		if i == -1 {
 			return nil
 		}
 		switch condition.Type {
 		case '=':
-			pkValues[index] = string(condition.At(1).Value)
+			indexValues[i] = string(condition.At(1).Value)
 		case IN:
-			pkValues[index], _ = condition.At(1).At(0).parseList()
+			indexValues[i], _ = condition.At(1).At(0).parseList()
 		}
 	}
-	if pkIndexScore.GetScore() == 1000 {
-		return pkValues
+	if indexScore.GetScore() == 1000 {
+		return indexValues
 	}
 	return nil
 }
@@ -818,6 +996,13 @@ func (self *Node) GenerateFullQuery() *ParsedQuery {
 	return NewParsedQuery(buf)
 }
 
+func (self *Node) GenerateNormalizedQuery() string {
+	buf := NewTrackedBuffer()
+	buf.normalize = true
+	self.Format(buf)
+	return buf.String()
+}
+
 func (self *Node) GenerateSelectLimitQuery() *ParsedQuery {
 	buf := NewTrackedBuffer()
 	if self.Type == SELECT {
@@ -846,6 +1031,10 @@ func (self *Node) GenerateDefaultQuery() *ParsedQuery {
 	return NewParsedQuery(buf)
 }
 
+// GenerateSelectOuterQuery generates a query that fetches a batch of rows
+// by pk. Like for the update and delete outer queries, the first list
+// variable is the list of pk values for single column pks, or the list
+// of pk tuples otherwise.
 func (self *Node) GenerateSelectOuterQuery(pkIndex *schema.Index) *ParsedQuery {
 	buf := NewTrackedBuffer()
 	Fprintf(buf, "select * from %v where ", self.At(SELECT_FROM_OFFSET))
@@ -877,15 +1066,18 @@ func (self *Node) GenerateDeleteOuterQuery(pkIndex *schema.Index) *ParsedQuery {
 	return NewParsedQuery(buf)
 }
 
+// generatePKWhere writes the where clause of the outer queries,
+// which the list variable :0 fills in: a list of values for single
+// column pks, or a TupleEqualityList for the others.
 func generatePKWhere(buf *TrackedBuffer, pkIndex *schema.Index) {
-	for i := 0; i < len(pkIndex.Columns); i++ {
-		if i != 0 {
-			buf.WriteString(" and ")
-		}
-		buf.WriteString(pkIndex.Columns[i])
-		buf.WriteString(" = ")
-		writeArg(buf, strconv.FormatInt(int64(i), 10))
+	if len(pkIndex.Columns) != 1 {
+		writeArg(buf, "0")
+		return
 	}
+	buf.WriteString(pkIndex.Columns[0])
+	buf.WriteString(" in (")
+	writeArg(buf, "0")
+	buf.WriteString(")")
 }
 
 func writeArg(buf *TrackedBuffer, arg string) {
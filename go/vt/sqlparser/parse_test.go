@@ -59,8 +59,9 @@ func initTables() {
 	a.Version = 0
 	a.Columns = append(a.Columns, "eid", "id", "name", "foo")
 	a.ColumnIsNumber = append(a.ColumnIsNumber, true, true, false, false)
-	a.Indexes = append(a.Indexes, &schema.Index{"PRIMARY", []string{"eid", "id"}})
-	a.Indexes = append(a.Indexes, &schema.Index{"a_name", []string{"eid", "name"}})
+	a.Indexes = append(a.Indexes, &schema.Index{Name: "PRIMARY", Columns: []string{"eid", "id"}, Unique: true})
+	a.Indexes = append(a.Indexes, &schema.Index{Name: "a_name", Columns: []string{"eid", "name"}})
+	a.Indexes = append(a.Indexes, &schema.Index{Name: "a_foo", Columns: []string{"foo"}, Unique: true})
 	a.PKColumns = append(a.PKColumns, 0, 1)
 	a.CacheType = 1
 	a.CacheSize = 1024
@@ -70,7 +71,7 @@ func initTables() {
 	b.Version = 0
 	b.Columns = append(a.Columns, "eid", "id")
 	b.ColumnIsNumber = append(a.ColumnIsNumber, true, true)
-	b.Indexes = append(a.Indexes, &schema.Index{"PRIMARY", []string{"eid", "id"}})
+	b.Indexes = append(a.Indexes, &schema.Index{Name: "PRIMARY", Columns: []string{"eid", "id"}, Unique: true})
 	b.PKColumns = append(a.PKColumns, 0, 1)
 	b.CacheType = 0
 	b.CacheSize = 0
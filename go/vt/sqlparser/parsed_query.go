@@ -42,6 +42,7 @@ import (
 type TrackedBuffer struct {
 	*bytes.Buffer
 	bind_locations []BindLocation
+	normalize      bool // write literals as ?
 }
 
 type BindLocation struct {
@@ -49,7 +50,7 @@ type BindLocation struct {
 }
 
 func NewTrackedBuffer() *TrackedBuffer {
-	return &TrackedBuffer{bytes.NewBuffer(make([]byte, 0, 128)), make([]BindLocation, 0, 4)}
+	return &TrackedBuffer{bytes.NewBuffer(make([]byte, 0, 128)), make([]BindLocation, 0, 4), false}
 }
 
 type ParsedQuery struct {
@@ -142,12 +143,47 @@ func EncodeValue(buf *bytes.Buffer, value interface{}) error {
 			}
 			buf.WriteByte(')')
 		}
+	case *TupleEqualityList:
+		return bindVal.Encode(buf)
 	default:
 		return errors.New(fmt.Sprintf("Bad bind variable type %T", value))
 	}
 	return nil
 }
 
+// TupleEqualityList is the list variable of the outer queries of
+// tables with a multi-column pk. It's encoded as the conditions that
+// match its rows: (a = 1 and b = 2) or (a = 1 and b = 3). MySQL can
+// use the pk to look them up, which it can't for a list of tuples.
+type TupleEqualityList struct {
+	Columns []string
+	Rows    [][]interface{}
+}
+
+func (self *TupleEqualityList) Encode(buf *bytes.Buffer) error {
+	for i, row := range self.Rows {
+		if len(row) != len(self.Columns) {
+			return errors.New(fmt.Sprintf("Row %v doesn't match columns %v", row, self.Columns))
+		}
+		if i != 0 {
+			buf.WriteString(" or ")
+		}
+		buf.WriteByte('(')
+		for j, value := range row {
+			if j != 0 {
+				buf.WriteString(" and ")
+			}
+			buf.WriteString(self.Columns[j])
+			buf.WriteString(" = ")
+			if err := EncodeValue(buf, value); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(')')
+	}
+	return nil
+}
+
 func EncodeBinary(buf *bytes.Buffer, bytes []byte) {
 	buf.WriteByte('\'')
 	for _, ch := range bytes {
@@ -119,6 +119,9 @@ const (
 %token <node> CREATE ALTER DROP RENAME
 %token <node> TABLE INDEX TO IGNORE IF UNIQUE USING
 
+// Transaction Tokens
+%token <node> SAVEPOINT ROLLBACK
+
 %start any_command
 
 // Fake Tokens
@@ -128,6 +131,7 @@ const (
 %type <node> command
 %type <node> select_statement insert_statement update_statement delete_statement set_statement
 %type <node> create_statement alter_statement rename_statement drop_statement
+%type <node> savepoint_statement rollback_statement
 %type <node> comment_opt comment_list
 %type <node> union_op distinct_opt
 %type <node> select_expression_list select_expression expression as_opt
@@ -138,7 +142,7 @@ const (
 %type <node> group_by_opt having_opt order_by_opt order_list order asc_desc_opt limit_opt for_update_opt on_dup_opt
 %type <node> column_list_opt column_list update_list update_expression
 %type <node> exists_opt not_exists_opt ignore_opt non_rename_operation to_opt constraint_opt using_opt
-%type <node> force_eof
+%type <node> savepoint_opt force_eof
 
 %%
 
@@ -158,6 +162,8 @@ command:
 | alter_statement
 | rename_statement
 | drop_statement
+| savepoint_statement
+| rollback_statement
 
 select_statement:
 	SELECT comment_opt distinct_opt select_expression_list FROM table_expression_list where_expression_opt group_by_opt having_opt order_by_opt limit_opt for_update_opt
@@ -263,6 +269,18 @@ drop_statement:
 		$$.Push($5)
 	}
 
+savepoint_statement:
+	SAVEPOINT ID
+	{
+		$$.Push($2)
+	}
+
+rollback_statement:
+	ROLLBACK TO savepoint_opt ID
+	{
+		$$.Push($4)
+	}
+
 comment_opt:
 	{
 		SetAllowComments(yylex, true)
@@ -803,6 +821,10 @@ using_opt:
 	{ $$ = nil }
 | USING ID
 
+savepoint_opt:
+	{ $$ = nil }
+| SAVEPOINT
+
 force_eof:
 {
 	ForceEOF(yylex)
@@ -135,3 +135,6 @@ create unique index a using foo on b#alter table b
 drop table a
 drop table if exists a#drop table a
 drop index b on a#alter table a
+savepoint a
+rollback to a#rollback to savepoint a
+rollback to savepoint a
@@ -116,6 +116,9 @@ var keywords = map[string]int{
 	"if":     IF,
 	"unique": UNIQUE,
 	"using":  USING,
+
+	"savepoint": SAVEPOINT,
+	"rollback":  ROLLBACK,
 }
 
 // escapEncodeMap specifies how to escape certain binary data with '\'
@@ -132,13 +135,13 @@ var escapeEncodeMap = map[byte]byte{
 	'\\':   '\\',
 }
 
-// escapeDecodeMap is the reverse of excapeEncodeMap
-var escapeDecodeMap map[byte]byte
+// EscapeDecodeMap is the reverse of excapeEncodeMap
+var EscapeDecodeMap map[byte]byte
 
 func init() {
-	escapeDecodeMap = make(map[byte]byte)
+	EscapeDecodeMap = make(map[byte]byte)
 	for k, v := range escapeEncodeMap {
-		escapeDecodeMap[v] = k
+		EscapeDecodeMap[v] = k
 	}
 }
 
@@ -364,7 +367,7 @@ func (self *Tokenizer) scanString() *Node {
 			if self.lastChar == EOFCHAR {
 				return NewParseNode(LEX_ERROR, buffer.Bytes())
 			}
-			if decodedChar, ok := escapeDecodeMap[byte(self.lastChar)]; ok {
+			if decodedChar, ok := EscapeDecodeMap[byte(self.lastChar)]; ok {
 				ch = uint16(decodedChar)
 			} else {
 				ch = self.lastChar
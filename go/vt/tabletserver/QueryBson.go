@@ -42,6 +42,7 @@ type Query struct {
 	TransactionId int64
 	ConnectionId  int64
 	SessionId     int64
+	Timeout       int64 // In nanoseconds. 0 means the server-wide timeout.
 }
 
 func (self *Query) MarshalBson(buf *bytes.Buffer) {
@@ -62,6 +63,9 @@ func (self *Query) MarshalBson(buf *bytes.Buffer) {
 	bson.EncodePrefix(buf, bson.Long, "SessionId")
 	bson.EncodeUint64(buf, uint64(self.SessionId))
 
+	bson.EncodePrefix(buf, bson.Long, "Timeout")
+	bson.EncodeUint64(buf, uint64(self.Timeout))
+
 	buf.WriteByte(0)
 	lenWriter.RecordLen()
 }
@@ -92,6 +96,8 @@ func (self *Query) UnmarshalBson(buf *bytes.Buffer) {
 			self.ConnectionId = bson.DecodeInt64(buf, kind)
 		case "SessionId":
 			self.SessionId = bson.DecodeInt64(buf, kind)
+		case "Timeout":
+			self.Timeout = bson.DecodeInt64(buf, kind)
 		default:
 			panic(bson.NewBsonError("Unrecognized tag %s", key))
 		}
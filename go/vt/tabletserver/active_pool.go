@@ -63,36 +63,65 @@ func (self *ActivePool) Open(ConnFactory CreateConnectionFunc) {
 
 func (self *ActivePool) Close() {
 	self.ticks.Close()
+	for _, v := range self.pool.GetAll() {
+		v.(*ActiveQuery).stopTimer()
+	}
 	self.connPool.Close()
 	self.pool = pools.NewNumbered()
 }
 
 func (self *ActivePool) QueryKiller() {
 	for self.ticks.Next() {
-		for _, v := range self.pool.GetTimedout(time.Duration(self.Timeout())) {
-			self.kill(v.(int64))
+		for _, v := range self.pool.GetTimedout(self.Timeout()) {
+			self.kill(v.(*ActiveQuery))
 		}
 	}
 }
 
-func (self *ActivePool) kill(connid int64) {
-	self.Remove(connid)
+func (self *ActivePool) kill(aq *ActiveQuery) {
+	defer logError()
+	// A query that already finished must not be killed:
+	// its connection may be running someone else's query by now.
+	if !atomic.CompareAndSwapInt32(&aq.state, AQ_RUNNING, AQ_KILLED) {
+		return
+	}
+	aq.stopTimer()
+	self.pool.Unregister(aq.connid)
 	killStats.Add("Queries", 1)
-	relog.Info("killing query %d", connid)
+	relog.Info("killing query %d", aq.connid)
+	self.KillConnection(aq.connid)
+}
+
+// KillConnection kills MySQL connection id, and the query running on it.
+func (self *ActivePool) KillConnection(id int64) {
+	defer logError()
 	killConn := self.connPool.Get()
 	defer killConn.Recycle()
-	sql := []byte(fmt.Sprintf("kill %d", connid))
+	sql := []byte(fmt.Sprintf("kill %d", id))
 	if _, err := killConn.ExecuteFetch(sql, 10000); err != nil {
-		relog.Error("Could not kill query %d: %v", connid, err)
+		relog.Error("Could not kill connection %d: %v", id, err)
 	}
 }
 
-func (self *ActivePool) Put(id int64) {
-	self.pool.Register(id, id)
+// Put registers the query running on connection id. A non-zero timeout
+// applies to this query only. The query is killed when either this
+// timeout or the pool's timeout expires, whichever comes first.
+func (self *ActivePool) Put(id int64, timeout time.Duration) *ActiveQuery {
+	aq := &ActiveQuery{connid: id}
+	self.pool.Register(id, aq)
+	if maxTimeout := self.Timeout(); timeout > 0 && (maxTimeout == 0 || timeout < maxTimeout) {
+		aq.timer = time.AfterFunc(timeout, func() { self.kill(aq) })
+	}
+	return aq
 }
 
-func (self *ActivePool) Remove(id int64) {
-	self.pool.Unregister(id)
+// Remove unregisters a query returned by Put once it has finished.
+func (self *ActivePool) Remove(aq *ActiveQuery) {
+	if !atomic.CompareAndSwapInt32(&aq.state, AQ_RUNNING, AQ_DONE) {
+		return
+	}
+	aq.stopTimer()
+	self.pool.Unregister(aq.connid)
 }
 
 func (self *ActivePool) Timeout() time.Duration {
@@ -116,3 +145,28 @@ func (self *ActivePool) StatsJSON() string {
 func (self *ActivePool) Stats() (size int, timeout time.Duration) {
 	return self.pool.Stats(), self.Timeout()
 }
+
+// ActiveQuery states
+const (
+	AQ_RUNNING = int32(iota)
+	AQ_KILLED
+	AQ_DONE
+)
+
+// ActiveQuery is a query registered with the ActivePool.
+type ActiveQuery struct {
+	connid int64
+	timer  *time.Timer // Fires when the per-query timeout expires
+	state  int32       // Use sync/atomic
+}
+
+func (self *ActiveQuery) stopTimer() {
+	if self.timer != nil {
+		self.timer.Stop()
+	}
+}
+
+// IsKilled returns true if the query was killed for exceeding its timeout.
+func (self *ActiveQuery) IsKilled() bool {
+	return atomic.LoadInt32(&self.state) == AQ_KILLED
+}
@@ -35,8 +35,13 @@ import (
 	"code.google.com/p/vitess/go/pools"
 	"code.google.com/p/vitess/go/relog"
 	"code.google.com/p/vitess/go/stats"
+	"code.google.com/p/vitess/go/streamlog"
 	"code.google.com/p/vitess/go/timer"
 	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -53,22 +58,43 @@ var (
 	ROLLBACK = []byte("rollback")
 )
 
+// Values for TxConnection.conclusion
+const (
+	TX_CLOSE    = "close"
+	TX_COMMIT   = "commit"
+	TX_ROLLBACK = "rollback"
+	TX_KILL     = "kill"
+)
+
+// TxLogger receives every completed transaction
+var TxLogger = streamlog.New("TxLog", 10)
+
 type ActiveTxPool struct {
-	pool    *pools.Numbered
-	lastId  int64
-	timeout int64
-	ticks   *timer.Timer
-	txStats *stats.Timings
+	pool         *pools.Numbered
+	lastId       int64
+	timeout      int64
+	ticks        *timer.Timer
+	slowQueryLog *SlowQueryLog
 }
 
-func NewActiveTxPool(timeout time.Duration) *ActiveTxPool {
-	return &ActiveTxPool{
-		pool:    pools.NewNumbered(),
-		lastId:  time.Now().UnixNano(),
-		timeout: int64(timeout),
-		ticks:   timer.NewTimer(timeout / 10),
-		txStats: stats.NewTimings("Transactions"),
+// txStats and TxLogger are shared by the transaction pools
+// of all the query services.
+var txStats = stats.NewTimings("Transactions")
+
+func init() {
+	http.Handle("/debug/txlog", TxLogger)
+}
+
+func NewActiveTxPool(name string, timeout time.Duration, slowQueryLog *SlowQueryLog) *ActiveTxPool {
+	self := &ActiveTxPool{
+		pool:         pools.NewNumbered(),
+		lastId:       time.Now().UnixNano(),
+		timeout:      int64(timeout),
+		ticks:        timer.NewTimer(timeout / 10),
+		slowQueryLog: slowQueryLog,
 	}
+	http.Handle(debugPath(name, "transactions"), self)
+	return self
 }
 
 func (self *ActiveTxPool) Open() {
@@ -81,7 +107,7 @@ func (self *ActiveTxPool) Close() {
 	for _, v := range self.pool.GetTimedout(time.Duration(0)) {
 		conn := v.(*TxConnection)
 		conn.Close()
-		conn.discard()
+		conn.discard(TX_KILL)
 	}
 }
 
@@ -96,7 +122,7 @@ func (self *ActiveTxPool) TransactionKiller() {
 			relog.Info("killing transaction %d", conn.transactionId)
 			killStats.Add("Transactions", 1)
 			conn.Close()
-			conn.discard()
+			conn.discard(TX_KILL)
 		}
 	}
 }
@@ -114,13 +140,13 @@ func (self *ActiveTxPool) SafeBegin(conn PoolConnection) (transactionId int64, e
 // An unpleasant dependency to SchemaInfo. Avoiding it makes the code worse
 func (self *ActiveTxPool) Commit(transactionId int64, schemaInfo *SchemaInfo) {
 	conn := self.Get(transactionId)
-	defer conn.discard()
-	self.txStats.Add("Completed", time.Now().Sub(conn.startTime))
+	defer conn.discard(TX_COMMIT)
+	txStats.Add("Completed", time.Now().Sub(conn.startTime))
 	defer func() {
 		for tableName, invalidList := range conn.dirtyTables {
 			tableInfo := schemaInfo.GetTable(tableName)
 			for key := range invalidList {
-				tableInfo.RowCache.Delete(key)
+				tableInfo.invalidateRow(key)
 			}
 			schemaInfo.Put(tableInfo)
 		}
@@ -133,14 +159,28 @@ func (self *ActiveTxPool) Commit(transactionId int64, schemaInfo *SchemaInfo) {
 
 func (self *ActiveTxPool) Rollback(transactionId int64) {
 	conn := self.Get(transactionId)
-	defer conn.discard()
-	self.txStats.Add("Aborted", time.Now().Sub(conn.startTime))
+	defer conn.discard(TX_ROLLBACK)
+	txStats.Add("Aborted", time.Now().Sub(conn.startTime))
 	if _, err := conn.ExecuteFetch(ROLLBACK, 10000); err != nil {
 		conn.Close()
 		panic(NewTabletErrorSql(FAIL, err))
 	}
 }
 
+func (self *ActiveTxPool) Savepoint(transactionId int64, name string) {
+	conn := self.Get(transactionId)
+	defer conn.Recycle()
+	conn.RecordQuery("savepoint "+name, "savepoint "+name)
+	conn.Savepoint(name)
+}
+
+func (self *ActiveTxPool) RollbackToSavepoint(transactionId int64, name string) {
+	conn := self.Get(transactionId)
+	defer conn.Recycle()
+	conn.RecordQuery("rollback to savepoint "+name, "rollback to savepoint "+name)
+	conn.RollbackToSavepoint(name)
+}
+
 // You must call Recycle on TxConnection once done.
 func (self *ActiveTxPool) Get(transactionId int64) (conn *TxConnection) {
 	v, err := self.pool.Get(transactionId)
@@ -168,13 +208,39 @@ func (self *ActiveTxPool) Stats() (size int, timeout time.Duration) {
 	return self.pool.Stats(), self.Timeout()
 }
 
+// ServeHTTP lists the transactions in flight with their age and last query.
+func (self *ActiveTxPool) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	vals := self.pool.GetAll()
+	response.Header().Set("Content-Type", "text/plain")
+	if len(vals) == 0 {
+		response.Write([]byte("empty\n"))
+		return
+	}
+	response.Write([]byte(fmt.Sprintf("Length: %d\n", len(vals))))
+	now := time.Now()
+	for _, v := range vals {
+		conn := v.(*TxConnection)
+		count, lastQuery := conn.lastQuery()
+		response.Write([]byte(fmt.Sprintf("%v\t%.6f\t%v\t%s\n", conn.transactionId, now.Sub(conn.startTime).Seconds(), count, lastQuery)))
+	}
+}
+
 type TxConnection struct {
 	PoolConnection
 	transactionId int64
 	pool          *ActiveTxPool
 	inUse         bool
 	startTime     time.Time
+	endTime       time.Time
 	dirtyTables   map[string]DirtyKeys
+	savepoints    []txSavepoint
+	conclusion    string
+	queriesMu     sync.Mutex // queries can be read by /debug/transactions
+	queries       []string
+
+	// normalizedQueries go to the slow query log, which must
+	// not contain the values of the queries.
+	normalizedQueries []string
 }
 
 func newTxConnection(conn PoolConnection, transactionId int64, pool *ActiveTxPool) *TxConnection {
@@ -196,17 +262,122 @@ func (self *TxConnection) DirtyKeys(tableName string) DirtyKeys {
 	return list
 }
 
+// Savepoint sets a savepoint and remembers which keys were dirty at
+// that point. As in MySQL, an older savepoint with the same name is replaced.
+func (self *TxConnection) Savepoint(name string) {
+	checkSavepointName(name)
+	if _, err := self.ExecuteFetch([]byte("savepoint "+name), 10000); err != nil {
+		panic(NewTabletErrorSql(FAIL, err))
+	}
+	if i := self.findSavepoint(name); i >= 0 {
+		self.savepoints = append(self.savepoints[:i], self.savepoints[i+1:]...)
+	}
+	self.savepoints = append(self.savepoints, txSavepoint{name, copyDirtyTables(self.dirtyTables)})
+}
+
+// RollbackToSavepoint undoes the changes made after the savepoint.
+// Keys dirtied after it are forgotten, because the rows they point
+// to are back to their committed values. Later savepoints are dropped.
+func (self *TxConnection) RollbackToSavepoint(name string) {
+	checkSavepointName(name)
+	i := self.findSavepoint(name)
+	if i < 0 {
+		panic(NewTabletError(FAIL, "Savepoint %s does not exist", name))
+	}
+	if _, err := self.ExecuteFetch([]byte("rollback to savepoint "+name), 10000); err != nil {
+		panic(NewTabletErrorSql(FAIL, err))
+	}
+	self.savepoints = self.savepoints[:i+1]
+	self.dirtyTables = copyDirtyTables(self.savepoints[i].dirtyTables)
+}
+
+func (self *TxConnection) findSavepoint(name string) int {
+	for i, sp := range self.savepoints {
+		if strings.EqualFold(sp.name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (self *TxConnection) RecordQuery(query, normalizedQuery string) {
+	self.queriesMu.Lock()
+	defer self.queriesMu.Unlock()
+	self.queries = append(self.queries, query)
+	self.normalizedQueries = append(self.normalizedQueries, normalizedQuery)
+}
+
+func (self *TxConnection) lastQuery() (count int, query string) {
+	self.queriesMu.Lock()
+	defer self.queriesMu.Unlock()
+	if len(self.queries) == 0 {
+		return 0, ""
+	}
+	return len(self.queries), self.queries[len(self.queries)-1]
+}
+
 func (self *TxConnection) Recycle() {
 	if self.IsClosed() {
-		self.discard()
+		self.discard(TX_CLOSE)
 	} else {
 		self.pool.pool.Put(self.transactionId)
 	}
 }
 
-func (self *TxConnection) discard() {
+func (self *TxConnection) discard(conclusion string) {
+	self.conclusion = conclusion
+	self.endTime = time.Now()
 	self.pool.pool.Unregister(self.transactionId)
 	self.PoolConnection.Recycle()
+	TxLogger.Send(self)
+	self.pool.slowQueryLog.logTransaction(self)
+}
+
+// Format returns a tab separated line for the transaction log:
+// id, start, end, duration, conclusion, query count and queries.
+func (self *TxConnection) Format(params url.Values) string {
+	self.queriesMu.Lock()
+	defer self.queriesMu.Unlock()
+	return fmt.Sprintf(
+		"%v\t%v\t%v\t%.6f\t%v\t%v\t%v\n",
+		self.transactionId,
+		self.startTime.Format(time.StampMicro),
+		self.endTime.Format(time.StampMicro),
+		self.endTime.Sub(self.startTime).Seconds(),
+		self.conclusion,
+		len(self.queries),
+		strings.Join(self.queries, ";"),
+	)
+}
+
+type txSavepoint struct {
+	name        string
+	dirtyTables map[string]DirtyKeys
+}
+
+// checkSavepointName allows only the names the sql parser accepts,
+// which also makes them safe to splice into a statement.
+func checkSavepointName(name string) {
+	if name == "" {
+		panic(NewTabletError(FAIL, "Empty savepoint name"))
+	}
+	for i, ch := range name {
+		if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch == '_' || i > 0 && ch >= '0' && ch <= '9') {
+			panic(NewTabletError(FAIL, "Invalid savepoint name: %s", name))
+		}
+	}
+}
+
+func copyDirtyTables(dirtyTables map[string]DirtyKeys) map[string]DirtyKeys {
+	copied := make(map[string]DirtyKeys, len(dirtyTables))
+	for tableName, keys := range dirtyTables {
+		copiedKeys := make(DirtyKeys, len(keys))
+		for key := range keys {
+			copiedKeys[key] = true
+		}
+		copied[tableName] = copiedKeys
+	}
+	return copied
 }
 
 type DirtyKeys map[string]bool
@@ -0,0 +1,114 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tabletserver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// fakeConn records the queries it's asked to execute.
+type fakeConn struct {
+	queries []string
+}
+
+func (self *fakeConn) ExecuteFetch(query []byte, maxrows int) (*QueryResult, error) {
+	self.queries = append(self.queries, string(query))
+	return &QueryResult{}, nil
+}
+
+func (self *fakeConn) ExecuteStreamFetch(query []byte, callback func(*QueryResult) error, streamBufferSize int) error {
+	return nil
+}
+
+func (self *fakeConn) Id() int64      { return 1 }
+func (self *fakeConn) Close()         {}
+func (self *fakeConn) IsClosed() bool { return false }
+func (self *fakeConn) Recycle()       {}
+
+func dirtyKeys(conn *TxConnection, tableName string) string {
+	keys := make([]string, 0, len(conn.dirtyTables[tableName]))
+	for key := range conn.dirtyTables[tableName] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, " ")
+}
+
+func expectTabletError(t *testing.T, want string, f func()) {
+	defer func() {
+		x := recover()
+		if x == nil {
+			t.Errorf("want error %s, got none", want)
+			return
+		}
+		if got := x.(*TabletError).Message; got != want {
+			t.Errorf("want error %s, got %s", want, got)
+		}
+	}()
+	f()
+}
+
+func TestSavepoints(t *testing.T) {
+	fc := &fakeConn{}
+	conn := newTxConnection(fc, 1, nil)
+	conn.DirtyKeys("a").Delete("1")
+	conn.Savepoint("s1")
+	conn.DirtyKeys("a").Delete("2")
+	conn.Savepoint("s2")
+	conn.DirtyKeys("b").Delete("3")
+
+	conn.RollbackToSavepoint("s2")
+	if got := dirtyKeys(conn, "a") + "|" + dirtyKeys(conn, "b"); got != "1 2|" {
+		t.Errorf("after s2: want 1 2|, got %s", got)
+	}
+	// The keys of a savepoint must survive rolling back to it twice
+	conn.DirtyKeys("a").Delete("4")
+	conn.RollbackToSavepoint("S1")
+	if got := dirtyKeys(conn, "a"); got != "1" {
+		t.Errorf("after s1: want 1, got %s", got)
+	}
+	conn.DirtyKeys("a").Delete("5")
+	conn.RollbackToSavepoint("s1")
+	if got := dirtyKeys(conn, "a"); got != "1" {
+		t.Errorf("after s1 again: want 1, got %s", got)
+	}
+	expectTabletError(t, "Savepoint s2 does not exist", func() { conn.RollbackToSavepoint("s2") })
+	expectTabletError(t, "Invalid savepoint name: s1; drop table a", func() { conn.Savepoint("s1; drop table a") })
+
+	want := "[savepoint s1 savepoint s2 rollback to savepoint s2 rollback to savepoint S1 rollback to savepoint s1]"
+	if got := fmt.Sprintf("%v", fc.queries); got != want {
+		t.Errorf("want %s, got %s", want, got)
+	}
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tabletserver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BINLOG_DELIMITER = "/*!*/;"
+	// How often a binlog file is checked for new statements once
+	// its end is reached.
+	BINLOG_POLL_INTERVAL = 100 * time.Millisecond
+)
+
+// BinlogFileCreator returns a CreateEventSourceFunc for a file written
+// by mysqlbinlog, which is followed as it grows, like tail -f would:
+//   mysqlbinlog --read-from-remote-server --stop-never ... > filename
+// Positions are offsets in that file.
+func BinlogFileCreator(filename string) CreateEventSourceFunc {
+	return func(position string) (EventSource, error) {
+		return NewBinlogFileSource(filename, position)
+	}
+}
+
+// BinlogFileSource reads the statements of a mysqlbinlog output file.
+type BinlogFileSource struct {
+	file   *os.File
+	reader *bufio.Reader
+	offset int64
+	// partial is the beginning of a line that's still being written
+	partial string
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func NewBinlogFileSource(filename string, position string) (*BinlogFileSource, error) {
+	offset := int64(0)
+	if position != "" {
+		var err error
+		if offset, err = strconv.ParseInt(position, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid binlog position '%s': %v", position, err)
+		}
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = file.Seek(offset, os.SEEK_SET); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &BinlogFileSource{file: file, reader: bufio.NewReader(file), offset: offset}, nil
+}
+
+// Next returns the next statement. Statements end with BINLOG_DELIMITER.
+// Comment lines and DELIMITER commands are skipped.
+func (self *BinlogFileSource) Next() (event *StreamEvent, err error) {
+	statement := make([]string, 0, 8)
+	for {
+		line, err := self.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(statement) == 0 && (strings.HasPrefix(line, "#") || strings.HasPrefix(line, "DELIMITER ")) {
+			continue
+		}
+		trimmed := strings.TrimRight(line, "\r\n")
+		if strings.HasSuffix(trimmed, BINLOG_DELIMITER) {
+			statement = append(statement, trimmed[:len(trimmed)-len(BINLOG_DELIMITER)])
+			return &StreamEvent{
+				Sql:      strings.TrimSpace(strings.Join(statement, "\n")),
+				Position: strconv.FormatInt(self.offset, 10),
+			}, nil
+		}
+		statement = append(statement, trimmed)
+	}
+	panic("unreachable")
+}
+
+// readLine waits for a full line to be written.
+func (self *BinlogFileSource) readLine() (string, error) {
+	for {
+		if self.isClosed() {
+			return "", io.EOF
+		}
+		line, err := self.reader.ReadString('\n')
+		self.partial += line
+		if err == nil {
+			line, self.partial = self.partial, ""
+			self.offset += int64(len(line))
+			return line, nil
+		}
+		if self.isClosed() {
+			return "", io.EOF
+		}
+		if err != io.EOF {
+			return "", err
+		}
+		time.Sleep(BINLOG_POLL_INTERVAL)
+	}
+	panic("unreachable")
+}
+
+func (self *BinlogFileSource) isClosed() bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.closed
+}
+
+// Close makes a pending Next return io.EOF.
+func (self *BinlogFileSource) Close() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.closed {
+		return
+	}
+	self.closed = true
+	self.file.Close()
+}
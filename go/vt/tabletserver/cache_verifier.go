@@ -0,0 +1,203 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tabletserver
+
+import (
+	"code.google.com/p/vitess/go/relog"
+	"code.google.com/p/vitess/go/stats"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How many mismatches are kept for /debug/cache_mismatches.
+const MAX_MISMATCH_EXAMPLES = 100
+
+var cacheChecks = stats.NewCounters("CacheChecks")
+var cacheMismatches = stats.NewCounters("CacheMismatches")
+
+// CacheMismatch is a cached row that didn't match MySQL.
+// Actual is nil if the row doesn't exist in MySQL.
+type CacheMismatch struct {
+	Time    time.Time
+	Table   string
+	Key     string
+	Cached  []interface{}
+	Actual  []interface{}
+	Evicted bool
+}
+
+// CacheVerifier periodically compares a sample of the rows of each
+// row cache with MySQL, to detect invalidation bugs. Mismatches are
+// counted per table, and the latest ones are shown at
+// /debug/cache_mismatches. If evict is set, mismatched rows are
+// deleted from the cache.
+type CacheVerifier struct {
+	mu         sync.Mutex
+	sqlQuery   *SqlQuery
+	interval   time.Duration
+	sampleSize int
+	evict      bool
+	done       chan struct{}
+	wg         sync.WaitGroup
+
+	// examples is protected by examplesMu because it's
+	// updated by the verifier goroutine.
+	examplesMu sync.Mutex
+	examples   []*CacheMismatch
+}
+
+func NewCacheVerifier(sqlQuery *SqlQuery) *CacheVerifier {
+	self := &CacheVerifier{sqlQuery: sqlQuery}
+	http.Handle(debugPath(sqlQuery.name, "cache_mismatches"), self)
+	return self
+}
+
+// SetParams sets how often Open verifies sampleSize rows of every
+// cached table. An interval of 0 disables verification.
+func (self *CacheVerifier) SetParams(interval time.Duration, sampleSize int, evict bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.interval = interval
+	self.sampleSize = sampleSize
+	self.evict = evict
+}
+
+func (self *CacheVerifier) Open() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.interval == 0 || self.sampleSize == 0 || self.done != nil {
+		return
+	}
+	self.done = make(chan struct{})
+	self.wg.Add(1)
+	go self.run(self.done, self.interval, self.sampleSize, self.evict)
+}
+
+func (self *CacheVerifier) Close() {
+	self.mu.Lock()
+	if self.done == nil {
+		self.mu.Unlock()
+		return
+	}
+	close(self.done)
+	self.done = nil
+	self.mu.Unlock()
+	self.wg.Wait()
+}
+
+func (self *CacheVerifier) run(done chan struct{}, interval time.Duration, sampleSize int, evict bool) {
+	defer self.wg.Done()
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(interval):
+		}
+		for _, tableName := range self.sqlQuery.cachedTables() {
+			self.verifyTable(tableName, sampleSize, evict)
+		}
+	}
+}
+
+func (self *CacheVerifier) verifyTable(tableName string, sampleSize int, evict bool) {
+	defer func() {
+		if x := recover(); x != nil {
+			relog.Error("Could not verify the cache of %s: %v", tableName, x)
+		}
+	}()
+	checked, mismatches := self.sqlQuery.verifyRows(tableName, sampleSize, evict)
+	cacheChecks.Add(tableName, int64(checked))
+	if len(mismatches) == 0 {
+		return
+	}
+	cacheMismatches.Add(tableName, int64(len(mismatches)))
+	relog.Warning("%d cached rows of %s don't match mysql", len(mismatches), tableName)
+	self.examplesMu.Lock()
+	defer self.examplesMu.Unlock()
+	self.examples = append(self.examples, mismatches...)
+	if len(self.examples) > MAX_MISMATCH_EXAMPLES {
+		self.examples = self.examples[len(self.examples)-MAX_MISMATCH_EXAMPLES:]
+	}
+}
+
+func (self *CacheVerifier) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	self.examplesMu.Lock()
+	examples := self.examples
+	self.examplesMu.Unlock()
+	response.Header().Set("Content-Type", "text/plain")
+	if len(examples) == 0 {
+		response.Write([]byte("empty\n"))
+		return
+	}
+	response.Write([]byte(fmt.Sprintf("Length: %d\n", len(examples))))
+	for i := len(examples) - 1; i >= 0; i-- {
+		m := examples[i]
+		response.Write([]byte(fmt.Sprintf("%v\t%s\t%s\tevicted: %v\n\tcached: %s\n\tactual: %s\n",
+			m.Time.Format(time.RFC3339), m.Table, m.Key, m.Evicted, formatRow(m.Cached), formatRow(m.Actual))))
+	}
+}
+
+// rowsEqual compares rows by the text of their values, because
+// the types of the values depend on the row cache backend.
+func rowsEqual(row1, row2 []interface{}) bool {
+	if len(row1) != len(row2) {
+		return false
+	}
+	for i := range row1 {
+		if (row1[i] == nil) != (row2[i] == nil) {
+			return false
+		}
+		if cellString(row1[i]) != cellString(row2[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func cellString(cell interface{}) string {
+	switch val := cell.(type) {
+	case []byte:
+		return string(val)
+	case string:
+		return val
+	}
+	return fmt.Sprintf("%v", cell)
+}
+
+func formatRow(row []interface{}) string {
+	if row == nil {
+		return "none"
+	}
+	return formatRows([][]interface{}{row})[0]
+}
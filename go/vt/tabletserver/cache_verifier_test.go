@@ -0,0 +1,73 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tabletserver
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRowsEqual(t *testing.T) {
+	cases := []struct {
+		row1, row2 []interface{}
+		want       bool
+	}{
+		{[]interface{}{"1", []byte("a"), nil}, []interface{}{[]byte("1"), "a", nil}, true},
+		{[]interface{}{int64(1)}, []interface{}{"1"}, true},
+		{[]interface{}{"a"}, []interface{}{"b"}, false},
+		{[]interface{}{""}, []interface{}{nil}, false},
+		{[]interface{}{"a"}, []interface{}{"a", "b"}, false},
+	}
+	for _, tcase := range cases {
+		if got := rowsEqual(tcase.row1, tcase.row2); got != tcase.want {
+			t.Errorf("rowsEqual(%v, %v): want %v, got %v", tcase.row1, tcase.row2, tcase.want, got)
+		}
+	}
+}
+
+func TestServeCacheMismatches(t *testing.T) {
+	verifier := &CacheVerifier{}
+	response := httptest.NewRecorder()
+	verifier.ServeHTTP(response, nil)
+	if response.Body.String() != "empty\n" {
+		t.Errorf("want empty, got %s", response.Body.String())
+	}
+
+	verifier.examples = []*CacheMismatch{{Table: "t", Key: "1,", Cached: []interface{}{"1", "a"}}}
+	response = httptest.NewRecorder()
+	verifier.ServeHTTP(response, nil)
+	body := response.Body.String()
+	if !strings.HasPrefix(body, "Length: 1\n") || !strings.Contains(body, "cached: ('1', 'a')") || !strings.Contains(body, "actual: none") {
+		t.Errorf("unexpected page:\n%s", body)
+	}
+}
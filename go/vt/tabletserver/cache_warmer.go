@@ -0,0 +1,261 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tabletserver
+
+import (
+	"bufio"
+	"bytes"
+	"code.google.com/p/vitess/go/relog"
+	"code.google.com/p/vitess/go/stats"
+	"code.google.com/p/vitess/go/vt/sqlparser"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WarmSpec says which rows to preload into the row cache of a table.
+type WarmSpec struct {
+	// Rows is the number of rows to preload, starting from the
+	// highest pk. For auto-increment pks, these are the most recent rows.
+	Rows int
+	// KeyFile lists the pks to preload instead, one per line.
+	// The values of multi-column pks are separated by commas.
+	KeyFile string
+}
+
+var cacheWarmingStats = stats.NewCounters("CacheWarming")
+var cacheWarmingErrors = stats.NewCounters("CacheWarmingErrors")
+
+// CacheWarmer preloads the row cache of the configured tables in the
+// background when queries are allowed, so a restarted tablet doesn't
+// send all its initial misses to MySQL. Queries are served while
+// the cache is warming.
+type CacheWarmer struct {
+	mu            sync.Mutex
+	sqlQuery      *SqlQuery
+	specs         map[string]WarmSpec
+	rowsPerSecond int
+	done          chan struct{}
+	wg            sync.WaitGroup
+
+	// progress is protected by progressMu because it's
+	// updated by the warmer goroutine.
+	progressMu sync.Mutex
+	running    bool
+	progress   map[string]*warmProgress
+}
+
+type warmProgress struct {
+	Target, Warmed int
+}
+
+func NewCacheWarmer(sqlQuery *SqlQuery) *CacheWarmer {
+	return &CacheWarmer{sqlQuery: sqlQuery}
+}
+
+// SetSpecs sets the tables warmed by Open. Warming is throttled to
+// rowsPerSecond rows, or not throttled if rowsPerSecond is 0.
+func (self *CacheWarmer) SetSpecs(specs map[string]WarmSpec, rowsPerSecond int) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.specs = specs
+	self.rowsPerSecond = rowsPerSecond
+}
+
+func (self *CacheWarmer) Open() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if len(self.specs) == 0 || self.done != nil {
+		return
+	}
+	self.progressMu.Lock()
+	self.running = true
+	self.progress = make(map[string]*warmProgress, len(self.specs))
+	self.progressMu.Unlock()
+	self.done = make(chan struct{})
+	self.wg.Add(1)
+	go self.run(self.done, self.specs, self.rowsPerSecond)
+}
+
+func (self *CacheWarmer) Close() {
+	self.mu.Lock()
+	if self.done == nil {
+		self.mu.Unlock()
+		return
+	}
+	close(self.done)
+	self.done = nil
+	self.mu.Unlock()
+	self.wg.Wait()
+}
+
+func (self *CacheWarmer) run(done chan struct{}, specs map[string]WarmSpec, rowsPerSecond int) {
+	defer self.wg.Done()
+	defer func() {
+		self.progressMu.Lock()
+		self.running = false
+		self.progressMu.Unlock()
+	}()
+	start := time.Now()
+	tableNames := make([]string, 0, len(specs))
+	for tableName := range specs {
+		tableNames = append(tableNames, tableName)
+	}
+	sort.Strings(tableNames)
+	for _, tableName := range tableNames {
+		if !self.warmTable(done, tableName, specs[tableName], rowsPerSecond) {
+			relog.Info("Cache warming stopped")
+			return
+		}
+	}
+	relog.Info("Cache warming done in %v", time.Now().Sub(start))
+}
+
+// warmTable returns false if the warmer was closed.
+func (self *CacheWarmer) warmTable(done chan struct{}, tableName string, spec WarmSpec, rowsPerSecond int) (ok bool) {
+	defer func() {
+		if x := recover(); x != nil {
+			cacheWarmingErrors.Add(tableName, 1)
+			relog.Error("Could not warm the cache of %s: %v", tableName, x)
+			ok = true
+		}
+	}()
+	var pkRows [][]interface{}
+	if spec.KeyFile != "" {
+		var err error
+		if pkRows, err = loadKeyFile(spec.KeyFile); err != nil {
+			panic(err)
+		}
+	} else {
+		pkRows = self.sqlQuery.highestPKs(tableName, spec.Rows)
+	}
+	progress := &warmProgress{Target: len(pkRows)}
+	self.progressMu.Lock()
+	self.progress[tableName] = progress
+	self.progressMu.Unlock()
+
+	batchSize := PK_BATCH_SIZE
+	if rowsPerSecond > 0 && rowsPerSecond < batchSize {
+		batchSize = rowsPerSecond
+	}
+	for start := 0; start < len(pkRows); start += batchSize {
+		end := start + batchSize
+		if end > len(pkRows) {
+			end = len(pkRows)
+		}
+		batchStart := time.Now()
+		count := self.sqlQuery.warmRows(tableName, pkRows[start:end])
+		cacheWarmingStats.Add(tableName, int64(count))
+		self.progressMu.Lock()
+		progress.Warmed += count
+		self.progressMu.Unlock()
+		var delay time.Duration
+		if rowsPerSecond > 0 {
+			delay = time.Duration(end-start)*time.Second/time.Duration(rowsPerSecond) - time.Now().Sub(batchStart)
+		}
+		select {
+		case <-done:
+			return false
+		case <-time.After(delay):
+		}
+	}
+	relog.Info("Warmed the cache of %s with %d rows", tableName, progress.Warmed)
+	return true
+}
+
+func (self *CacheWarmer) StatsJSON() string {
+	self.progressMu.Lock()
+	defer self.progressMu.Unlock()
+	buf := bytes.NewBuffer(make([]byte, 0, 128))
+	fmt.Fprintf(buf, "{\"Running\": %v, \"Tables\": {", self.running)
+	tableNames := make([]string, 0, len(self.progress))
+	for tableName := range self.progress {
+		tableNames = append(tableNames, tableName)
+	}
+	sort.Strings(tableNames)
+	for i, tableName := range tableNames {
+		if i != 0 {
+			buf.WriteString(", ")
+		}
+		progress := self.progress[tableName]
+		fmt.Fprintf(buf, "\"%s\": {\"Target\": %v, \"Warmed\": %v}", tableName, progress.Target, progress.Warmed)
+	}
+	buf.WriteString("}}")
+	return buf.String()
+}
+
+// loadKeyFile reads the pks listed in filename. Blank lines are skipped.
+func loadKeyFile(filename string) (pkRows [][]interface{}, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if line = strings.TrimSpace(line); line != "" {
+			values := strings.Split(line, ",")
+			pkRow := make([]interface{}, len(values))
+			for i, value := range values {
+				pkRow[i] = strings.TrimSpace(value)
+			}
+			pkRows = append(pkRows, pkRow)
+		}
+		if err == io.EOF {
+			return pkRows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	panic("unreachable")
+}
+
+// buildWarmQuery returns the query that fetches the rows of pkRows.
+// It's the outer query of the selects that go through the row cache.
+func buildWarmQuery(tableInfo *TableInfo, pkRows [][]interface{}) []byte {
+	tree, err := sqlparser.Parse("select * from " + tableInfo.Name)
+	if err != nil {
+		panic(NewTabletError(FAIL, "%s", err))
+	}
+	outerQuery := tree.GenerateSelectOuterQuery(tableInfo.Indexes[0])
+	sql, err := outerQuery.GenerateQuery(map[string]interface{}{}, []interface{}{buildPKList(tableInfo, pkRows)})
+	if err != nil {
+		panic(NewTabletError(FAIL, "%s", err))
+	}
+	return sql
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tabletserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLoadKeyFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "keyfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("1, a\n\n2,b\n3,c")
+	file.Close()
+
+	pkRows, err := loadKeyFile(file.Name())
+	if err != nil {
+		t.Fatalf("loadKeyFile: %v", err)
+	}
+	if got := fmt.Sprintf("%v", pkRows); got != "[[1 a] [2 b] [3 c]]" {
+		t.Errorf("want [[1 a] [2 b] [3 c]], got %s", got)
+	}
+	if _, err = loadKeyFile(file.Name() + ".missing"); err == nil {
+		t.Errorf("want error for missing file")
+	}
+}
+
+func TestBuildWarmQuery(t *testing.T) {
+	tableInfo := newStreamTable()
+	pkRows := [][]interface{}{{int64(1), "a"}, {int64(2), "it's"}}
+	want := "select * from t where (id = 1 and name = 'a') or (id = 2 and name = 'it\\'s')"
+	if got := string(buildWarmQuery(tableInfo, pkRows)); got != want {
+		t.Errorf("want %s, got %s", want, got)
+	}
+
+	tableInfo = newPKTable()
+	want = "select * from t where id in (1, 2)"
+	if got := string(buildWarmQuery(tableInfo, [][]interface{}{{int64(1)}, {int64(2)}})); got != want {
+		t.Errorf("want %s, got %s", want, got)
+	}
+}
@@ -123,9 +123,15 @@ func normalizeRows(tableInfo *TableInfo, columnNumbers []int, rows [][]interface
 }
 
 func buildKey(tableInfo *TableInfo, row []interface{}) (key string) {
+	return buildColumnsKey(tableInfo, tableInfo.PKColumns, row)
+}
+
+// buildColumnsKey encodes row, the values of columnNumbers, like
+// buildKey does for pks.
+func buildColumnsKey(tableInfo *TableInfo, columnNumbers []int, row []interface{}) (key string) {
 	buf := bytes.NewBuffer(make([]byte, 0, 32))
-	for i, pkValue := range row {
-		encodePKValue(buf, pkValue, tableInfo.ColumnIsNumber[tableInfo.PKColumns[i]])
+	for i, value := range row {
+		encodePKValue(buf, value, tableInfo.ColumnIsNumber[columnNumbers[i]])
 		buf.WriteByte(',')
 	}
 	return buf.String()
@@ -219,6 +225,18 @@ func escapeWrite(buf *bytes.Buffer, b byte) {
 		buf.WriteString("\\/")
 	case '*':
 		buf.WriteString("\\*")
+	case '\x00':
+		buf.WriteString("\\0")
+	case '\b':
+		buf.WriteString("\\b")
+	case '\n':
+		buf.WriteString("\\n")
+	case '\r':
+		buf.WriteString("\\r")
+	case '\t':
+		buf.WriteString("\\t")
+	case 26:
+		buf.WriteString("\\Z")
 	default:
 		buf.WriteByte(b)
 	}
@@ -47,7 +47,7 @@ func NewConnectionPool(capacity int, idleTimeout time.Duration) *ConnectionPool
 
 func (self *ConnectionPool) Open(connFactory CreateConnectionFunc) {
 	f := func() (pools.Resource, error) {
-		c, err := connFactory()
+		c, err := connectWithBackoff(connFactory)
 		if err != nil {
 			return nil, err
 		}
@@ -57,10 +57,12 @@ func (self *ConnectionPool) Open(connFactory CreateConnectionFunc) {
 }
 
 // You must call Recycle on the PoolConnection once done.
+// If MySQL can't be reached, it panics with a RETRY error.
+// Other errors, like access denied, panic with FATAL.
 func (self *ConnectionPool) Get() PoolConnection {
 	r, err := self.RoundRobin.Get()
 	if err != nil {
-		panic(NewTabletErrorSql(FATAL, err))
+		panic(connectError(err))
 	}
 	return r.(*pooledConnection)
 }
@@ -69,7 +71,7 @@ func (self *ConnectionPool) Get() PoolConnection {
 func (self *ConnectionPool) TryGet() PoolConnection {
 	r, err := self.RoundRobin.TryGet()
 	if err != nil {
-		panic(NewTabletErrorSql(FATAL, err))
+		panic(connectError(err))
 	}
 	if r == nil {
 		return nil
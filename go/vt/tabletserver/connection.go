@@ -38,15 +38,25 @@ import (
 	"time"
 )
 
+const (
+	// Connection attempts are retried with exponential backoff
+	// starting at CONNECT_RETRY_DELAY.
+	CONNECT_ATTEMPTS    = 5
+	CONNECT_RETRY_DELAY = 10 * time.Millisecond
+)
+
 var mysqlStats *stats.Timings
+var reconnectStats *stats.Counters
 var QueryLogger *relog.Logger
 
 func init() {
 	mysqlStats = stats.NewTimings("MySQL")
+	reconnectStats = stats.NewCounters("Reconnects")
 }
 
 type PoolConnection interface {
 	ExecuteFetch(query []byte, maxrows int) (*QueryResult, error)
+	ExecuteStreamFetch(query []byte, callback func(*QueryResult) error, streamBufferSize int) error
 	Id() int64
 	Close()
 	IsClosed() bool
@@ -55,9 +65,22 @@ type PoolConnection interface {
 
 type CreateConnectionFunc func() (connection *DBConnection, err error)
 
-// DBConnection re-exposes mysql.Connection with some wrapping.
+// MysqlConnection is the part of mysql.Connection used by DBConnection.
+// It lets the query service run against a fake MySQL in tests.
+type MysqlConnection interface {
+	ExecuteFetch(query []byte, maxrows int) (*mysql.QueryResult, error)
+	ExecuteStreamFetch(query []byte) error
+	Fields() []mysql.Field
+	FetchNext() ([]interface{}, error)
+	CloseResult()
+	Id() int64
+	Close()
+	IsClosed() bool
+}
+
+// DBConnection re-exposes a MysqlConnection with some wrapping.
 type DBConnection struct {
-	*mysql.Connection
+	MysqlConnection
 }
 
 func (self *DBConnection) ExecuteFetch(query []byte, maxrows int) (*QueryResult, error) {
@@ -65,17 +88,10 @@ func (self *DBConnection) ExecuteFetch(query []byte, maxrows int) (*QueryResult,
 	if QueryLogger != nil {
 		QueryLogger.Info("%s", query)
 	}
-	mqr, err := self.Connection.ExecuteFetch(query, maxrows)
+	mqr, err := self.MysqlConnection.ExecuteFetch(query, maxrows)
 	if err != nil {
 		mysqlStats.Record("Exec", start)
-		if sqlErr, ok := err.(*mysql.SqlError); ok {
-			if sqlErr.Number() >= 2000 && sqlErr.Number() <= 2018 { // mysql connection errors
-				self.Close()
-			}
-			if sqlErr.Number() == 1317 { // Query was interrupted
-				self.Close()
-			}
-		}
+		self.handleError(err)
 		return nil, err
 	}
 	mysqlStats.Record("Exec", start)
@@ -83,6 +99,109 @@ func (self *DBConnection) ExecuteFetch(query []byte, maxrows int) (*QueryResult,
 	return &qr, nil
 }
 
+// ExecuteStreamFetch sends the results of query to callback in chunks of
+// roughly streamBufferSize bytes. The first chunk contains only the fields.
+// If callback fails, the connection is closed to abort the query.
+func (self *DBConnection) ExecuteStreamFetch(query []byte, callback func(*QueryResult) error, streamBufferSize int) error {
+	start := time.Now()
+	if QueryLogger != nil {
+		QueryLogger.Info("%s", query)
+	}
+	defer mysqlStats.Record("ExecStream", start)
+
+	if err := self.MysqlConnection.ExecuteStreamFetch(query); err != nil {
+		self.handleError(err)
+		return err
+	}
+	defer self.CloseResult()
+
+	if err := callback(&QueryResult{Fields: self.Fields()}); err != nil {
+		self.Close()
+		return err
+	}
+
+	qr := &QueryResult{}
+	byteCount := 0
+	for {
+		row, err := self.FetchNext()
+		if err != nil {
+			self.handleError(err)
+			return err
+		}
+		if row == nil {
+			break
+		}
+		qr.Rows = append(qr.Rows, row)
+		byteCount += DBResultRow(row).Size()
+		if byteCount >= streamBufferSize {
+			qr.RowsAffected = uint64(len(qr.Rows))
+			if err = callback(qr); err != nil {
+				self.Close()
+				return err
+			}
+			qr = &QueryResult{}
+			byteCount = 0
+		}
+	}
+	if len(qr.Rows) != 0 {
+		qr.RowsAffected = uint64(len(qr.Rows))
+		if err := callback(qr); err != nil {
+			self.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *DBConnection) handleError(err error) {
+	if IsConnectionError(err) {
+		self.Close()
+	}
+	if sqlErr, ok := err.(*mysql.SqlError); ok {
+		if sqlErr.Number() == 1317 { // Query was interrupted
+			self.Close()
+		}
+	}
+}
+
+// IsConnectionError returns true if err means the connection
+// to MySQL was lost, or could not be established.
+func IsConnectionError(err error) bool {
+	if sqlErr, ok := err.(hasNumber); ok {
+		return sqlErr.Number() >= 2000 && sqlErr.Number() <= 2018 // mysql client errors
+	}
+	return false
+}
+
+// connectError converts an error from a connection factory.
+// Only connection errors are worth retrying: others, like access
+// denied or unknown database, won't go away by themselves.
+func connectError(err error) *TabletError {
+	if IsConnectionError(err) {
+		return NewTabletErrorSql(RETRY, err)
+	}
+	return NewTabletErrorSql(FATAL, err)
+}
+
+// connectWithBackoff calls connFactory up to CONNECT_ATTEMPTS times,
+// doubling the delay between attempts, so that queries ride out
+// a quick MySQL restart.
+func connectWithBackoff(connFactory CreateConnectionFunc) (conn *DBConnection, err error) {
+	delay := CONNECT_RETRY_DELAY
+	for attempt := 1; ; attempt++ {
+		if conn, err = connFactory(); err == nil {
+			return conn, nil
+		}
+		if attempt == CONNECT_ATTEMPTS || !IsConnectionError(err) {
+			return nil, err
+		}
+		reconnectStats.Add("Connect", 1)
+		time.Sleep(delay)
+		delay *= 2
+	}
+	panic("unreachable")
+}
+
 // CreateConnection returns a connection for running user queries. No DDL.
 func CreateConnection(socketPath, dbName string) (*DBConnection, error) {
 	info := map[string]interface{}{
@@ -94,8 +213,7 @@ func CreateConnection(socketPath, dbName string) (*DBConnection, error) {
 		"dbname":      dbName,
 		"charset":     "utf8",
 	}
-	c, err := mysql.Connect(info)
-	return &DBConnection{c}, err
+	return CreateGenericConnection(info)
 }
 
 // ConnectionCreator creates a closure that wraps CreateConnection
@@ -118,8 +236,7 @@ func CreateSuperConnection(socketPath, dbName string) (*DBConnection, error) {
 		"dbname":      dbName,
 		"charset":     "utf8",
 	}
-	c, err := mysql.Connect(info)
-	return &DBConnection{c}, err
+	return CreateGenericConnection(info)
 }
 
 // SuperConnectionCreator is a closure that wraps CreateSuperConnection
@@ -131,7 +248,10 @@ func SuperConnectionCreator(socketPath, dbName string) CreateConnectionFunc {
 
 func CreateGenericConnection(info map[string]interface{}) (*DBConnection, error) {
 	c, err := mysql.Connect(info)
-	return &DBConnection{c}, err
+	if err != nil {
+		return nil, err
+	}
+	return &DBConnection{c}, nil
 }
 
 func GenericConnectionCreator(info map[string]interface{}) CreateConnectionFunc {
@@ -46,9 +46,9 @@ type Consolidator struct {
 	consolidations *cache.LRUCache
 }
 
-func NewConsolidator() *Consolidator {
+func NewConsolidator(name string) *Consolidator {
 	self := &Consolidator{queries: make(map[string]*Result), consolidations: cache.NewLRUCache(1000)}
-	http.Handle("/debug/consolidations", self)
+	http.Handle(debugPath(name, "consolidations"), self)
 	return self
 }
 
@@ -58,15 +58,21 @@ type Result struct {
 	sql          string
 	Result       *QueryResult
 	Err          *TabletError
+
+	// size is the number of bytes counted against the ResultBudget
+	// for Result. It's released when all refs are done with it.
+	size int64
+	refs int32 // Use sync/atomic
 }
 
 func (self *Consolidator) Create(sql string) (r *Result, created bool) {
 	self.mu.Lock()
 	defer self.mu.Unlock()
 	if r, ok := self.queries[sql]; ok {
+		atomic.AddInt32(&r.refs, 1)
 		return r, false
 	}
-	r = &Result{consolidator: self, sql: sql}
+	r = &Result{consolidator: self, sql: sql, refs: 1}
 	r.executing.Lock()
 	self.queries[sql] = r
 	return r, true
@@ -107,6 +113,14 @@ func (self *Result) Wait() {
 	self.executing.RLock()
 }
 
+// Release gives up a reference to the result, and returns
+// its memory to budget if it was the last one.
+func (self *Result) Release(budget *ResultBudget) {
+	if atomic.AddInt32(&self.refs, -1) == 0 {
+		budget.Release(self.size)
+	}
+}
+
 type ccount int64
 
 func (self *ccount) Size() int {
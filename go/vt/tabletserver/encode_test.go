@@ -47,7 +47,7 @@ func assertTrue(tf bool, msg string, t *testing.T) {
 func TestQuery(t *testing.T) {
 	bv := make(map[string]interface{})
 	bv["foo"] = int64(20)
-	in := &Query{"abcd", bv, 24, 0, 0}
+	in := &Query{"abcd", bv, 24, 0, 0, 1e9}
 	encoded := bytes.NewBuffer(make([]byte, 0, 8))
 	in.MarshalBson(encoded)
 	expected, _ := bson.Marshal(in)
@@ -57,6 +57,7 @@ func TestQuery(t *testing.T) {
 	ret.UnmarshalBson(encoded)
 	assertTrue(ret.Sql == in.Sql, "Sql", t)
 	assertTrue(ret.BindVariables["foo"] == in.BindVariables["foo"], "bind vars", t)
+	assertTrue(ret.Timeout == in.Timeout, "timeout", t)
 }
 
 func TestQueryResult(t *testing.T) {
@@ -0,0 +1,208 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tabletserver
+
+import (
+	"bytes"
+	"code.google.com/p/vitess/go/vt/sqlparser"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// QueryPlan explains how a query gets executed.
+// Queries are generated as they would be sent to MySQL. Outer
+// queries that depend on the rows returned by the subquery can't
+// be generated without executing it: they're shown unsubstituted.
+type QueryPlan struct {
+	PlanId       string
+	Reason       string
+	TableName    string
+	IndexUsed    string
+	PKValues     []string
+	FullQuery    string
+	OuterQueries []string
+	Subquery     string
+}
+
+// Explain returns the plan of a query without executing it.
+func (self *SqlQuery) Explain(query *Query, reply *QueryPlan) (err error) {
+	defer handleError(&err)
+	self.checkState(query.SessionId, false)
+	*reply = *self.explain(query)
+	return nil
+}
+
+func (self *SqlQuery) explain(query *Query) *QueryPlan {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+
+	if query.BindVariables == nil {
+		query.BindVariables = make(map[string]interface{})
+	}
+	stripTrailing(query)
+	basePlan, tableInfo := self.schemaInfo.GetPlan(query.Sql, false)
+	defer self.schemaInfo.Put(tableInfo)
+	plan := &CompiledPlan{ExecPlan: basePlan, TableInfo: tableInfo, BindVars: query.BindVariables}
+
+	qp := newQueryPlan(plan.ExecPlan)
+	if plan.FullQuery != nil {
+		qp.FullQuery = string(self.generateFinalSql(plan.FullQuery, plan.BindVars, nil, nil))
+	}
+	if plan.Subquery != nil {
+		qp.Subquery = string(self.generateFinalSql(plan.Subquery, plan.BindVars, nil, nil))
+	}
+	switch plan.PlanId {
+	case sqlparser.PLAN_SELECT_PK:
+		pkRows := buildValueList(plan.PKValues, plan.BindVars)
+		normalizePKRows(tableInfo, pkRows)
+		qp.PKValues = formatRows(pkRows)
+		// Assuming all misses
+		batchSize := self.pkBatchSize()
+		for start := 0; start < len(pkRows); start += batchSize {
+			end := start + batchSize
+			if end > len(pkRows) {
+				end = len(pkRows)
+			}
+			listVars := []interface{}{buildPKList(tableInfo, pkRows[start:end])}
+			qp.OuterQueries = append(qp.OuterQueries, string(self.generateFinalSql(plan.OuterQuery, plan.BindVars, listVars, nil)))
+		}
+	case sqlparser.PLAN_DML_PK, sqlparser.PLAN_INSERT_PK:
+		pkRows := buildValueList(plan.PKValues, plan.BindVars)
+		normalizePKRows(tableInfo, pkRows)
+		qp.PKValues = formatRows(pkRows)
+		secondaryList := buildSecondaryList(pkRows, plan.SecondaryPKValues, plan.BindVars)
+		bsc := buildStreamComment(tableInfo, pkRows, secondaryList)
+		qp.OuterQueries = []string{string(self.generateFinalSql(plan.OuterQuery, plan.BindVars, nil, bsc))}
+	case sqlparser.PLAN_SELECT_CACHE_RESULT:
+		qp.OuterQueries = []string{string(self.generateFinalSql(plan.OuterQuery, plan.BindVars, nil, nil))}
+	}
+	return qp
+}
+
+// newQueryPlan returns the plan with its queries unsubstituted.
+func newQueryPlan(plan *sqlparser.ExecPlan) *QueryPlan {
+	qp := &QueryPlan{
+		PlanId:    plan.PlanId.String(),
+		Reason:    plan.Reason.String(),
+		TableName: plan.TableName,
+		IndexUsed: plan.IndexUsed,
+	}
+	if plan.FullQuery != nil {
+		qp.FullQuery = plan.FullQuery.Query
+	}
+	if plan.OuterQuery != nil {
+		qp.OuterQueries = []string{plan.OuterQuery.Query}
+	}
+	if plan.Subquery != nil {
+		qp.Subquery = plan.Subquery.Query
+	}
+	return qp
+}
+
+func formatRows(rows [][]interface{}) []string {
+	formatted := make([]string, len(rows))
+	for i, row := range rows {
+		buf := bytes.NewBuffer(make([]byte, 0, 32))
+		buf.WriteByte('(')
+		if err := sqlparser.EncodeValue(buf, row); err != nil {
+			panic(NewTabletError(FAIL, "%s", err))
+		}
+		buf.WriteByte(')')
+		formatted[i] = buf.String()
+	}
+	return formatted
+}
+
+// ServeQueryPlans explains the query given by the sql parameter, using
+// the bind variables given as a JSON object by the bindvars parameter.
+// Without a query, it lists the plans of the cached queries.
+func (self *SqlQuery) ServeQueryPlans(response http.ResponseWriter, request *http.Request) {
+	defer func() {
+		if x := recover(); x != nil {
+			response.WriteHeader(http.StatusBadRequest)
+			response.Write([]byte(fmt.Sprintf("%v\n", x)))
+		}
+	}()
+	if atomic.LoadInt32(&self.state) != OPEN {
+		panic(NewTabletError(RETRY, "unavailable"))
+	}
+	response.Header().Set("Content-Type", "text/plain")
+	if sql := request.FormValue("sql"); sql != "" {
+		query := &Query{Sql: sql, BindVariables: make(map[string]interface{})}
+		if bindVars := request.FormValue("bindvars"); bindVars != "" {
+			if err := json.Unmarshal([]byte(bindVars), &query.BindVariables); err != nil {
+				panic(NewTabletError(FAIL, "invalid bindvars: %v", err))
+			}
+			convertJSONNumbers(query.BindVariables)
+		}
+		data, err := json.MarshalIndent(self.explain(query), "", "  ")
+		if err != nil {
+			panic(NewTabletError(FAIL, "%v", err))
+		}
+		response.Write(data)
+		response.Write([]byte("\n"))
+		return
+	}
+
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	items := self.schemaInfo.Queries.Items()
+	response.Write([]byte(fmt.Sprintf("Length: %d\n", len(items))))
+	for _, item := range items {
+		data, err := json.MarshalIndent(newQueryPlan(item.Value.(*sqlparser.ExecPlan)), "", "  ")
+		if err != nil {
+			continue
+		}
+		response.Write([]byte(fmt.Sprintf("%s\n%s\n\n", item.Key, data)))
+	}
+}
+
+// convertJSONNumbers turns whole numbers back into integers:
+// encoding/json decodes all numbers as float64.
+func convertJSONNumbers(bindVars map[string]interface{}) {
+	for k, v := range bindVars {
+		switch val := v.(type) {
+		case float64:
+			if val == float64(int64(val)) {
+				bindVars[k] = int64(val)
+			}
+		case []interface{}:
+			for i, elem := range val {
+				if f, ok := elem.(float64); ok && f == float64(int64(f)) {
+					val[i] = int64(f)
+				}
+			}
+		}
+	}
+}
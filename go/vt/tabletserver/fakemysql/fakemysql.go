@@ -0,0 +1,370 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+// Package fakemysql is an in-memory stand-in for MySQL, to test the
+// query service without a running server. A DB answers the queries
+// it was scripted with, and fails the others.
+package fakemysql
+
+import (
+	"code.google.com/p/vitess/go/mysql"
+	"code.google.com/p/vitess/go/vt/tabletserver"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	// MySQL error numbers returned by the fake
+	ERR_UNKNOWN     = 1105
+	ERR_SERVER_GONE = 2006
+	ERR_OUT_OF_SYNC = 2014
+)
+
+// Column is a column of a Table. Type is as shown by describe,
+// e.g. "int(11)" or "varchar(128)".
+type Column struct {
+	Name string
+	Type string
+}
+
+// Index is an index of a Table. The primary key is the index
+// called PRIMARY.
+type Index struct {
+	Name    string
+	Unique  bool
+	Columns []string
+}
+
+// Table describes a table of the fake schema.
+type Table struct {
+	Name    string
+	Columns []Column
+	Indexes []Index
+}
+
+type pattern struct {
+	re     *regexp.Regexp
+	result *mysql.QueryResult
+}
+
+// DB is a fake MySQL server. Queries are looked up as rejected
+// queries first, then as exact queries, then as patterns in the
+// order they were added.
+type DB struct {
+	mu         sync.Mutex
+	queries    map[string]*mysql.QueryResult
+	patterns   []pattern
+	rejected   map[string]error
+	tables     []string
+	log        []string
+	conns      map[int64]*Conn
+	lastId     int64
+	connectErr error
+}
+
+// NewDB creates a DB with no tables, which accepts begin, commit
+// and rollback.
+func NewDB() *DB {
+	self := &DB{
+		queries:  make(map[string]*mysql.QueryResult),
+		rejected: make(map[string]error),
+		conns:    make(map[int64]*Conn),
+	}
+	self.AddQuery("begin", &mysql.QueryResult{})
+	self.AddQuery("commit", &mysql.QueryResult{})
+	self.AddQuery("rollback", &mysql.QueryResult{})
+	self.AddQuery("show tables", &mysql.QueryResult{Fields: []mysql.Field{{Name: "Tables", Type: 253}}})
+	return self
+}
+
+// AddQuery makes query return result.
+func (self *DB) AddQuery(query string, result *mysql.QueryResult) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.queries[query] = result
+}
+
+// AddQueryPattern makes the queries that entirely match the regexp
+// expr return result.
+func (self *DB) AddQueryPattern(expr string, result *mysql.QueryResult) {
+	re := regexp.MustCompile("^(?:" + expr + ")$")
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.patterns = append(self.patterns, pattern{re, result})
+}
+
+// AddRejectedQuery makes query fail with err, usually a *mysql.SqlError
+// such as mysql.NewSqlError(1062, "Duplicate entry '1' for key 'PRIMARY'").
+func (self *DB) AddRejectedQuery(query string, err error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.rejected[query] = err
+}
+
+// DeleteQuery forgets the result or the error of query.
+func (self *DB) DeleteQuery(query string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	delete(self.queries, query)
+	delete(self.rejected, query)
+}
+
+// AddTable adds table to the schema. It scripts the answers to the
+// queries the query service loads the schema with.
+func (self *DB) AddTable(table *Table) {
+	describe := &mysql.QueryResult{Fields: []mysql.Field{{Name: "Field", Type: 253}, {Name: "Type", Type: 252}, {Name: "Null", Type: 253}, {Name: "Key", Type: 253}, {Name: "Default", Type: 252}, {Name: "Extra", Type: 253}}}
+	fields := &mysql.QueryResult{}
+	for _, col := range table.Columns {
+		describe.Rows = append(describe.Rows, []interface{}{col.Name, col.Type, "YES", "", nil, ""})
+		fields.Fields = append(fields.Fields, mysql.Field{Name: col.Name, Type: fieldType(col.Type)})
+	}
+	describe.RowsAffected = uint64(len(describe.Rows))
+
+	indexes := &mysql.QueryResult{Fields: []mysql.Field{{Name: "Table", Type: 253}, {Name: "Non_unique", Type: 8}, {Name: "Key_name", Type: 253}, {Name: "Seq_in_index", Type: 8}, {Name: "Column_name", Type: 253}}}
+	for _, index := range table.Indexes {
+		nonUnique := "1"
+		if index.Unique || index.Name == "PRIMARY" {
+			nonUnique = "0"
+		}
+		for i, col := range index.Columns {
+			indexes.Rows = append(indexes.Rows, []interface{}{table.Name, nonUnique, index.Name, fmt.Sprintf("%d", i+1), col})
+		}
+	}
+	indexes.RowsAffected = uint64(len(indexes.Rows))
+
+	self.mu.Lock()
+	self.tables = append(self.tables, table.Name)
+	showTables := &mysql.QueryResult{Fields: []mysql.Field{{Name: "Tables", Type: 253}}}
+	for _, name := range self.tables {
+		showTables.Rows = append(showTables.Rows, []interface{}{name})
+	}
+	showTables.RowsAffected = uint64(len(showTables.Rows))
+	self.mu.Unlock()
+
+	self.AddQuery("show tables", showTables)
+	self.AddQuery("describe "+table.Name, describe)
+	self.AddQuery("show index from "+table.Name, indexes)
+	self.AddQuery("select * from "+table.Name+" where 1!=1", fields)
+}
+
+// fieldType returns the MySQL field type of a column type.
+func fieldType(columnType string) int64 {
+	switch {
+	case strings.HasPrefix(columnType, "bigint"):
+		return 8
+	case strings.HasPrefix(columnType, "int"):
+		return 3
+	case strings.HasPrefix(columnType, "float"):
+		return 4
+	}
+	return 253
+}
+
+// QueryLog returns the queries received since the last ResetQueryLog,
+// including the failed ones.
+func (self *DB) QueryLog() []string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return append([]string(nil), self.log...)
+}
+
+func (self *DB) ResetQueryLog() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.log = nil
+}
+
+// SetConnectError makes new connections fail with err,
+// or succeed again if err is nil.
+func (self *DB) SetConnectError(err error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.connectErr = err
+}
+
+// Restart drops all the connections, as if MySQL was restarted.
+// Their next query fails with a 2006 error.
+func (self *DB) Restart() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for id, conn := range self.conns {
+		conn.gone = true
+		delete(self.conns, id)
+	}
+}
+
+// Connections returns the number of connections still open.
+func (self *DB) Connections() int {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return len(self.conns)
+}
+
+func (self *DB) Connect() (*Conn, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.connectErr != nil {
+		return nil, self.connectErr
+	}
+	self.lastId++
+	conn := &Conn{db: self, id: self.lastId}
+	self.conns[conn.id] = conn
+	return conn, nil
+}
+
+// ConnectionCreator returns a CreateConnectionFunc that connects to self.
+func (self *DB) ConnectionCreator() tabletserver.CreateConnectionFunc {
+	return func() (*tabletserver.DBConnection, error) {
+		conn, err := self.Connect()
+		if err != nil {
+			return nil, err
+		}
+		return &tabletserver.DBConnection{MysqlConnection: conn}, nil
+	}
+}
+
+func (self *DB) execute(conn *Conn, query string) (*mysql.QueryResult, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if conn.closed {
+		return nil, mysql.NewSqlError(ERR_SERVER_GONE, "Connection is closed")
+	}
+	if conn.gone {
+		return nil, &mysql.SqlError{Num: ERR_SERVER_GONE, Message: "MySQL server has gone away", Query: query}
+	}
+	self.log = append(self.log, query)
+	if err, ok := self.rejected[query]; ok {
+		return nil, err
+	}
+	if result, ok := self.queries[query]; ok {
+		return result, nil
+	}
+	for _, p := range self.patterns {
+		if p.re.MatchString(query) {
+			return p.result, nil
+		}
+	}
+	return nil, &mysql.SqlError{Num: ERR_UNKNOWN, Message: "query not scripted in fakemysql", Query: query}
+}
+
+// Conn is a connection to a DB. It implements tabletserver.MysqlConnection.
+type Conn struct {
+	db     *DB
+	id     int64
+	closed bool // protected by db.mu
+	gone   bool // protected by db.mu
+
+	// The current streaming query
+	stream *mysql.QueryResult
+	next   int
+}
+
+func (self *Conn) ExecuteFetch(query []byte, maxrows int) (*mysql.QueryResult, error) {
+	result, err := self.db.execute(self, string(query))
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Rows) > maxrows {
+		return nil, &mysql.SqlError{Num: 0, Message: fmt.Sprintf("Row count exceeded %d", maxrows), Query: string(query)}
+	}
+	qr := *result
+	qr.Rows = make([][]interface{}, len(result.Rows))
+	for i, row := range result.Rows {
+		qr.Rows[i] = copyRow(row)
+	}
+	return &qr, nil
+}
+
+func (self *Conn) ExecuteStreamFetch(query []byte) error {
+	if self.stream != nil {
+		return mysql.NewSqlError(ERR_OUT_OF_SYNC, "Streaming query already in progress")
+	}
+	result, err := self.db.execute(self, string(query))
+	if err != nil {
+		return err
+	}
+	self.stream = result
+	self.next = 0
+	return nil
+}
+
+func (self *Conn) Fields() []mysql.Field {
+	if self.stream == nil {
+		return nil
+	}
+	return self.stream.Fields
+}
+
+func (self *Conn) FetchNext() ([]interface{}, error) {
+	if self.stream == nil {
+		return nil, mysql.NewSqlError(ERR_OUT_OF_SYNC, "No streaming query in progress")
+	}
+	if self.next == len(self.stream.Rows) {
+		return nil, nil
+	}
+	self.next++
+	return copyRow(self.stream.Rows[self.next-1]), nil
+}
+
+// copyRow returns a copy of a scripted row: callers can change the
+// rows they get, like those of a real MySQL.
+func copyRow(row []interface{}) []interface{} {
+	result := make([]interface{}, len(row))
+	copy(result, row)
+	return result
+}
+
+func (self *Conn) CloseResult() {
+	self.stream = nil
+}
+
+func (self *Conn) Id() int64 {
+	if self.IsClosed() {
+		return 0
+	}
+	return self.id
+}
+
+func (self *Conn) Close() {
+	self.db.mu.Lock()
+	defer self.db.mu.Unlock()
+	self.closed = true
+	self.stream = nil
+	delete(self.db.conns, self.id)
+}
+
+func (self *Conn) IsClosed() bool {
+	self.db.mu.Lock()
+	defer self.db.mu.Unlock()
+	return self.closed
+}
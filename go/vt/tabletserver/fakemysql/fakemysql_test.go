@@ -0,0 +1,148 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package fakemysql
+
+import (
+	"code.google.com/p/vitess/go/mysql"
+	"testing"
+)
+
+func errno(err error) int {
+	if sqlErr, ok := err.(*mysql.SqlError); ok {
+		return sqlErr.Number()
+	}
+	return -1
+}
+
+func TestScriptedQueries(t *testing.T) {
+	db := NewDB()
+	db.AddQuery("select 1 from dual", &mysql.QueryResult{Rows: [][]interface{}{{"1"}}})
+	db.AddQueryPattern("select .* from t", &mysql.QueryResult{Rows: [][]interface{}{{"a"}, {"b"}}})
+	db.AddRejectedQuery("insert into t values (1)", mysql.NewSqlError(1062, "Duplicate entry '1' for key 'PRIMARY'"))
+	conn, err := db.Connect()
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+
+	if qr, err := conn.ExecuteFetch([]byte("select 1 from dual"), 10); err != nil || len(qr.Rows) != 1 {
+		t.Errorf("exact query: %v, %v", qr, err)
+	}
+	if qr, err := conn.ExecuteFetch([]byte("select a from t"), 10); err != nil || len(qr.Rows) != 2 {
+		t.Errorf("pattern: %v, %v", qr, err)
+	}
+	if qr, _ := conn.ExecuteFetch([]byte("select a from t"), 10); qr != nil {
+		qr.Rows[0][0] = "c"
+	}
+	if qr, _ := conn.ExecuteFetch([]byte("select a from t"), 10); qr == nil || qr.Rows[0][0] != "a" {
+		t.Errorf("want the scripted rows unchanged, got %v", qr)
+	}
+	if _, err := conn.ExecuteFetch([]byte("select a from t where 1"), 10); errno(err) != ERR_UNKNOWN {
+		t.Errorf("patterns must match the whole query, got %v", err)
+	}
+	if _, err := conn.ExecuteFetch([]byte("select a from t"), 1); err == nil || errno(err) != 0 {
+		t.Errorf("want row count exceeded, got %v", err)
+	}
+	if _, err := conn.ExecuteFetch([]byte("insert into t values (1)"), 10); errno(err) != 1062 {
+		t.Errorf("want 1062, got %v", err)
+	}
+	want := []string{"select 1 from dual", "select a from t", "select a from t", "select a from t", "select a from t where 1", "select a from t", "insert into t values (1)"}
+	if log := db.QueryLog(); len(log) != len(want) || log[6] != want[6] {
+		t.Errorf("query log: %q, want %q", log, want)
+	}
+}
+
+func TestStream(t *testing.T) {
+	db := NewDB()
+	db.AddQuery("select a from t", &mysql.QueryResult{Fields: []mysql.Field{{Name: "a", Type: 253}}, Rows: [][]interface{}{{"a"}, {"b"}}})
+	conn, _ := db.Connect()
+	if err := conn.ExecuteStreamFetch([]byte("select a from t")); err != nil {
+		t.Fatalf("stream: %v", err)
+	}
+	if err := conn.ExecuteStreamFetch([]byte("select a from t")); errno(err) != ERR_OUT_OF_SYNC {
+		t.Errorf("want %v, got %v", ERR_OUT_OF_SYNC, err)
+	}
+	if fields := conn.Fields(); len(fields) != 1 {
+		t.Errorf("fields: %v", fields)
+	}
+	count := 0
+	for {
+		row, err := conn.FetchNext()
+		if err != nil {
+			t.Fatalf("fetch: %v", err)
+		}
+		if row == nil {
+			break
+		}
+		row[0] = "c"
+		count++
+	}
+	if count != 2 {
+		t.Errorf("want 2 rows, got %d", count)
+	}
+	conn.CloseResult()
+	if _, err := conn.FetchNext(); errno(err) != ERR_OUT_OF_SYNC {
+		t.Errorf("want %v, got %v", ERR_OUT_OF_SYNC, err)
+	}
+	conn.ExecuteStreamFetch([]byte("select a from t"))
+	if row, _ := conn.FetchNext(); row == nil || row[0] != "a" {
+		t.Errorf("want the scripted rows unchanged, got %v", row)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	db := NewDB()
+	conn, _ := db.Connect()
+	db.Restart()
+	if db.Connections() != 0 {
+		t.Errorf("want no connections, got %d", db.Connections())
+	}
+	if _, err := conn.ExecuteFetch([]byte("begin"), 10); errno(err) != ERR_SERVER_GONE {
+		t.Errorf("want %v, got %v", ERR_SERVER_GONE, err)
+	}
+
+	db.SetConnectError(mysql.NewSqlError(2002, "Can't connect to local MySQL server"))
+	if _, err := db.ConnectionCreator()(); errno(err) != 2002 {
+		t.Errorf("want 2002, got %v", err)
+	}
+	db.SetConnectError(nil)
+	dbConn, err := db.ConnectionCreator()()
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	if _, err := dbConn.ExecuteFetch([]byte("begin"), 10); err != nil {
+		t.Errorf("begin: %v", err)
+	}
+	dbConn.Close()
+	if !dbConn.IsClosed() || dbConn.Id() != 0 || db.Connections() != 0 {
+		t.Errorf("connection not closed")
+	}
+}
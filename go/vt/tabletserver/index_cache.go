@@ -0,0 +1,200 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tabletserver
+
+import (
+	"code.google.com/p/vitess/go/cache"
+	"code.google.com/p/vitess/go/vt/schema"
+	"fmt"
+	"sync/atomic"
+)
+
+// IndexCache maps the values of a unique secondary index to the pks
+// of their rows, for PLAN_SELECT_SUBQUERY lookups by that index to be
+// served by the row cache without running the subquery. Entries are
+// added by lookups that miss, and deleted when the rows they point
+// to are invalidated. A lookup that races with a DML can still add
+// a stale entry, so the rows of a hit are verified before use.
+type IndexCache struct {
+	Name string
+	// Columns are the column numbers of the index in the table
+	Columns []int
+	entries *cache.LRUCache // index key -> *indexEntry
+	pks     *cache.LRUCache // pk key -> indexKey
+	// hits & misses count lookups, not values
+	hits, misses int64
+}
+
+type indexEntry struct {
+	pkRow []interface{}
+	pkKey string
+}
+
+func (self *indexEntry) Size() int {
+	return 1
+}
+
+type indexKey string
+
+func (self indexKey) Size() int {
+	return 1
+}
+
+// NewIndexCache creates an index cache of index that holds up to
+// capacity entries.
+func NewIndexCache(tableInfo *TableInfo, index *schema.Index, capacity uint64) *IndexCache {
+	columns := make([]int, len(index.Columns))
+	for i, column := range index.Columns {
+		columns[i] = tableInfo.FindColumn(column)
+	}
+	return &IndexCache{
+		Name:    index.Name,
+		Columns: columns,
+		entries: cache.NewLRUCache(capacity),
+		pks:     cache.NewLRUCache(capacity),
+	}
+}
+
+// Lookup returns the pks of the rows of indexRows, which must be
+// normalized. It returns nil unless they're all in the cache. keys
+// maps the key of every value of indexRows to the key of its pk.
+// The pks are copies that the caller can change.
+func (self *IndexCache) Lookup(tableInfo *TableInfo, indexRows [][]interface{}) (pkRows [][]interface{}, keys map[string]string) {
+	pkRows = make([][]interface{}, 0, len(indexRows))
+	keys = make(map[string]string, len(indexRows))
+	for _, indexRow := range indexRows {
+		key, ok := self.buildKey(tableInfo, indexRow)
+		if !ok {
+			atomic.AddInt64(&self.misses, 1)
+			return nil, nil
+		}
+		if _, ok := keys[key]; ok {
+			continue
+		}
+		value, ok := self.entries.Get(key)
+		if !ok {
+			atomic.AddInt64(&self.misses, 1)
+			return nil, nil
+		}
+		entry := value.(*indexEntry)
+		// Keep the reverse entry as fresh as the entry.
+		self.pks.Get(entry.pkKey)
+		keys[key] = entry.pkKey
+		pkRow := make([]interface{}, len(entry.pkRow))
+		copy(pkRow, entry.pkRow)
+		pkRows = append(pkRows, pkRow)
+	}
+	atomic.AddInt64(&self.hits, 1)
+	return pkRows, keys
+}
+
+// Verify reports whether rows, which are full table rows, are the
+// rows of keys as returned by Lookup. If not, the entries of keys
+// are deleted.
+func (self *IndexCache) Verify(tableInfo *TableInfo, keys map[string]string, rows [][]interface{}) bool {
+	found := make(map[string]bool, len(keys))
+	for _, row := range rows {
+		key, ok := self.buildKey(tableInfo, applyFilter(self.Columns, row))
+		if !ok || keys[key] != buildKey(tableInfo, applyFilter(tableInfo.PKColumns, row)) {
+			break
+		}
+		found[key] = true
+	}
+	if len(found) == len(keys) && len(rows) == len(keys) {
+		return true
+	}
+	for key := range keys {
+		self.Delete(key)
+	}
+	return false
+}
+
+// Fill adds the entries of rows, which are full table rows.
+func (self *IndexCache) Fill(tableInfo *TableInfo, rows [][]interface{}) {
+	for _, row := range rows {
+		key, ok := self.buildKey(tableInfo, applyFilter(self.Columns, row))
+		if !ok {
+			continue
+		}
+		pkRow := applyFilter(tableInfo.PKColumns, row)
+		// Normalized like the pks the queries look up.
+		normalizePKRows(tableInfo, [][]interface{}{pkRow})
+		self.set(key, pkRow, buildKey(tableInfo, pkRow))
+	}
+}
+
+func (self *IndexCache) set(key string, pkRow []interface{}, pkKey string) {
+	if value, ok := self.pks.Get(pkKey); ok && string(value.(indexKey)) != key {
+		self.entries.Delete(string(value.(indexKey)))
+	}
+	self.entries.Set(key, &indexEntry{pkRow, pkKey})
+	self.pks.Set(pkKey, indexKey(key))
+}
+
+// Delete deletes the entry of the index key key.
+func (self *IndexCache) Delete(key string) {
+	if value, ok := self.entries.Get(key); ok {
+		self.pks.Delete(value.(*indexEntry).pkKey)
+	}
+	self.entries.Delete(key)
+}
+
+// DeletePK deletes the entry that points to the row of pkKey.
+func (self *IndexCache) DeletePK(pkKey string) {
+	if value, ok := self.pks.Get(pkKey); ok {
+		self.entries.Delete(string(value.(indexKey)))
+		self.pks.Delete(pkKey)
+	}
+}
+
+// buildKey returns false if indexRow has values that can't be
+// looked up in the cache, like NULLs.
+func (self *IndexCache) buildKey(tableInfo *TableInfo, indexRow []interface{}) (key string, ok bool) {
+	for _, value := range indexRow {
+		switch value.(type) {
+		case int, int32, int64, uint, uint32, uint64, string, []byte:
+		default:
+			return "", false
+		}
+	}
+	return buildColumnsKey(tableInfo, self.Columns, indexRow), true
+}
+
+func (self *IndexCache) StatsJSON() string {
+	length, _, capacity, _ := self.entries.Stats()
+	return fmt.Sprintf("{\"Length\": %v, \"Capacity\": %v, \"Hits\": %v, \"Misses\": %v}",
+		length,
+		capacity,
+		atomic.LoadInt64(&self.hits),
+		atomic.LoadInt64(&self.misses),
+	)
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tabletserver
+
+import (
+	"code.google.com/p/vitess/go/vt/schema"
+	"fmt"
+	"testing"
+)
+
+func newIndexCacheTable() (*TableInfo, *IndexCache) {
+	tableInfo := &TableInfo{Table: schema.NewTable("users")}
+	tableInfo.AddColumn("id", "bigint(20)")
+	tableInfo.AddColumn("email", "varchar(64)")
+	tableInfo.AddIndex("PRIMARY").AddColumn("id")
+	index := tableInfo.AddIndex("users_email")
+	index.AddColumn("email")
+	index.Unique = true
+	tableInfo.PKColumns = []int{0}
+	return tableInfo, NewIndexCache(tableInfo, index, 10)
+}
+
+func lookup(tableInfo *TableInfo, indexCache *IndexCache, values ...interface{}) (pks string, keys map[string]string) {
+	indexRows := make([][]interface{}, len(values))
+	for i, value := range values {
+		indexRows[i] = []interface{}{value}
+	}
+	pkRows, keys := indexCache.Lookup(tableInfo, indexRows)
+	if pkRows == nil {
+		return "miss", nil
+	}
+	return fmt.Sprintf("%v", pkRows), keys
+}
+
+func TestIndexCacheLookup(t *testing.T) {
+	tableInfo, indexCache := newIndexCacheTable()
+	if pks, _ := lookup(tableInfo, indexCache, "a@x"); pks != "miss" {
+		t.Errorf("want miss, got %s", pks)
+	}
+	indexCache.Fill(tableInfo, [][]interface{}{{"1", "a@x"}, {"2", "b@x"}, {"3", nil}})
+	if pks, _ := lookup(tableInfo, indexCache, "b@x", "a@x", "b@x"); pks != "[[2] [1]]" {
+		t.Errorf("want [[2] [1]], got %s", pks)
+	}
+	if pks, _ := lookup(tableInfo, indexCache, "a@x", "c@x"); pks != "miss" {
+		t.Errorf("want miss, got %s", pks)
+	}
+	if pks, _ := lookup(tableInfo, indexCache, nil); pks != "miss" {
+		t.Errorf("want miss, got %s", pks)
+	}
+	if got := indexCache.StatsJSON(); got != `{"Length": 2, "Capacity": 10, "Hits": 1, "Misses": 3}` {
+		t.Errorf("unexpected stats: %s", got)
+	}
+
+	// Callers can change the pks they get
+	pkRows, _ := indexCache.Lookup(tableInfo, [][]interface{}{{"a@x"}})
+	pkRows[0][0] = nil
+	if pks, _ := lookup(tableInfo, indexCache, "a@x"); pks != "[[1]]" {
+		t.Errorf("want [[1]], got %s", pks)
+	}
+}
+
+func TestIndexCacheVerify(t *testing.T) {
+	tableInfo, indexCache := newIndexCacheTable()
+	indexCache.Fill(tableInfo, [][]interface{}{{"1", "a@x"}, {"2", "b@x"}})
+	_, keys := lookup(tableInfo, indexCache, "a@x", "b@x")
+	if !indexCache.Verify(tableInfo, keys, [][]interface{}{{"1", "a@x"}, {"2", "b@x"}}) {
+		t.Errorf("want rows verified")
+	}
+	// The row of b@x changed its email.
+	if indexCache.Verify(tableInfo, keys, [][]interface{}{{"1", "a@x"}, {"2", "c@x"}}) {
+		t.Errorf("want changed row rejected")
+	}
+	if pks, _ := lookup(tableInfo, indexCache, "a@x"); pks != "miss" {
+		t.Errorf("want entries deleted, got %s", pks)
+	}
+
+	// The row of a@x is gone.
+	indexCache.Fill(tableInfo, [][]interface{}{{"1", "a@x"}})
+	_, keys = lookup(tableInfo, indexCache, "a@x")
+	if indexCache.Verify(tableInfo, keys, nil) {
+		t.Errorf("want missing row rejected")
+	}
+}
+
+func TestIndexCacheInvalidation(t *testing.T) {
+	tableInfo, indexCache := newIndexCacheTable()
+	indexCache.Fill(tableInfo, [][]interface{}{{"1", "a@x"}, {"2", "b@x"}})
+	indexCache.DeletePK(buildKey(tableInfo, []interface{}{"1"}))
+	if pks, _ := lookup(tableInfo, indexCache, "a@x"); pks != "miss" {
+		t.Errorf("want miss, got %s", pks)
+	}
+	if pks, _ := lookup(tableInfo, indexCache, "b@x"); pks != "[[2]]" {
+		t.Errorf("want [[2]], got %s", pks)
+	}
+
+	// A new email for row 2 replaces the old one.
+	indexCache.Fill(tableInfo, [][]interface{}{{"2", "c@x"}})
+	if pks, _ := lookup(tableInfo, indexCache, "b@x"); pks != "miss" {
+		t.Errorf("want miss, got %s", pks)
+	}
+	if pks, _ := lookup(tableInfo, indexCache, "c@x"); pks != "[[2]]" {
+		t.Errorf("want [[2]], got %s", pks)
+	}
+}
@@ -0,0 +1,382 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tabletserver
+
+import (
+	"code.google.com/p/vitess/go/relog"
+	"code.google.com/p/vitess/go/stats"
+	"code.google.com/p/vitess/go/vt/sqlparser"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How often the position is saved, at most.
+	POSITION_SAVE_INTERVAL = 1 * time.Second
+	// How long to wait before reopening an event source that failed.
+	EVENT_SOURCE_RETRY_DELAY = 1 * time.Second
+)
+
+// StreamEvent is a statement that was applied to the database, along
+// with the position right after it in the stream.
+type StreamEvent struct {
+	Sql      string
+	Position string
+}
+
+// EventSource supplies the statements applied to the database, in order.
+type EventSource interface {
+	// Next blocks until the next event is available.
+	// It returns io.EOF once the source is closed.
+	Next() (event *StreamEvent, err error)
+	Close()
+}
+
+// CreateEventSourceFunc opens an event source at position.
+// An empty position means the beginning of the stream.
+type CreateEventSourceFunc func(position string) (EventSource, error)
+
+var invalidationStats = stats.NewCounters("Invalidations")
+var invalidatorErrors = stats.NewCounters("InvalidatorErrors")
+
+// Invalidator deletes the rows changed by the statements of an event
+// source from the row cache, based on their _stream comments. This
+// covers the writes that didn't go through this tablet. The position
+// is saved in a file so the invalidator can resume after a restart.
+type Invalidator struct {
+	mu            sync.Mutex
+	sqlQuery      *SqlQuery
+	sourceFactory CreateEventSourceFunc
+	positionFile  string
+	source        EventSource
+	done          chan struct{}
+	wg            sync.WaitGroup
+
+	// position is protected by positionMu because it's
+	// updated by the invalidator goroutine.
+	positionMu sync.Mutex
+	position   string
+	lastSave   time.Time
+	events     int64
+}
+
+func NewInvalidator(sqlQuery *SqlQuery) *Invalidator {
+	return &Invalidator{sqlQuery: sqlQuery}
+}
+
+// SetEventSource sets the event source used by Open. Open is a no-op
+// until an event source is set. An empty positionFile disables saving
+// the position: a restarted invalidator starts from the beginning.
+func (self *Invalidator) SetEventSource(sourceFactory CreateEventSourceFunc, positionFile string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.sourceFactory = sourceFactory
+	self.positionFile = positionFile
+}
+
+func (self *Invalidator) Open() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.sourceFactory == nil || self.done != nil {
+		return
+	}
+	self.setPosition(self.loadPosition())
+	self.done = make(chan struct{})
+	self.wg.Add(1)
+	go self.run(self.done)
+	relog.Info("Invalidator started at position '%s'", self.getPosition())
+}
+
+func (self *Invalidator) Close() {
+	self.mu.Lock()
+	if self.done == nil {
+		self.mu.Unlock()
+		return
+	}
+	close(self.done)
+	self.done = nil
+	if self.source != nil {
+		self.source.Close()
+	}
+	self.mu.Unlock()
+	self.wg.Wait()
+	self.savePosition()
+	relog.Info("Invalidator stopped at position '%s'", self.getPosition())
+}
+
+func (self *Invalidator) run(done chan struct{}) {
+	defer self.wg.Done()
+	for {
+		source, err := self.sourceFactory(self.getPosition())
+		if err != nil {
+			invalidatorErrors.Add("Open", 1)
+			relog.Error("Could not open event source at '%s': %v", self.getPosition(), err)
+		} else if !self.setSource(source, done) {
+			source.Close()
+			return
+		} else {
+			err = self.consume(source)
+			self.setSource(nil, done)
+			source.Close()
+			if err != io.EOF {
+				invalidatorErrors.Add("Read", 1)
+				relog.Error("Error reading event source at '%s': %v", self.getPosition(), err)
+			}
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(EVENT_SOURCE_RETRY_DELAY):
+		}
+	}
+}
+
+// setSource makes source visible to Close. It returns false if
+// the invalidator was closed in the meantime.
+func (self *Invalidator) setSource(source EventSource, done chan struct{}) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.done != done {
+		return false
+	}
+	self.source = source
+	return true
+}
+
+func (self *Invalidator) consume(source EventSource) error {
+	for {
+		event, err := source.Next()
+		if err != nil {
+			return err
+		}
+		self.invalidateEvent(event.Sql)
+		self.positionMu.Lock()
+		self.position = event.Position
+		self.events++
+		saveNow := time.Now().Sub(self.lastSave) > POSITION_SAVE_INTERVAL
+		self.positionMu.Unlock()
+		if saveNow {
+			self.savePosition()
+		}
+	}
+	panic("unreachable")
+}
+
+func (self *Invalidator) invalidateEvent(sql string) {
+	defer func() {
+		if x := recover(); x != nil {
+			invalidatorErrors.Add("Invalidate", 1)
+			relog.Error("Could not invalidate for '%s': %v", sql, x)
+		}
+	}()
+	tableName, columns, pkValueList, err := parseStreamComment(sql)
+	if err != nil {
+		invalidatorErrors.Add("Parse", 1)
+		relog.Warning("Could not parse stream comment of '%s': %v", sql, err)
+		return
+	}
+	if tableName == "" {
+		return
+	}
+	self.sqlQuery.invalidateRows(tableName, columns, pkValueList)
+}
+
+func (self *Invalidator) getPosition() string {
+	self.positionMu.Lock()
+	defer self.positionMu.Unlock()
+	return self.position
+}
+
+func (self *Invalidator) setPosition(position string) {
+	self.positionMu.Lock()
+	defer self.positionMu.Unlock()
+	self.position = position
+}
+
+func (self *Invalidator) loadPosition() string {
+	if self.positionFile == "" {
+		return ""
+	}
+	data, err := ioutil.ReadFile(self.positionFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			invalidatorErrors.Add("LoadPosition", 1)
+			relog.Error("Could not read position file %s: %v", self.positionFile, err)
+		}
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// savePosition writes the position to a temporary file first,
+// so a crash never leaves a truncated position file.
+func (self *Invalidator) savePosition() {
+	self.positionMu.Lock()
+	defer self.positionMu.Unlock()
+	self.lastSave = time.Now()
+	if self.positionFile == "" {
+		return
+	}
+	tmpFile := self.positionFile + ".tmp"
+	err := ioutil.WriteFile(tmpFile, []byte(self.position+"\n"), 0664)
+	if err == nil {
+		err = os.Rename(tmpFile, self.positionFile)
+	}
+	if err != nil {
+		invalidatorErrors.Add("SavePosition", 1)
+		relog.Error("Could not save position to %s: %v", self.positionFile, err)
+	}
+}
+
+func (self *Invalidator) StatsJSON() string {
+	self.mu.Lock()
+	running := self.done != nil
+	self.mu.Unlock()
+	self.positionMu.Lock()
+	defer self.positionMu.Unlock()
+	position, _ := json.Marshal(self.position)
+	return fmt.Sprintf("{\"Running\": %v, \"Position\": %s, \"Events\": %v}", running, position, self.events)
+}
+
+// parseStreamComment extracts the table name, pk column names and pk
+// values from the comment added by buildStreamComment:
+//
+//	/* _stream table (col1 col2 ) (val1 val2 ) (val1 val2 ); */
+//
+// String values are unescaped. It returns an empty table name if sql
+// has no such comment.
+func parseStreamComment(sql string) (tableName string, columns []string, pkValueList [][]interface{}, err error) {
+	start := strings.Index(sql, "/* _stream ")
+	if start == -1 {
+		return "", nil, nil, nil
+	}
+	parser := &streamCommentParser{sql: sql, pos: start + len("/* _stream ")}
+	defer parser.handleError(&err)
+	tableName = parser.word()
+	parser.expect('(')
+	for parser.skipSpaces() != ')' {
+		columns = append(columns, parser.word())
+	}
+	parser.expect(')')
+	for parser.skipSpaces() == '(' {
+		parser.expect('(')
+		pkValues := make([]interface{}, 0, len(columns))
+		for parser.skipSpaces() != ')' {
+			pkValues = append(pkValues, parser.value())
+		}
+		parser.expect(')')
+		pkValueList = append(pkValueList, pkValues)
+	}
+	parser.expect(';')
+	return tableName, columns, pkValueList, nil
+}
+
+type streamCommentParser struct {
+	sql string
+	pos int
+}
+
+type streamCommentError string
+
+func (self *streamCommentParser) handleError(err *error) {
+	if x := recover(); x != nil {
+		parseError, ok := x.(streamCommentError)
+		if !ok {
+			panic(x)
+		}
+		*err = fmt.Errorf("%s at position %d", parseError, self.pos)
+	}
+}
+
+// skipSpaces returns the next non-space character.
+func (self *streamCommentParser) skipSpaces() byte {
+	for self.pos < len(self.sql) && self.sql[self.pos] == ' ' {
+		self.pos++
+	}
+	if self.pos == len(self.sql) {
+		panic(streamCommentError("unexpected end of comment"))
+	}
+	return self.sql[self.pos]
+}
+
+func (self *streamCommentParser) expect(c byte) {
+	if self.skipSpaces() != c {
+		panic(streamCommentError(fmt.Sprintf("expecting '%c'", c)))
+	}
+	self.pos++
+}
+
+func (self *streamCommentParser) word() string {
+	self.skipSpaces()
+	start := self.pos
+	for self.pos < len(self.sql) && !strings.ContainsRune(" ()", rune(self.sql[self.pos])) {
+		self.pos++
+	}
+	if start == self.pos {
+		panic(streamCommentError("expecting a name"))
+	}
+	return self.sql[start:self.pos]
+}
+
+// value returns numbers as is, and strings without their quotes and escapes.
+func (self *streamCommentParser) value() string {
+	if self.skipSpaces() != '\'' {
+		return self.word()
+	}
+	self.pos++
+	buf := make([]byte, 0, 16)
+	for self.pos < len(self.sql) {
+		c := self.sql[self.pos]
+		self.pos++
+		switch c {
+		case '\'':
+			return string(buf)
+		case '\\':
+			if self.pos == len(self.sql) {
+				panic(streamCommentError("unterminated string"))
+			}
+			c = self.sql[self.pos]
+			self.pos++
+			if decoded, ok := sqlparser.EscapeDecodeMap[c]; ok {
+				c = decoded
+			}
+		}
+		buf = append(buf, c)
+	}
+	panic(streamCommentError("unterminated string"))
+}
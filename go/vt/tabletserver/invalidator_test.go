@@ -0,0 +1,156 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tabletserver
+
+import (
+	"code.google.com/p/vitess/go/vt/schema"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func newStreamTable() *TableInfo {
+	tableInfo := &TableInfo{Table: schema.NewTable("t")}
+	tableInfo.AddColumn("id", "int")
+	tableInfo.AddColumn("name", "varchar")
+	tableInfo.AddColumn("val", "varchar")
+	index := tableInfo.AddIndex("PRIMARY")
+	index.AddColumn("id")
+	index.AddColumn("name")
+	tableInfo.PKColumns = []int{0, 1}
+	return tableInfo
+}
+
+func TestParseStreamComment(t *testing.T) {
+	tableInfo := newStreamTable()
+	pkValueList := [][]interface{}{
+		{int64(1), "a"},
+		{int64(-2), "it's a /* \\ */ ( ) test"},
+	}
+	secondaryList := [][]interface{}{{"3", []byte("c")}}
+	sql := "update t set val = 1" + string(buildStreamComment(tableInfo, pkValueList, secondaryList))
+
+	tableName, columns, values, err := parseStreamComment(sql)
+	if err != nil {
+		t.Fatalf("parseStreamComment(%s): %v", sql, err)
+	}
+	if tableName != "t" || fmt.Sprintf("%v", columns) != "[id name]" {
+		t.Errorf("want t [id name], got %s %v", tableName, columns)
+	}
+	if len(values) != 3 {
+		t.Fatalf("want 3 rows, got %v", values)
+	}
+	all := append(pkValueList, secondaryList...)
+	for i, pkValues := range values {
+		if want, got := buildKey(tableInfo, all[i]), buildKey(tableInfo, pkValues); want != got {
+			t.Errorf("want key %s, got %s", want, got)
+		}
+	}
+
+	if tableName, _, _, err = parseStreamComment("select 1 from dual"); tableName != "" || err != nil {
+		t.Errorf("want no comment, got %s %v", tableName, err)
+	}
+	for _, bad := range []string{
+		"update t set a=1 /* _stream t (id ) (1 ) */",
+		"update t set a=1 /* _stream t (id ) ('1 ); */",
+		"update t set a=1 /* _stream t (id ",
+	} {
+		if _, _, _, err = parseStreamComment(bad); err == nil {
+			t.Errorf("parseStreamComment(%s): want error", bad)
+		}
+	}
+}
+
+func TestStreamCommentEscapes(t *testing.T) {
+	tableInfo := newStreamTable()
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	for _, name := range []string{"a\nb\r\t\x00\b\x1a", "\\n", string(all)} {
+		pkValueList := [][]interface{}{{int64(1), name}}
+		sql := "update t set val = 1" + string(buildStreamComment(tableInfo, pkValueList, nil))
+		_, _, values, err := parseStreamComment(sql)
+		if err != nil {
+			t.Fatalf("parseStreamComment(%q): %v", sql, err)
+		}
+		if len(values) != 1 {
+			t.Fatalf("want 1 row, got %v", values)
+		}
+		if want, got := buildKey(tableInfo, pkValueList[0]), buildKey(tableInfo, values[0]); want != got {
+			t.Errorf("%q: want key %s, got %s", name, want, got)
+		}
+	}
+}
+
+func TestBinlogFileSource(t *testing.T) {
+	file, err := ioutil.TempFile("", "binlog_source_test")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	defer os.Remove(file.Name())
+	fmt.Fprintf(file, "DELIMITER /*!*/;\n# at 4\nBEGIN\n/*!*/;\n# at 100\nSET TIMESTAMP=1/*!*/;\n")
+	fmt.Fprintf(file, "update t set a=1\nwhere id=1 /* _stream t (id ) (1 ); */\n/*!*/;\n")
+	file.Close()
+
+	source, err := NewBinlogFileSource(file.Name(), "")
+	if err != nil {
+		t.Fatalf("NewBinlogFileSource: %v", err)
+	}
+	want := []string{"BEGIN", "SET TIMESTAMP=1", "update t set a=1\nwhere id=1 /* _stream t (id ) (1 ); */"}
+	var positions []string
+	for _, sql := range want {
+		event, err := source.Next()
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if event.Sql != sql {
+			t.Errorf("want %q, got %q", sql, event.Sql)
+		}
+		positions = append(positions, event.Position)
+	}
+	source.Close()
+	if _, err = source.Next(); err == nil {
+		t.Errorf("Next after Close: want error")
+	}
+
+	source, err = NewBinlogFileSource(file.Name(), positions[0])
+	if err != nil {
+		t.Fatalf("NewBinlogFileSource: %v", err)
+	}
+	defer source.Close()
+	event, err := source.Next()
+	if err != nil || event.Sql != want[1] || event.Position != positions[1] {
+		t.Errorf("resume: want %q at %s, got %v %v", want[1], positions[1], event, err)
+	}
+}
@@ -0,0 +1,359 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tabletserver
+
+import (
+	"bytes"
+	"code.google.com/p/vitess/go/cache"
+	"code.google.com/p/vitess/go/memcache"
+	"code.google.com/p/vitess/go/pools"
+	"code.google.com/p/vitess/go/relog"
+	"code.google.com/p/vitess/go/stats"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+const (
+	// Item flags
+	MEMCACHE_ROW         = 0
+	MEMCACHE_PLACEHOLDER = 1
+
+	// A placeholder is left in memcache when a Get misses. A subsequent
+	// SetIfAbsent uses its cas value, and fails if the key was deleted
+	// in the meantime. Placeholders expire after this many seconds.
+	MEMCACHE_PLACEHOLDER_TIMEOUT = 10
+
+	MEMCACHE_MAX_KEY_LEN = 250
+
+	// Max number of cas values remembered for pending fills
+	MEMCACHE_CAS_CACHE_SIZE = 10000
+
+	// Max number of recent hits remembered for SampleKeys
+	MEMCACHE_RECENT_KEYS_SIZE = 1000
+)
+
+var memcacheErrors = stats.NewCounters("MemcacheErrors")
+
+// MemcachePool is a pool of connections to a memcached server.
+type MemcachePool struct {
+	*pools.RoundRobin
+	address string
+}
+
+func NewMemcachePool(address string, capacity int) *MemcachePool {
+	self := &MemcachePool{address: address}
+	self.RoundRobin = pools.NewRoundRobin(capacity, self.connect, 0)
+	return self
+}
+
+func (self *MemcachePool) connect() (pools.Resource, error) {
+	conn, err := memcache.Connect(self.address)
+	if err != nil {
+		return nil, err
+	}
+	return &memcacheConnection{conn, self}, nil
+}
+
+// Get returns nil if a connection could not be obtained.
+// You must call Recycle on the connection once done.
+func (self *MemcachePool) Get() *memcacheConnection {
+	r, err := self.RoundRobin.Get()
+	if err != nil {
+		memcacheErrors.Add("Connect", 1)
+		relog.Error("Could not connect to memcache at %s: %v", self.address, err)
+		return nil
+	}
+	return r.(*memcacheConnection)
+}
+
+type memcacheConnection struct {
+	*memcache.Connection
+	pool *MemcachePool
+}
+
+func (self *memcacheConnection) Recycle() {
+	self.pool.Put(self)
+}
+
+// MemcacheRowCache caches the rows of a table in memcache.
+// Errors are logged and counted. They result in cache misses.
+// Memcache outlives schema changes, so keys contain a signature of
+// the columns: rows cached for an older schema are never read.
+type MemcacheRowCache struct {
+	pool       *MemcachePool
+	prefix     string
+	numColumns int
+	casValues  *cache.LRUCache
+	recentKeys *cache.LRUCache
+}
+
+func NewMemcacheRowCache(pool *MemcachePool, keyPrefix string, tableInfo *TableInfo) RowCache {
+	return &MemcacheRowCache{
+		pool:       pool,
+		prefix:     keyPrefix + "." + tableInfo.Name + "." + schemaSignature(tableInfo) + ".",
+		numColumns: len(tableInfo.Columns),
+		casValues:  cache.NewLRUCache(MEMCACHE_CAS_CACHE_SIZE),
+		recentKeys: cache.NewLRUCache(MEMCACHE_RECENT_KEYS_SIZE),
+	}
+}
+
+func (self *MemcacheRowCache) Get(key string) (row DBResultRow, ok bool) {
+	conn := self.pool.Get()
+	if conn == nil {
+		return nil, false
+	}
+	defer conn.Recycle()
+
+	mkey := self.memcacheKey(key)
+	results, err := conn.Gets(mkey)
+	if err != nil {
+		self.logError("Get", err)
+		return nil, false
+	}
+	if len(results) == 0 {
+		if _, err = conn.Add(mkey, MEMCACHE_PLACEHOLDER, MEMCACHE_PLACEHOLDER_TIMEOUT, nil); err != nil {
+			self.logError("Add", err)
+			return nil, false
+		}
+		if results, err = conn.Gets(mkey); err != nil {
+			self.logError("Get", err)
+			return nil, false
+		}
+		if len(results) == 0 {
+			return nil, false
+		}
+	}
+	if results[0].Flags == MEMCACHE_PLACEHOLDER {
+		self.casValues.Set(key, casValue(results[0].Cas))
+		return nil, false
+	}
+	if row, ok = self.decode(conn, mkey, results[0].Value); !ok {
+		return nil, false
+	}
+	self.recentKeys.Set(key, recentKey{})
+	return row, true
+}
+
+// Peek doesn't leave a placeholder on misses, and doesn't count
+// hits as recent. Memcached still moves the key in its own LRU.
+func (self *MemcacheRowCache) Peek(key string) (row DBResultRow, ok bool) {
+	conn := self.pool.Get()
+	if conn == nil {
+		return nil, false
+	}
+	defer conn.Recycle()
+
+	mkey := self.memcacheKey(key)
+	results, err := conn.Gets(mkey)
+	if err != nil {
+		self.logError("Get", err)
+		return nil, false
+	}
+	if len(results) == 0 || results[0].Flags == MEMCACHE_PLACEHOLDER {
+		return nil, false
+	}
+	if row, ok = self.decode(conn, mkey, results[0].Value); !ok {
+		return nil, false
+	}
+	return row, true
+}
+
+func (self *MemcacheRowCache) Set(key string, row DBResultRow) {
+	conn := self.pool.Get()
+	if conn == nil {
+		return
+	}
+	defer conn.Recycle()
+	if _, err := conn.Set(self.memcacheKey(key), MEMCACHE_ROW, 0, encodeRow(row)); err != nil {
+		self.logError("Set", err)
+	}
+}
+
+// SetIfAbsent replaces the placeholder left by Get if it's unchanged.
+// If there was no Get, the row is added only if the key is absent.
+func (self *MemcacheRowCache) SetIfAbsent(key string, row DBResultRow) {
+	conn := self.pool.Get()
+	if conn == nil {
+		return
+	}
+	defer conn.Recycle()
+	mkey := self.memcacheKey(key)
+	var err error
+	if v, ok := self.casValues.Get(key); ok {
+		self.casValues.Delete(key)
+		_, err = conn.Cas(mkey, MEMCACHE_ROW, 0, encodeRow(row), uint64(v.(casValue)))
+	} else {
+		_, err = conn.Add(mkey, MEMCACHE_ROW, 0, encodeRow(row))
+	}
+	if err != nil {
+		self.logError("SetIfAbsent", err)
+	}
+}
+
+func (self *MemcacheRowCache) Delete(key string) bool {
+	conn := self.pool.Get()
+	if conn == nil {
+		return false
+	}
+	defer conn.Recycle()
+	self.recentKeys.Delete(key)
+	deleted, err := conn.Delete(self.memcacheKey(key))
+	if err != nil {
+		self.logError("Delete", err)
+		return false
+	}
+	return deleted
+}
+
+// SampleKeys returns keys that were recently hit. Memcache
+// can't list its keys.
+func (self *MemcacheRowCache) SampleKeys(count int) []string {
+	return self.recentKeys.SampleKeys(count)
+}
+
+// SetCapacity is a no-op. The capacity of memcache is set on its command line.
+func (self *MemcacheRowCache) SetCapacity(capacity uint64) {
+}
+
+func (self *MemcacheRowCache) StatsJSON() string {
+	return self.pool.StatsJSON()
+}
+
+// decode deletes values it can't decode. Otherwise, SetIfAbsent
+// could never replace them, and every Get would miss.
+func (self *MemcacheRowCache) decode(conn *memcacheConnection, mkey string, value []byte) (row DBResultRow, ok bool) {
+	if row, ok = decodeRow(value, self.numColumns); ok {
+		return row, true
+	}
+	memcacheErrors.Add("Decode", 1)
+	if _, err := conn.Delete(mkey); err != nil {
+		self.logError("Delete", err)
+	}
+	return nil, false
+}
+
+func (self *MemcacheRowCache) logError(op string, err error) {
+	memcacheErrors.Add(op, 1)
+	relog.Error("Memcache %s failed for %s: %v", op, self.prefix, err)
+}
+
+// memcacheKey returns a key that's acceptable to memcache. Keys that are
+// too long or contain spaces or control characters are replaced by their md5.
+func (self *MemcacheRowCache) memcacheKey(key string) string {
+	mkey := self.prefix + key
+	if len(mkey) <= MEMCACHE_MAX_KEY_LEN && isMemcacheSafe(mkey) {
+		return mkey
+	}
+	// buildKey never starts a key with '#'
+	hash := md5.New()
+	io.WriteString(hash, key)
+	return self.prefix + "#" + hex.EncodeToString(hash.Sum(nil))
+}
+
+// schemaSignature returns a short hash of the names and types of
+// the columns of tableInfo.
+func schemaSignature(tableInfo *TableInfo) string {
+	hash := md5.New()
+	for _, column := range tableInfo.Columns {
+		fmt.Fprintf(hash, "%s,", column)
+	}
+	for _, field := range tableInfo.Fields {
+		fmt.Fprintf(hash, "%d,", field.Type)
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:8]
+}
+
+func isMemcacheSafe(key string) bool {
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+type casValue uint64
+
+func (self casValue) Size() int {
+	return 1
+}
+
+type recentKey struct{}
+
+func (self recentKey) Size() int {
+	return 1
+}
+
+// encodeRow encodes every value as a varint length followed by the
+// bytes of the value. NULL values have a length of -1.
+func encodeRow(row DBResultRow) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, 16+row.Size()))
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	for _, v := range row {
+		if v == nil {
+			buf.Write(lenBuf[:binary.PutVarint(lenBuf, -1)])
+			continue
+		}
+		s := v.(string)
+		buf.Write(lenBuf[:binary.PutVarint(lenBuf, int64(len(s)))])
+		buf.WriteString(s)
+	}
+	return buf.Bytes()
+}
+
+// decodeRow returns false if data doesn't contain exactly numColumns values.
+func decodeRow(data []byte, numColumns int) (row DBResultRow, ok bool) {
+	row = make(DBResultRow, 0, numColumns)
+	for len(data) > 0 {
+		length, n := binary.Varint(data)
+		if n <= 0 {
+			return nil, false
+		}
+		data = data[n:]
+		if length < 0 {
+			row = append(row, nil)
+			continue
+		}
+		if int64(len(data)) < length {
+			return nil, false
+		}
+		row = append(row, string(data[:length]))
+		data = data[length:]
+	}
+	if len(row) != numColumns {
+		return nil, false
+	}
+	return row, true
+}
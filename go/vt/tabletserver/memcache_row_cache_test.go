@@ -0,0 +1,166 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tabletserver
+
+import (
+	"code.google.com/p/vitess/go/memcache/fakememcached"
+	"code.google.com/p/vitess/go/vt/schema"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestEncodeRow(t *testing.T) {
+	rows := []DBResultRow{
+		{"1", nil, "", "abc"},
+		{nil},
+		{strings.Repeat("a", 1000), "b"},
+	}
+	for _, row := range rows {
+		decoded, ok := decodeRow(encodeRow(row), len(row))
+		if !ok || fmt.Sprintf("%#v", decoded) != fmt.Sprintf("%#v", row) {
+			t.Errorf("want %#v, got %#v", row, decoded)
+		}
+	}
+	if _, ok := decodeRow(encodeRow(rows[0]), 3); ok {
+		t.Errorf("decodeRow accepted a row with the wrong number of columns")
+	}
+	if _, ok := decodeRow([]byte{20, 'a'}, 1); ok {
+		t.Errorf("decodeRow accepted a truncated value")
+	}
+}
+
+func newTestRowCache(t *testing.T) (*fakememcached.Server, RowCache) {
+	address := fmt.Sprintf("/tmp/memcache_row_cache_test-%d.sock", os.Getpid())
+	os.Remove(address)
+	server, err := fakememcached.Start(address)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	tableInfo := &TableInfo{Table: schema.NewTable("t")}
+	tableInfo.AddColumn("pk", "int")
+	tableInfo.AddColumn("name", "varchar")
+	factory := GenericRowCacheCreator(address, 2, "db")
+	return server, factory(tableInfo, 100)
+}
+
+func expectRow(t *testing.T, rc RowCache, key string, want DBResultRow) {
+	row, ok := rc.Get(key)
+	if want == nil {
+		if ok {
+			t.Errorf("Get(%s): want miss, got %v", key, row)
+		}
+		return
+	}
+	if !ok || fmt.Sprintf("%v", row) != fmt.Sprintf("%v", want) {
+		t.Errorf("Get(%s): want %v, got %v %v", key, want, row, ok)
+	}
+}
+
+func TestMemcacheRowCache(t *testing.T) {
+	server, rc := newTestRowCache(t)
+	defer server.Close()
+
+	row := DBResultRow{"1", "a"}
+	expectRow(t, rc, "1", nil)
+	rc.SetIfAbsent("1", row)
+	expectRow(t, rc, "1", row)
+
+	// An invalidation between Get and SetIfAbsent must prevent the fill.
+	expectRow(t, rc, "2", nil)
+	rc.Delete("2")
+	rc.SetIfAbsent("2", DBResultRow{"2", "stale"})
+	expectRow(t, rc, "2", nil)
+
+	// SetIfAbsent doesn't overwrite existing rows.
+	rc.SetIfAbsent("1", DBResultRow{"1", "b"})
+	expectRow(t, rc, "1", row)
+
+	rc.Set("1", DBResultRow{"1", nil})
+	expectRow(t, rc, "1", DBResultRow{"1", nil})
+	if !rc.Delete("1") {
+		t.Errorf("Delete: want true")
+	}
+	expectRow(t, rc, "1", nil)
+
+	// Keys that memcache can't take are hashed.
+	longKey := strings.Repeat("k", 300)
+	rc.Set(longKey, row)
+	expectRow(t, rc, longKey, row)
+	rc.Set("a b", row)
+	expectRow(t, rc, "a b", row)
+
+	// Peek leaves no placeholder, and doesn't make keys recent.
+	if _, ok := rc.Peek("3"); ok {
+		t.Errorf("Peek(3): want miss")
+	}
+	rc.SetIfAbsent("3", DBResultRow{"3", "c"})
+	if got, ok := rc.Peek("3"); !ok || got[1] != "c" {
+		t.Errorf("Peek(3): want [3 c], got %v", got)
+	}
+	for _, key := range rc.SampleKeys(10) {
+		if key == "3" {
+			t.Errorf("SampleKeys: want no 3, got %v", rc.SampleKeys(10))
+		}
+	}
+}
+
+func TestMemcacheRowCacheSchemaChange(t *testing.T) {
+	server, rc := newTestRowCache(t)
+	defer server.Close()
+	pool := rc.(*MemcacheRowCache).pool
+
+	row := DBResultRow{"1", "a"}
+	rc.Set("1", row)
+
+	// A new column changes the keys: the old rows are not read.
+	tableInfo := &TableInfo{Table: schema.NewTable("t")}
+	tableInfo.AddColumn("pk", "int")
+	tableInfo.AddColumn("name", "varchar")
+	tableInfo.AddColumn("foo", "varchar")
+	altered := NewMemcacheRowCache(pool, "db", tableInfo)
+	expectRow(t, altered, "1", nil)
+	altered.SetIfAbsent("1", DBResultRow{"1", "a", "b"})
+	expectRow(t, altered, "1", DBResultRow{"1", "a", "b"})
+	expectRow(t, rc, "1", row)
+
+	// Values that can't be decoded are deleted, and can be refilled.
+	conn := pool.Get()
+	if _, err := conn.Set(rc.(*MemcacheRowCache).memcacheKey("1"), MEMCACHE_ROW, 0, []byte{20, 'a'}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	conn.Recycle()
+	expectRow(t, rc, "1", nil)
+	rc.SetIfAbsent("1", row)
+	expectRow(t, rc, "1", row)
+}
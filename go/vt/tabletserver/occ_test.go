@@ -0,0 +1,776 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+// Tests ported from py/vttest/occ_test.py. They run the query service
+// against fakemysql instead of a real MySQL.
+package tabletserver_test
+
+import (
+	"bytes"
+	"code.google.com/p/vitess/go/mysql"
+	"code.google.com/p/vitess/go/relog"
+	"code.google.com/p/vitess/go/stats"
+	"code.google.com/p/vitess/go/vt/tabletserver"
+	"code.google.com/p/vitess/go/vt/tabletserver/fakemysql"
+	"encoding/json"
+	"expvar"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testDbName = "vttest"
+
+var startOnce sync.Once
+
+// newTestDB returns a DB with the tables of py/vttest/test_schema.sql.
+func newTestDB() *fakemysql.DB {
+	db := fakemysql.NewDB()
+	db.AddTable(&fakemysql.Table{
+		Name:    "vtocc_test",
+		Columns: []fakemysql.Column{{Name: "intval", Type: "int(11)"}, {Name: "floatval", Type: "float"}, {Name: "charval", Type: "varchar(256)"}, {Name: "binval", Type: "varbinary(256)"}},
+		Indexes: []fakemysql.Index{{Name: "PRIMARY", Unique: true, Columns: []string{"intval"}}},
+	})
+	db.AddTable(&fakemysql.Table{
+		Name:    "vtocc_a",
+		Columns: []fakemysql.Column{{Name: "eid", Type: "bigint(20)"}, {Name: "id", Type: "int(11)"}, {Name: "name", Type: "varchar(128)"}, {Name: "foo", Type: "varbinary(128)"}},
+		Indexes: []fakemysql.Index{{Name: "PRIMARY", Unique: true, Columns: []string{"eid", "id"}}},
+	})
+	db.AddTable(&fakemysql.Table{
+		Name:    "vtocc_b",
+		Columns: []fakemysql.Column{{Name: "eid", Type: "bigint(20)"}, {Name: "id", Type: "int(11)"}},
+		Indexes: []fakemysql.Index{{Name: "PRIMARY", Unique: true, Columns: []string{"eid", "id"}}},
+	})
+	db.AddTable(&fakemysql.Table{
+		Name:    "vtocc_c",
+		Columns: []fakemysql.Column{{Name: "eid", Type: "bigint(20)"}, {Name: "name", Type: "varbinary(128)"}, {Name: "foo", Type: "varbinary(128)"}},
+		Indexes: []fakemysql.Index{{Name: "PRIMARY", Unique: true, Columns: []string{"eid", "name"}}},
+	})
+	db.AddTable(&fakemysql.Table{
+		Name:    "vtocc_d",
+		Columns: []fakemysql.Column{{Name: "eid", Type: "bigint(20)"}, {Name: "id", Type: "int(11)"}},
+	})
+	db.AddQuery("select * from vtocc_test limit 10001", vtoccTestRows)
+	return db
+}
+
+var vtoccTestRows = &mysql.QueryResult{
+	Fields:       []mysql.Field{{Name: "intval", Type: 3}, {Name: "floatval", Type: 4}, {Name: "charval", Type: 253}, {Name: "binval", Type: 253}},
+	RowsAffected: 3,
+	Rows: [][]interface{}{
+		{"1", "1.12345", "\xc2\xa2", "\x00\xff"},
+		{"2", nil, "", nil},
+		{"3", nil, nil, nil},
+	},
+}
+
+// startService opens the query service on db, and returns
+// a session id for it.
+func startService(t *testing.T, db *fakemysql.DB) int64 {
+	return startCachedService(t, db, nil, 0)
+}
+
+// startCachedService is startService with the in-process row caches
+// of cachingInfo, and index caches of indexCacheSize entries.
+func startCachedService(t *testing.T, db *fakemysql.DB, cachingInfo map[string]uint64, indexCacheSize int) int64 {
+	startOnce.Do(func() {
+		tabletserver.StartQueryService(testDbName, tabletserver.Config{
+			PoolSize:            16,
+			TransactionCap:      20,
+			ReservedCap:         100,
+			TransactionTimeout:  30,
+			MaxResultSize:       10000,
+			StreamBufferSize:    32 * 1024,
+			DMLBatchSize:        100,
+			ResultBudget:        512 * 1024 * 1024,
+			QueryCacheSize:      5000,
+			SchemaReloadTime:    30 * 60,
+			QueryTimeout:        0,
+			IdleTimeout:         30 * 60,
+			ReservedIdleTimeout: 30 * 60,
+			SlowQueryThreshold:  1,
+			SlowQuerySampleRate: 0,
+		})
+	})
+	tabletserver.SetIndexCacheSize(testDbName, indexCacheSize)
+	tabletserver.AllowQueries(testDbName, db.ConnectionCreator(), cachingInfo, tabletserver.NewLRURowCache, db.ConnectionCreator())
+	sessionId, err := tabletserver.GetSessionId(testDbName, "")
+	if err != nil || sessionId == 0 {
+		t.Fatalf("query service didn't start: %v", err)
+	}
+	return sessionId
+}
+
+func stopService() {
+	tabletserver.DisallowQueries()
+}
+
+func execute(sessionId, transactionId int64, sql string, bindVars map[string]interface{}) (*tabletserver.QueryResult, error) {
+	if bindVars == nil {
+		bindVars = make(map[string]interface{})
+	}
+	query := &tabletserver.Query{Sql: sql, BindVariables: bindVars, TransactionId: transactionId, SessionId: sessionId}
+	reply := new(tabletserver.QueryResult)
+	if err := tabletserver.SqlQueryRpcService.Execute(query, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func begin(t *testing.T, sessionId int64) int64 {
+	var transactionId int64
+	if err := tabletserver.SqlQueryRpcService.Begin(&tabletserver.Session{SessionId: sessionId}, &transactionId); err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	return transactionId
+}
+
+func commit(t *testing.T, sessionId, transactionId int64) {
+	var noOutput string
+	if err := tabletserver.SqlQueryRpcService.Commit(&tabletserver.Session{TransactionId: transactionId, SessionId: sessionId}, &noOutput); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+}
+
+func rollback(t *testing.T, sessionId, transactionId int64) {
+	var noOutput string
+	if err := tabletserver.SqlQueryRpcService.Rollback(&tabletserver.Session{TransactionId: transactionId, SessionId: sessionId}, &noOutput); err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+}
+
+// counts returns the counts of the stats variable called name.
+func counts(name string) map[string]int64 {
+	switch v := expvar.Get(name).(type) {
+	case *stats.Counters:
+		return v.Counts()
+	case *stats.Timings:
+		return v.Counts()
+	}
+	return nil
+}
+
+func expectError(t *testing.T, err error, substr string) {
+	if err == nil {
+		t.Errorf("want error containing %#v, got none", substr)
+	} else if !strings.Contains(err.Error(), substr) {
+		t.Errorf("want error containing %#v, got %v", substr, err)
+	}
+}
+
+func TestSimpleRead(t *testing.T) {
+	db := newTestDB()
+	sessionId := startService(t, db)
+	defer stopService()
+
+	qr, err := execute(sessionId, 0, "select * from vtocc_test", nil)
+	if err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	if len(qr.Fields) != 4 || qr.Fields[0].Name != "intval" {
+		t.Errorf("fields: %v", qr.Fields)
+	}
+	if qr.RowsAffected != 3 || len(qr.Rows) != 3 {
+		t.Errorf("want 3 rows, got %v", qr)
+	}
+	if qr.Rows[0][2] != "\xc2\xa2" || qr.Rows[1][1] != nil {
+		t.Errorf("rows: %v", qr.Rows)
+	}
+}
+
+func TestCommit(t *testing.T) {
+	db := newTestDB()
+	db.AddQuery("insert into vtocc_test(intval, floatval, charval, binval) values (4, null, null, null) /* _stream vtocc_test (intval ) (4 ); */", &mysql.QueryResult{RowsAffected: 1})
+	sessionId := startService(t, db)
+	defer stopService()
+
+	start := counts("Transactions")
+	db.ResetQueryLog()
+	transactionId := begin(t, sessionId)
+	if transactionId == 0 {
+		t.Errorf("want a transaction id")
+	}
+	qr, err := execute(sessionId, transactionId, "insert into vtocc_test (intval, floatval, charval, binval) values(4, null, null, null)", nil)
+	if err != nil {
+		rollback(t, sessionId, transactionId)
+		t.Fatalf("insert: %v, query log: %q", err, db.QueryLog())
+	}
+	if qr.RowsAffected != 1 {
+		t.Errorf("want 1 row affected, got %v", qr.RowsAffected)
+	}
+	commit(t, sessionId, transactionId)
+	end := counts("Transactions")
+	if end["Completed"] != start["Completed"]+1 {
+		t.Errorf("Completed: want %v, got %v", start["Completed"]+1, end["Completed"])
+	}
+	want := []string{
+		"begin",
+		"insert into vtocc_test(intval, floatval, charval, binval) values (4, null, null, null) /* _stream vtocc_test (intval ) (4 ); */",
+		"commit",
+	}
+	if log := db.QueryLog(); !reflect.DeepEqual(log, want) {
+		t.Errorf("query log:\n%q\nwant:\n%q", log, want)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	db := newTestDB()
+	db.AddQueryPattern("insert into vtocc_test.*", &mysql.QueryResult{RowsAffected: 1})
+	sessionId := startService(t, db)
+	defer stopService()
+
+	start := counts("Transactions")
+	transactionId := begin(t, sessionId)
+	if _, err := execute(sessionId, transactionId, "insert into vtocc_test values(4, null, null, null)", nil); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	rollback(t, sessionId, transactionId)
+	end := counts("Transactions")
+	if end["Aborted"] != start["Aborted"]+1 {
+		t.Errorf("Aborted: want %v, got %v", start["Aborted"]+1, end["Aborted"])
+	}
+	if log := db.QueryLog(); log[len(log)-1] != "rollback" {
+		t.Errorf("want rollback, got %q", log)
+	}
+}
+
+func TestIntegrityError(t *testing.T) {
+	db := newTestDB()
+	db.AddRejectedQuery("insert into vtocc_test values (1, null, null, null)",
+		mysql.NewSqlError(1062, "Duplicate entry '1' for key 'PRIMARY'"))
+	sessionId := startService(t, db)
+	defer stopService()
+
+	start := counts("Errors")
+	transactionId := begin(t, sessionId)
+	_, err := execute(sessionId, transactionId, "insert into vtocc_test values(1, null, null, null)", nil)
+	expectError(t, err, "error: Duplicate")
+	if terr, ok := err.(*tabletserver.TabletError); !ok || terr.SqlError != tabletserver.DUPLICATE_KEY {
+		t.Errorf("want a duplicate key error, got %#v", err)
+	}
+	rollback(t, sessionId, transactionId)
+	end := counts("Errors")
+	if end["DupKey"] != start["DupKey"]+1 {
+		t.Errorf("DupKey: want %v, got %v", start["DupKey"]+1, end["DupKey"])
+	}
+}
+
+func TestNontxDml(t *testing.T) {
+	db := newTestDB()
+	sessionId := startService(t, db)
+	defer stopService()
+
+	start := counts("Errors")
+	db.ResetQueryLog()
+	_, err := execute(sessionId, 0, "insert into vtocc_test values(4, null, null, null)", nil)
+	expectError(t, err, "error: DMLs")
+	end := counts("Errors")
+	if end["Fail"] != start["Fail"]+1 {
+		t.Errorf("Fail: want %v, got %v", start["Fail"]+1, end["Fail"])
+	}
+	if log := db.QueryLog(); len(log) != 0 {
+		t.Errorf("want no queries sent to MySQL, got %q", log)
+	}
+}
+
+func TestForUpdate(t *testing.T) {
+	db := newTestDB()
+	db.AddQueryPattern("select \\* from vtocc_test where intval = 2 limit 10001( for update)?", &mysql.QueryResult{})
+	sessionId := startService(t, db)
+	defer stopService()
+
+	_, err := execute(sessionId, 0, "select * from vtocc_test where intval=2 for update", nil)
+	expectError(t, err, "error: Disallowed")
+
+	transactionId := begin(t, sessionId)
+	if _, err = execute(sessionId, transactionId, "select * from vtocc_test where intval=2 for update", nil); err != nil {
+		t.Errorf("select for update: %v", err)
+	}
+	commit(t, sessionId, transactionId)
+	if _, err = execute(sessionId, 0, "select * from vtocc_test where intval=2", nil); err != nil {
+		t.Errorf("select: %v", err)
+	}
+}
+
+func TestMaxResultSize(t *testing.T) {
+	db := newTestDB()
+	db.AddQuery("select * from vtocc_test limit 3", vtoccTestRows)
+	sessionId := startService(t, db)
+	defer stopService()
+
+	if _, err := execute(sessionId, 0, "set vt_max_result_size=2", nil); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	defer execute(sessionId, 0, "set vt_max_result_size=10000", nil)
+	_, err := execute(sessionId, 0, "select * from vtocc_test", nil)
+	expectError(t, err, "error: Row")
+}
+
+func TestServerRestart(t *testing.T) {
+	db := newTestDB()
+	sessionId := startService(t, db)
+	defer stopService()
+
+	if _, err := execute(sessionId, 0, "select * from vtocc_test", nil); err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	start := counts("Reconnects")
+	db.Restart()
+	// Reads are retried once on a new connection
+	if _, err := execute(sessionId, 0, "select * from vtocc_test", nil); err != nil {
+		t.Errorf("select after restart: %v", err)
+	}
+	end := counts("Reconnects")
+	if end["Query"] != start["Query"]+1 {
+		t.Errorf("Reconnects: want %v, got %v", start["Query"]+1, end["Query"])
+	}
+
+	// Transactions can't move to another connection
+	transactionId := begin(t, sessionId)
+	db.Restart()
+	_, err := execute(sessionId, transactionId, "select * from vtocc_test", nil)
+	expectError(t, err, "gone away")
+	// The transaction ended with its connection
+	var noOutput string
+	err = tabletserver.SqlQueryRpcService.Rollback(&tabletserver.Session{TransactionId: transactionId, SessionId: sessionId}, &noOutput)
+	expectError(t, err, "not found")
+}
+
+func TestSetTunable(t *testing.T) {
+	db := newTestDB()
+	sessionId := startService(t, db)
+
+	// Running values are compared, including those changed by SET
+	if _, err := execute(sessionId, 0, "set vt_max_result_size=2", nil); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	changed, skipped, err := tabletserver.SetTunable("vt_max_result_size", 10000)
+	if err != nil || len(changed) != 1 || len(skipped) != 0 {
+		t.Errorf("SetTunable: want [%s] [], got %v %v %v", testDbName, changed, skipped, err)
+	}
+	if changed, _, _ = tabletserver.SetTunable("vt_max_result_size", 10000); len(changed) != 0 {
+		t.Errorf("SetTunable: want no change, got %v", changed)
+	}
+	if _, _, err = tabletserver.SetTunable("vt_unknown", 1); err == nil {
+		t.Errorf("SetTunable: want error for unknown variable")
+	}
+
+	stopService()
+	changed, skipped, err = tabletserver.SetTunable("vt_max_result_size", 5000)
+	if err != nil || len(changed) != 0 || len(skipped) != 1 {
+		t.Errorf("SetTunable: want [] [%s], got %v %v %v", testDbName, changed, skipped, err)
+	}
+}
+
+func TestConnectErrors(t *testing.T) {
+	db := newTestDB()
+	sessionId := startService(t, db)
+	defer stopService()
+
+	// Only errors that may go away are worth a retry
+	db.Restart()
+	db.SetConnectError(mysql.NewSqlError(2002, "Can't connect to local MySQL server"))
+	_, err := execute(sessionId, 0, "select * from vtocc_test", nil)
+	expectError(t, err, "retry: Can't connect")
+	db.SetConnectError(mysql.NewSqlError(1045, "Access denied for user 'vt'"))
+	_, err = execute(sessionId, 0, "select * from vtocc_test", nil)
+	expectError(t, err, "fatal: Access denied")
+	db.SetConnectError(nil)
+	if _, err := execute(sessionId, 0, "select * from vtocc_test", nil); err != nil {
+		t.Errorf("select: %v", err)
+	}
+}
+
+func TestDisallowWhileRetrying(t *testing.T) {
+	db := newTestDB()
+	startService(t, db)
+	stopService()
+
+	// Shutting down during a MySQL outage must not hang
+	db.SetConnectError(mysql.NewSqlError(1045, "Access denied for user 'vt'"))
+	tabletserver.AllowQueries(testDbName, db.ConnectionCreator(), nil, tabletserver.NewLRURowCache, db.ConnectionCreator())
+	done := make(chan struct{})
+	go func() {
+		stopService()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("DisallowQueries hung while AllowQueries was being retried")
+	}
+}
+
+func TestStreamExecute(t *testing.T) {
+	db := newTestDB()
+	db.AddQuery("select * from vtocc_test", vtoccTestRows)
+	db.AddQuery("select * from vtocc_test where intval = 1", vtoccTestRows)
+	sessionId := startService(t, db)
+	defer stopService()
+
+	var replies []*tabletserver.QueryResult
+	query := &tabletserver.Query{Sql: "select * from vtocc_test", BindVariables: make(map[string]interface{}), SessionId: sessionId}
+	err := tabletserver.SqlQueryRpcService.StreamExecute(query, func(reply interface{}) error {
+		replies = append(replies, reply.(*tabletserver.QueryResult))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("stream: %v", err)
+	}
+	if len(replies) != 2 || len(replies[0].Fields) != 4 || len(replies[1].Rows) != 3 {
+		t.Errorf("replies: %v", replies)
+	}
+
+	// Streamed queries go to the slow query log too
+	buf := &bytes.Buffer{}
+	tabletserver.SlowQueryLogger = relog.New(buf, "", 0, relog.DEBUG)
+	defer func() { tabletserver.SlowQueryLogger = nil }()
+	tabletserver.SetTunable("vt_slow_query_sample_rate", 1)
+	defer tabletserver.SetTunable("vt_slow_query_sample_rate", 0)
+	query.Sql = "select * from vtocc_test where intval = 1"
+	tabletserver.SqlQueryRpcService.StreamExecute(query, func(reply interface{}) error {
+		return nil
+	})
+	if line := buf.String(); !strings.Contains(line, "\"select * from vtocc_test where intval = ?\"") {
+		t.Errorf("want the normalized query in %q", line)
+	}
+}
+
+func TestTableAclEntryPoints(t *testing.T) {
+	db := newTestDB()
+	startService(t, db)
+	defer stopService()
+
+	acl := tabletserver.NewTableAcl()
+	aclJson := `[
+		{"Table": "vtocc_b", "Readers": ["auditor"], "Admins": ["dba"]},
+		{"Table": "vtocc_*", "Admins": ["*"]}
+	]`
+	if err := json.Unmarshal([]byte(aclJson), acl); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	tabletserver.SetTableAcl(acl)
+	defer tabletserver.SetTableAcl(tabletserver.NewTableAcl())
+	app, _ := tabletserver.GetSessionId(testDbName, "app")
+	dba, _ := tabletserver.GetSessionId(testDbName, "dba")
+
+	// Every table of the statement is checked
+	for _, sql := range []string{
+		"select * from vtocc_a, vtocc_b",
+		"select * from vtocc_a join vtocc_b on vtocc_a.eid = vtocc_b.eid",
+		"select * from vtocc_a union select * from vtocc_b",
+		"select * from vtocc_a where eid in (select eid from vtocc_b)",
+		"insert into vtocc_a select * from vtocc_b",
+	} {
+		_, err := execute(app, 0, sql, nil)
+		expectError(t, err, "read access to vtocc_b denied")
+	}
+	query := &tabletserver.Query{Sql: "select * from vtocc_a, vtocc_b", BindVariables: make(map[string]interface{}), SessionId: app}
+	err := tabletserver.SqlQueryRpcService.StreamExecute(query, func(reply interface{}) error {
+		return nil
+	})
+	expectError(t, err, "read access to vtocc_b denied")
+
+	// vt_* settings need admin access to every table
+	_, err = execute(app, 0, "set vt_max_result_size=10000", nil)
+	expectError(t, err, "admin access to vt_max_result_size denied")
+	if _, err = execute(dba, 0, "set vt_max_result_size=10000", nil); err != nil {
+		t.Errorf("set: %v", err)
+	}
+}
+
+func TestQueryRulesEntryPoints(t *testing.T) {
+	db := newTestDB()
+	db.AddQuery("select * from vtocc_test", vtoccTestRows)
+	sessionId := startService(t, db)
+	defer stopService()
+	qrs := tabletserver.NewQueryRules()
+	if err := json.Unmarshal([]byte(`[{"Name": "no_vtocc_test", "TableNames": ["vtocc_test"]}]`), qrs); err != nil {
+		t.Fatalf("rules: %v", err)
+	}
+	tabletserver.SetQueryRules(qrs)
+	defer tabletserver.SetQueryRules(tabletserver.NewQueryRules())
+
+	_, err := execute(sessionId, 0, "select * from vtocc_test", nil)
+	expectError(t, err, "rule: no_vtocc_test")
+	query := &tabletserver.Query{Sql: "select * from vtocc_test", SessionId: sessionId}
+	err = tabletserver.SqlQueryRpcService.StreamExecute(query, func(reply interface{}) error {
+		t.Errorf("unexpected reply: %v", reply)
+		return nil
+	})
+	expectError(t, err, "rule: no_vtocc_test")
+	query = &tabletserver.Query{Sql: "alter table vtocc_test comment 'x'", SessionId: sessionId}
+	err = tabletserver.SqlQueryRpcService.ExecuteDDL(query, new(tabletserver.QueryResult))
+	expectError(t, err, "rule: no_vtocc_test")
+}
+
+// execCases are the rewrites checked by test_execution of
+// py/vttest/occ_test.py: every query must send log to MySQL.
+var execCases = []struct {
+	sql      string
+	bindVars map[string]interface{}
+	log      []string
+}{
+	{
+		"select /* union */ eid, id from vtocc_a union select eid, id from vtocc_b", nil,
+		[]string{"select /* union */ eid, id from vtocc_a union select eid, id from vtocc_b"},
+	},
+	{
+		"select /* distinct */ distinct * from vtocc_a", nil,
+		[]string{"select /* distinct */ distinct * from vtocc_a limit 10001"},
+	},
+	{
+		"select /* group by */ eid, sum(id) from vtocc_a group by eid", nil,
+		[]string{"select /* group by */ eid, sum(id) from vtocc_a group by eid limit 10001"},
+	},
+	{
+		"select /* limit */ eid, id from vtocc_a limit :a", map[string]interface{}{"a": 1},
+		[]string{"select /* limit */ eid, id from vtocc_a limit 1"},
+	},
+	{
+		"select /* multi-table */ a.eid, a.id, b.eid, b.id  from vtocc_a as a, vtocc_b as b", nil,
+		[]string{"select /* multi-table */ a.eid, a.id, b.eid, b.id from vtocc_a as a, vtocc_b as b limit 10001"},
+	},
+	{
+		"select /* table alias */ a.eid from vtocc_a as a where a.eid=1", nil,
+		[]string{"select /* table alias */ a.eid from vtocc_a as a where a.eid = 1 limit 10001"},
+	},
+	{
+		"select /* parenthesised col */ (eid) from vtocc_a where eid = 1 and id = 1", nil,
+		[]string{"select /* parenthesised col */ eid from vtocc_a where eid = 1 and id = 1 limit 10001"},
+	},
+	{
+		"select /* order */ * from vtocc_a order by id desc", nil,
+		[]string{"select /* order */ * from vtocc_a order by id desc limit 10001"},
+	},
+	{
+		"insert /* simple */ into vtocc_a values (2, 1, 'aaaa', 'bbbb')", nil,
+		[]string{"insert /* simple */ into vtocc_a values (2, 1, 'aaaa', 'bbbb')"},
+	},
+	{
+		"insert /* qualified */ into vtocc_a(eid, id, name, foo) values (3, 1, 'aaaa', 'cccc')", nil,
+		[]string{"insert /* qualified */ into vtocc_a(eid, id, name, foo) values (3, 1, 'aaaa', 'cccc') /* _stream vtocc_a (eid id ) (3 1 ); */"},
+	},
+	{
+		"insert /* bind values */ into vtocc_a(eid, id, name, foo) values (:eid, :id, :name, :foo)",
+		map[string]interface{}{"foo": "cccc", "eid": 4, "name": "aaaa", "id": 1},
+		[]string{"insert /* bind values */ into vtocc_a(eid, id, name, foo) values (4, 1, 'aaaa', 'cccc') /* _stream vtocc_a (eid id ) (4 1 ); */"},
+	},
+	{
+		"insert into vtocc_c(name, eid, foo) values (:name, '9', 'aaa')", map[string]interface{}{"name": "bbb"},
+		[]string{"insert into vtocc_c(name, eid, foo) values ('bbb', '9', 'aaa') /* _stream vtocc_c (eid name ) (9 'bbb' ); */"},
+	},
+	{
+		"insert into vtocc_a(eid, id, name, foo) values (7, 1+1, '', '')", nil,
+		[]string{"insert into vtocc_a(eid, id, name, foo) values (7, 1+1, '', '')"},
+	},
+	{
+		"insert into vtocc_d(eid, id) values (1, 1)", nil,
+		[]string{"insert into vtocc_d(eid, id) values (1, 1)"},
+	},
+	{
+		"insert into vtocc_a(eid, id, name, foo) values (8, 1, '', '') on duplicate key update id = 2", nil,
+		[]string{"insert into vtocc_a(eid, id, name, foo) values (8, 1, '', '') on duplicate key update id = 2 /* _stream vtocc_a (eid id ) (8 1 ) (8 2 ); */"},
+	},
+	{
+		"insert /* subquery */ into vtocc_a(eid, id, name, foo) select eid, foo, name, foo from vtocc_c", nil,
+		[]string{
+			"select eid, foo, name, foo from vtocc_c limit 10001",
+			"insert /* subquery */ into vtocc_a(eid, id, name, foo) values (10, 20, 'abcd', '20'), (11, 30, 'bcde', '30') /* _stream vtocc_a (eid id ) (10 20 ) (11 30 ); */",
+		},
+	},
+	{
+		"insert into vtocc_a(eid, id, name, foo) values (5, 1, '', ''), (7, 1, '', '')", nil,
+		[]string{"insert into vtocc_a(eid, id, name, foo) values (5, 1, '', ''), (7, 1, '', '') /* _stream vtocc_a (eid id ) (5 1 ) (7 1 ); */"},
+	},
+	{
+		"update /* pk */ vtocc_a set foo='bar' where eid = 1 and id = 1", nil,
+		[]string{"update /* pk */ vtocc_a set foo = 'bar' where eid = 1 and id = 1 /* _stream vtocc_a (eid id ) (1 1 ); */"},
+	},
+	{
+		"update /* pk */ vtocc_a set foo='bar' where eid = 1 and id in (1, 2)", nil,
+		[]string{"update /* pk */ vtocc_a set foo = 'bar' where eid = 1 and id in (1, 2) /* _stream vtocc_a (eid id ) (1 1 ) (1 2 ); */"},
+	},
+	{
+		"update /* pk */ vtocc_a set foo='bar' where eid in (1) and id in (1, 2)", nil,
+		[]string{
+			"select eid, id from vtocc_a where eid in (1) and id in (1, 2) limit 10001 for update",
+			"update /* pk */ vtocc_a set foo = 'bar' where (eid = 1 and id = 1) or (eid = 1 and id = 2) /* _stream vtocc_a (eid id ) (1 1 ) (1 2 ); */",
+		},
+	},
+	{
+		"update vtocc_a set eid = 2 where eid = 1 and id = 1", nil,
+		[]string{"update vtocc_a set eid = 2 where eid = 1 and id = 1 /* _stream vtocc_a (eid id ) (1 1 ) (2 1 ); */"},
+	},
+	{
+		"update vtocc_a set eid = 1+1 where eid = 1 and id = 1", nil,
+		[]string{"update vtocc_a set eid = 1+1 where eid = 1 and id = 1"},
+	},
+	{
+		"update /* pk */ vtocc_a set foo='bar' where id = 1", nil,
+		[]string{
+			"select eid, id from vtocc_a where id = 1 limit 10001 for update",
+			"update /* pk */ vtocc_a set foo = 'bar' where (eid = 1 and id = 1) /* _stream vtocc_a (eid id ) (1 1 ); */",
+		},
+	},
+	{
+		"update vtocc_a set foo='bar'", nil,
+		[]string{
+			"select eid, id from vtocc_a limit 10001 for update",
+			"update vtocc_a set foo = 'bar' where (eid = 1 and id = 1) or (eid = 1 and id = 2) /* _stream vtocc_a (eid id ) (1 1 ) (1 2 ); */",
+		},
+	},
+	{
+		"update vtocc_d set id = 2 where eid = 1", nil,
+		[]string{"update vtocc_d set id = 2 where eid = 1"},
+	},
+	{
+		"delete /* pk */ from vtocc_a where eid = 2 and id = 1", nil,
+		[]string{"delete /* pk */ from vtocc_a where eid = 2 and id = 1 /* _stream vtocc_a (eid id ) (2 1 ); */"},
+	},
+	{
+		"delete /* pk */ from vtocc_a where (eid, id) in ((2, 1), (3, 2))", nil,
+		[]string{"delete /* pk */ from vtocc_a where (eid, id) in ((2, 1), (3, 2)) /* _stream vtocc_a (eid id ) (2 1 ) (3 2 ); */"},
+	},
+	{
+		"delete from vtocc_a where eid = 1+1 and id = 1", nil,
+		[]string{
+			"select eid, id from vtocc_a where eid = 1+1 and id = 1 limit 10001 for update",
+			"delete from vtocc_a where (eid = 2 and id = 1) /* _stream vtocc_a (eid id ) (2 1 ); */",
+		},
+	},
+	{
+		"delete from vtocc_test where intval > 3", nil,
+		[]string{
+			"select intval from vtocc_test where intval > 3 limit 10001 for update",
+			"delete from vtocc_test where intval in (4, 5) /* _stream vtocc_test (intval ) (4 ) (5 ); */",
+		},
+	},
+	{
+		"delete from vtocc_d where eid =1 and id =1", nil,
+		[]string{"delete from vtocc_d where eid = 1 and id = 1"},
+	},
+}
+
+func TestExecution(t *testing.T) {
+	db := newTestDB()
+	pks := func(rows ...[]interface{}) *mysql.QueryResult {
+		return &mysql.QueryResult{Fields: []mysql.Field{{Name: "eid", Type: 8}, {Name: "id", Type: 3}}, RowsAffected: uint64(len(rows)), Rows: rows}
+	}
+	db.AddQuery("select eid, foo, name, foo from vtocc_c limit 10001", &mysql.QueryResult{
+		Fields:       []mysql.Field{{Name: "eid", Type: 8}, {Name: "foo", Type: 253}, {Name: "name", Type: 253}, {Name: "foo", Type: 253}},
+		RowsAffected: 2,
+		Rows:         [][]interface{}{{"10", "20", "abcd", "20"}, {"11", "30", "bcde", "30"}},
+	})
+	db.AddQuery("select eid, id from vtocc_a where eid in (1) and id in (1, 2) limit 10001 for update", pks([]interface{}{"1", "1"}, []interface{}{"1", "2"}))
+	db.AddQuery("select eid, id from vtocc_a where id = 1 limit 10001 for update", pks([]interface{}{"1", "1"}))
+	db.AddQuery("select eid, id from vtocc_a limit 10001 for update", pks([]interface{}{"1", "1"}, []interface{}{"1", "2"}))
+	db.AddQuery("select eid, id from vtocc_a where eid = 1+1 and id = 1 limit 10001 for update", pks([]interface{}{"2", "1"}))
+	db.AddQuery("select intval from vtocc_test where intval > 3 limit 10001 for update", &mysql.QueryResult{
+		Fields:       []mysql.Field{{Name: "intval", Type: 3}},
+		RowsAffected: 2,
+		Rows:         [][]interface{}{{"4"}, {"5"}},
+	})
+	db.AddQueryPattern("(select|insert|update|delete) .*", &mysql.QueryResult{})
+	sessionId := startService(t, db)
+	defer stopService()
+
+	for _, tcase := range execCases {
+		transactionId := begin(t, sessionId)
+		db.ResetQueryLog()
+		if _, err := execute(sessionId, transactionId, tcase.sql, tcase.bindVars); err != nil {
+			t.Errorf("%s: %v", tcase.sql, err)
+		}
+		if log := db.QueryLog(); !reflect.DeepEqual(log, tcase.log) {
+			t.Errorf("%s:\n%q\nwant:\n%q", tcase.sql, log, tcase.log)
+		}
+		rollback(t, sessionId, transactionId)
+	}
+}
+
+func TestUniqueIndexCache(t *testing.T) {
+	db := newTestDB()
+	db.AddTable(&fakemysql.Table{
+		Name:    "vtocc_users",
+		Columns: []fakemysql.Column{{Name: "id", Type: "bigint(20)"}, {Name: "email", Type: "varchar(64)"}},
+		Indexes: []fakemysql.Index{
+			{Name: "PRIMARY", Unique: true, Columns: []string{"id"}},
+			{Name: "users_email", Unique: true, Columns: []string{"email"}},
+		},
+	})
+	subquery := "select id from vtocc_users where email = 'a@x' limit 10001"
+	db.AddQuery(subquery, &mysql.QueryResult{Fields: []mysql.Field{{Name: "id", Type: 8}}, RowsAffected: 1, Rows: [][]interface{}{{"1"}}})
+	db.AddQuery("select * from vtocc_users where id in (1)", &mysql.QueryResult{
+		Fields:       []mysql.Field{{Name: "id", Type: 8}, {Name: "email", Type: 253}},
+		RowsAffected: 1,
+		Rows:         [][]interface{}{{"1", "a@x"}},
+	})
+	db.AddQueryPattern("update vtocc_users .*", &mysql.QueryResult{RowsAffected: 1})
+	sessionId := startCachedService(t, db, map[string]uint64{"vtocc_users": 100}, 100)
+	defer stopService()
+
+	lookup := "select email from vtocc_users where email = 'a@x'"
+	for i := 0; i < 2; i++ {
+		db.ResetQueryLog()
+		qr, err := execute(sessionId, 0, lookup, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", lookup, err)
+		}
+		if len(qr.Rows) != 1 || qr.Rows[0][0] != "a@x" {
+			t.Errorf("want [[a@x]], got %v", qr.Rows)
+		}
+	}
+	if log := db.QueryLog(); len(log) != 0 {
+		t.Errorf("want the second lookup served by the cache, got %q", log)
+	}
+
+	transactionId := begin(t, sessionId)
+	if _, err := execute(sessionId, transactionId, "update vtocc_users set email = 'b@x' where id = 1", nil); err != nil {
+		rollback(t, sessionId, transactionId)
+		t.Fatalf("update: %v", err)
+	}
+	commit(t, sessionId, transactionId)
+	db.DeleteQuery(subquery)
+	db.AddQuery(subquery, &mysql.QueryResult{Fields: []mysql.Field{{Name: "id", Type: 8}}})
+	db.ResetQueryLog()
+	qr, err := execute(sessionId, 0, lookup, nil)
+	if err != nil {
+		t.Fatalf("%s: %v", lookup, err)
+	}
+	if len(qr.Rows) != 0 {
+		t.Errorf("want no rows after the update, got %v", qr.Rows)
+	}
+	if log := db.QueryLog(); !reflect.DeepEqual(log, []string{subquery}) {
+		t.Errorf("want %q, got %q", subquery, log)
+	}
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tabletserver
+
+import (
+	"code.google.com/p/vitess/go/streamlog"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SqlQueryLogger receives a SqlQueryStats for every query
+// executed by SqlQuery.Execute.
+var SqlQueryLogger = streamlog.New("SqlQuery", 50)
+
+func init() {
+	http.Handle("/debug/querylog", SqlQueryLogger)
+}
+
+// SqlQueryStats is the query log record of one query.
+type SqlQueryStats struct {
+	StartTime     time.Time
+	EndTime       time.Time
+	SessionId     int64
+	TransactionId int64
+	ConnectionId  int64
+	PlanType      string
+	TableName     string
+	OriginalSql   string
+	BindVariables map[string]interface{}
+	RewrittenSql  []string
+	RowsAffected  uint64
+	CacheHits     int
+	CacheMisses   int
+	MysqlTime     time.Duration
+	WaitTime      time.Duration
+	Error         string
+}
+
+func newSqlQueryStats(query *Query, plan *CompiledPlan, start time.Time, rowsAffected uint64, err interface{}) *SqlQueryStats {
+	stats := &SqlQueryStats{
+		StartTime:     start,
+		EndTime:       time.Now(),
+		SessionId:     query.SessionId,
+		TransactionId: query.TransactionId,
+		ConnectionId:  query.ConnectionId,
+		OriginalSql:   query.Sql,
+		BindVariables: query.BindVariables,
+		RowsAffected:  rowsAffected,
+	}
+	if plan != nil {
+		stats.PlanType = plan.PlanId.String()
+		stats.TableName = plan.TableName
+		stats.RewrittenSql = plan.rewrittenSqls
+		stats.CacheHits = plan.cacheHits
+		stats.CacheMisses = plan.cacheMisses
+		stats.MysqlTime = plan.MysqlTime
+		stats.WaitTime = plan.WaitTime
+	}
+	if err != nil {
+		stats.Error = fmt.Sprintf("%v", err)
+	}
+	return stats
+}
+
+func (self *SqlQueryStats) TotalTime() time.Duration {
+	return self.EndTime.Sub(self.StartTime)
+}
+
+// userBindVariables returns the bind variables without
+// the ones added by the query service.
+func (self *SqlQueryStats) userBindVariables() map[string]interface{} {
+	bindVars := make(map[string]interface{}, len(self.BindVariables))
+	for k, v := range self.BindVariables {
+		if k == MAX_RESULT_NAME || k == TRAILING_COMMENT {
+			continue
+		}
+		bindVars[k] = v
+	}
+	return bindVars
+}
+
+// matches returns true if the record passes the filters of params:
+// table and plan, which can be repeated, and min_duration in seconds.
+func (self *SqlQueryStats) matches(params url.Values) bool {
+	if tables, ok := params["table"]; ok && !stringIn(self.TableName, tables) {
+		return false
+	}
+	if plans, ok := params["plan"]; ok && !stringIn(self.PlanType, plans) {
+		return false
+	}
+	if minDuration := params.Get("min_duration"); minDuration != "" {
+		seconds, err := strconv.ParseFloat(minDuration, 64)
+		if err == nil && self.TotalTime().Seconds() < seconds {
+			return false
+		}
+	}
+	return true
+}
+
+func stringIn(s string, list []string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Format returns the record as a tab separated line: start, end,
+// duration, session id, transaction id, connection id, plan, table,
+// sql, bind variables, rewritten sqls, rows, cache hits, cache misses,
+// mysql time, wait time and error. With format=json, it returns
+// a JSON object instead. Records that don't match the filters
+// of params are skipped.
+func (self *SqlQueryStats) Format(params url.Values) string {
+	if !self.matches(params) {
+		return ""
+	}
+	if params.Get("format") == "json" {
+		data, err := json.Marshal(map[string]interface{}{
+			"StartTime":     self.StartTime,
+			"EndTime":       self.EndTime,
+			"TotalTime":     self.TotalTime().Seconds(),
+			"SessionId":     self.SessionId,
+			"TransactionId": self.TransactionId,
+			"ConnectionId":  self.ConnectionId,
+			"PlanType":      self.PlanType,
+			"TableName":     self.TableName,
+			"OriginalSql":   self.OriginalSql,
+			"BindVariables": self.userBindVariables(),
+			"RewrittenSql":  self.RewrittenSql,
+			"RowsAffected":  self.RowsAffected,
+			"CacheHits":     self.CacheHits,
+			"CacheMisses":   self.CacheMisses,
+			"MysqlTime":     self.MysqlTime.Seconds(),
+			"WaitTime":      self.WaitTime.Seconds(),
+			"Error":         self.Error,
+		})
+		if err != nil {
+			return ""
+		}
+		return string(data) + "\n"
+	}
+	return fmt.Sprintf(
+		"%v\t%v\t%.6f\t%v\t%v\t%v\t%v\t%v\t%q\t%v\t%q\t%v\t%v\t%v\t%.6f\t%.6f\t%q\n",
+		self.StartTime.Format(time.StampMicro),
+		self.EndTime.Format(time.StampMicro),
+		self.TotalTime().Seconds(),
+		self.SessionId,
+		self.TransactionId,
+		self.ConnectionId,
+		self.PlanType,
+		self.TableName,
+		self.OriginalSql,
+		self.userBindVariables(),
+		strings.Join(self.RewrittenSql, ";"),
+		self.RowsAffected,
+		self.CacheHits,
+		self.CacheMisses,
+		self.MysqlTime.Seconds(),
+		self.WaitTime.Seconds(),
+		self.Error,
+	)
+}
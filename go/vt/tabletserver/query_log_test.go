@@ -0,0 +1,90 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tabletserver
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSqlQueryStatsFormat(t *testing.T) {
+	start := time.Now()
+	stats := &SqlQueryStats{
+		StartTime:     start,
+		EndTime:       start.Add(20 * time.Millisecond),
+		PlanType:      "SELECT_PK",
+		TableName:     "a",
+		OriginalSql:   "select * from a where id = :id",
+		BindVariables: map[string]interface{}{"id": 1, MAX_RESULT_NAME: 10001},
+		RewrittenSql:  []string{"select * from a where id in (1)"},
+		RowsAffected:  1,
+	}
+	cases := []struct {
+		query string
+		match bool
+	}{
+		{"", true},
+		{"table=a", true},
+		{"table=b&table=a", true},
+		{"table=b", false},
+		{"plan=SELECT_PK", true},
+		{"plan=PASS_SELECT", false},
+		{"min_duration=0.01", true},
+		{"min_duration=0.1", false},
+		{"table=a&plan=PASS_SELECT", false},
+	}
+	for _, c := range cases {
+		params, _ := url.ParseQuery(c.query)
+		if got := stats.Format(params) != ""; got != c.match {
+			t.Errorf("%q: want match %v, got %v", c.query, c.match, got)
+		}
+	}
+
+	line := stats.Format(url.Values{})
+	if fields := strings.Split(line, "\t"); len(fields) != 17 {
+		t.Errorf("want 17 fields, got %d: %s", len(fields), line)
+	}
+	if strings.Contains(line, MAX_RESULT_NAME) {
+		t.Errorf("internal bind variable in %s", line)
+	}
+
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(stats.Format(url.Values{"format": {"json"}})), &record); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if record["TableName"] != "a" || record["RowsAffected"] != float64(1) {
+		t.Errorf("unexpected record %v", record)
+	}
+}
@@ -0,0 +1,445 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tabletserver
+
+import (
+	"code.google.com/p/vitess/go/vt/sqlparser"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sync"
+)
+
+//-----------------------------------------------
+// QueryRuleInfo holds the current set of query rules.
+// The rules can be replaced at any time while queries are being served.
+type QueryRuleInfo struct {
+	mu         sync.Mutex
+	queryRules *QueryRules
+}
+
+func NewQueryRuleInfo(name string) *QueryRuleInfo {
+	self := &QueryRuleInfo{queryRules: NewQueryRules()}
+	http.Handle(debugPath(name, "query_rules"), self)
+	return self
+}
+
+func (self *QueryRuleInfo) SetRules(qrs *QueryRules) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.queryRules = qrs
+}
+
+// GetRules returns the current rules. QueryRules are never modified
+// once set, so the returned value can be used without locking.
+func (self *QueryRuleInfo) GetRules() *QueryRules {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.queryRules
+}
+
+// ServeHTTP shows the current rules. They can only be changed
+// through the authenticated SetQueryRules RPC.
+func (self *QueryRuleInfo) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		http.Error(response, "query rules are read-only", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := json.MarshalIndent(self.GetRules(), "", "  ")
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response.Header().Set("Content-Type", "text/plain")
+	response.Write(data)
+	response.Write([]byte("\n"))
+}
+
+//-----------------------------------------------
+// QueryRules is an ordered list of rules. The first rule
+// that matches a query decides what happens to it.
+type QueryRules struct {
+	rules []*QueryRule
+}
+
+func NewQueryRules() *QueryRules {
+	return &QueryRules{}
+}
+
+func (self *QueryRules) Add(qr *QueryRule) error {
+	if err := qr.compile(); err != nil {
+		return err
+	}
+	self.rules = append(self.rules, qr)
+	return nil
+}
+
+func (self *QueryRules) MarshalJSON() ([]byte, error) {
+	if self.rules == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(self.rules)
+}
+
+func (self *QueryRules) UnmarshalJSON(data []byte) (err error) {
+	var rules []*QueryRule
+	if err = json.Unmarshal(data, &rules); err != nil {
+		return err
+	}
+	for _, qr := range rules {
+		if err = qr.compile(); err != nil {
+			return err
+		}
+	}
+	self.rules = rules
+	return nil
+}
+
+// getAction returns the first rule that matches the query, or nil.
+func (self *QueryRules) getAction(sql string, bindVars map[string]interface{}, plan *sqlparser.ExecPlan) *QueryRule {
+	for _, qr := range self.rules {
+		if qr.matches(sql, bindVars, plan) {
+			return qr
+		}
+	}
+	return nil
+}
+
+//-----------------------------------------------
+// QueryRule matches a query if all its conditions are satisfied.
+// Empty conditions match everything.
+// Query is a regular expression that must match the entire sql.
+// Plans, Reasons and TableNames are lists of acceptable values.
+// Plans and Reasons use the names of sqlparser.PlanType and
+// sqlparser.ReasonType, without the PLAN_ & REASON_ prefixes.
+// Action is the type of error returned for a matching query:
+// FAIL (default), RETRY or FATAL.
+type QueryRule struct {
+	Name         string
+	Description  string
+	Query        string
+	Plans        []string
+	Reasons      []string
+	TableNames   []string
+	BindVarConds []*BindVarCond
+	Action       string
+
+	query     *regexp.Regexp
+	plans     []sqlparser.PlanType
+	reasons   []sqlparser.ReasonType
+	errorType int
+}
+
+func (self *QueryRule) compile() (err error) {
+	if self.Name == "" {
+		return fmt.Errorf("Query rule has no name")
+	}
+	if self.Query != "" {
+		if self.query, err = regexp.Compile("^(?:" + self.Query + ")$"); err != nil {
+			return fmt.Errorf("Query rule %s: %v", self.Name, err)
+		}
+	}
+	self.plans = nil
+	for _, name := range self.Plans {
+		pt, ok := sqlparser.PlanByName(name)
+		if !ok {
+			return fmt.Errorf("Query rule %s: invalid plan %s", self.Name, name)
+		}
+		self.plans = append(self.plans, pt)
+	}
+	self.reasons = nil
+	for _, name := range self.Reasons {
+		rt, ok := sqlparser.ReasonByName(name)
+		if !ok {
+			return fmt.Errorf("Query rule %s: invalid reason %s", self.Name, name)
+		}
+		self.reasons = append(self.reasons, rt)
+	}
+	for _, bvc := range self.BindVarConds {
+		if err = bvc.compile(); err != nil {
+			return fmt.Errorf("Query rule %s: %v", self.Name, err)
+		}
+	}
+	switch self.Action {
+	case "", "FAIL":
+		self.errorType = FAIL
+	case "RETRY":
+		self.errorType = RETRY
+	case "FATAL":
+		self.errorType = FATAL
+	default:
+		return fmt.Errorf("Query rule %s: invalid action %s", self.Name, self.Action)
+	}
+	return nil
+}
+
+func (self *QueryRule) matches(sql string, bindVars map[string]interface{}, plan *sqlparser.ExecPlan) bool {
+	if self.query != nil && !self.query.MatchString(sql) {
+		return false
+	}
+	if self.plans != nil && !planMatches(plan.PlanId, self.plans) {
+		return false
+	}
+	if self.reasons != nil && !reasonMatches(plan.Reason, self.reasons) {
+		return false
+	}
+	if self.TableNames != nil && !tableMatches(plan.TableName, self.TableNames) {
+		return false
+	}
+	for _, bvc := range self.BindVarConds {
+		if !bvc.matches(bindVars) {
+			return false
+		}
+	}
+	return true
+}
+
+func planMatches(planId sqlparser.PlanType, plans []sqlparser.PlanType) bool {
+	for _, pt := range plans {
+		if pt == planId {
+			return true
+		}
+	}
+	return false
+}
+
+func reasonMatches(reason sqlparser.ReasonType, reasons []sqlparser.ReasonType) bool {
+	for _, rt := range reasons {
+		if rt == reason {
+			return true
+		}
+	}
+	return false
+}
+
+func tableMatches(tableName string, tableNames []string) bool {
+	for _, name := range tableNames {
+		if name == tableName {
+			return true
+		}
+	}
+	return false
+}
+
+//-----------------------------------------------
+// BindVarCond compares the bind variable Name against Value.
+// Operator is one of ==, !=, <, >=, >, <=, MATCH or NOMATCH.
+// The comparison operators accept integer or string values.
+// MATCH and NOMATCH accept a regular expression that must match
+// the entire value of the bind variable.
+// OnAbsent is the outcome if the bind variable is not supplied, and
+// OnMismatch is the outcome if it cannot be compared against Value.
+type BindVarCond struct {
+	Name       string
+	OnAbsent   bool
+	OnMismatch bool
+	Operator   string
+	Value      interface{}
+
+	op    int
+	value interface{} // int64, uint64, string or *regexp.Regexp
+}
+
+const (
+	QR_EQ = iota
+	QR_NE
+	QR_LT
+	QR_GE
+	QR_GT
+	QR_LE
+	QR_MATCH
+	QR_NOMATCH
+)
+
+var opCodes = map[string]int{
+	"==":      QR_EQ,
+	"!=":      QR_NE,
+	"<":       QR_LT,
+	">=":      QR_GE,
+	">":       QR_GT,
+	"<=":      QR_LE,
+	"MATCH":   QR_MATCH,
+	"NOMATCH": QR_NOMATCH,
+}
+
+func (self *BindVarCond) compile() (err error) {
+	var ok bool
+	if self.op, ok = opCodes[self.Operator]; !ok {
+		return fmt.Errorf("invalid operator %s for bind var %s", self.Operator, self.Name)
+	}
+	if self.op == QR_MATCH || self.op == QR_NOMATCH {
+		s, ok := self.Value.(string)
+		if !ok {
+			return fmt.Errorf("expecting string for bind var %s: %v", self.Name, self.Value)
+		}
+		if self.value, err = regexp.Compile("^(?:" + s + ")$"); err != nil {
+			return fmt.Errorf("bind var %s: %v", self.Name, err)
+		}
+		return nil
+	}
+	switch v := self.Value.(type) {
+	case string:
+		self.value = v
+	case float64:
+		if self.value, ok = bindVarNumber(v); !ok {
+			return fmt.Errorf("expecting integer for bind var %s: %v", self.Name, v)
+		}
+	default:
+		return fmt.Errorf("unexpected value for bind var %s: %v", self.Name, self.Value)
+	}
+	return nil
+}
+
+func (self *BindVarCond) matches(bindVars map[string]interface{}) bool {
+	bv, ok := bindVars[self.Name]
+	if !ok {
+		return self.OnAbsent
+	}
+	if self.op == QR_MATCH || self.op == QR_NOMATCH {
+		s, ok := bindVarString(bv)
+		if !ok {
+			return self.OnMismatch
+		}
+		return self.value.(*regexp.Regexp).MatchString(s) == (self.op == QR_MATCH)
+	}
+	var cmp int
+	switch value := self.value.(type) {
+	case string:
+		s, ok := bindVarString(bv)
+		if !ok {
+			return self.OnMismatch
+		}
+		switch {
+		case s < value:
+			cmp = -1
+		case s > value:
+			cmp = 1
+		}
+	default:
+		num, ok := bindVarNumber(bv)
+		if !ok {
+			return self.OnMismatch
+		}
+		cmp = compareNumbers(num, value)
+	}
+	switch self.op {
+	case QR_EQ:
+		return cmp == 0
+	case QR_NE:
+		return cmp != 0
+	case QR_LT:
+		return cmp < 0
+	case QR_GE:
+		return cmp >= 0
+	case QR_GT:
+		return cmp > 0
+	case QR_LE:
+		return cmp <= 0
+	}
+	panic("unreachable")
+}
+
+func bindVarString(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	}
+	return "", false
+}
+
+// bindVarNumber converts v to an int64, or to a uint64
+// if the value is beyond the range of int64.
+func bindVarNumber(v interface{}) (interface{}, bool) {
+	switch v := v.(type) {
+	case int:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint:
+		return normalizeUint(uint64(v)), true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		return normalizeUint(v), true
+	case float64:
+		// JSON clients send all numbers as float64
+		if v >= math.MinInt64 && v < math.MaxInt64 && float64(int64(v)) == v {
+			return int64(v), true
+		}
+		if v > 0 && v < math.MaxUint64 && float64(uint64(v)) == v {
+			return uint64(v), true
+		}
+	}
+	return nil, false
+}
+
+func normalizeUint(v uint64) interface{} {
+	if v > math.MaxInt64 {
+		return v
+	}
+	return int64(v)
+}
+
+// compareNumbers compares values returned by bindVarNumber.
+func compareNumbers(a, b interface{}) int {
+	ai, aSigned := a.(int64)
+	bi, bSigned := b.(int64)
+	switch {
+	case aSigned && bSigned:
+		switch {
+		case ai < bi:
+			return -1
+		case ai > bi:
+			return 1
+		}
+		return 0
+	case aSigned:
+		// b is a uint64 beyond the range of int64
+		return -1
+	case bSigned:
+		return 1
+	}
+	au, bu := a.(uint64), b.(uint64)
+	switch {
+	case au < bu:
+		return -1
+	case au > bu:
+		return 1
+	}
+	return 0
+}
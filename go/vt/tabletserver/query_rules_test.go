@@ -0,0 +1,108 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tabletserver
+
+import (
+	"code.google.com/p/vitess/go/vt/sqlparser"
+	"encoding/json"
+	"testing"
+)
+
+var testRules = `[{
+	"Name": "r1",
+	"Query": "select .* from a.*",
+	"Plans": ["PASS_SELECT", "SELECT_PK"],
+	"TableNames": ["a"],
+	"BindVarConds": [{"Name": "id", "Operator": ">=", "Value": 10}],
+	"Action": "RETRY"
+}, {
+	"Name": "r2",
+	"Reasons": ["TABLE_NOINDEX"]
+}, {
+	"Name": "r3",
+	"BindVarConds": [
+		{"Name": "name", "Operator": "MATCH", "Value": "bad.*", "OnMismatch": true},
+		{"Name": "other", "Operator": "==", "Value": "x", "OnAbsent": true}
+	]
+}]`
+
+func TestQueryRules(t *testing.T) {
+	qrs := NewQueryRules()
+	if err := json.Unmarshal([]byte(testRules), qrs); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	plan := &sqlparser.ExecPlan{PlanId: sqlparser.PLAN_SELECT_PK, TableName: "a"}
+	sql := "select * from a where id = :id"
+
+	qr := qrs.getAction(sql, map[string]interface{}{"id": int64(12)}, plan)
+	assertTrue(qr != nil && qr.Name == "r1" && qr.errorType == RETRY, "r1 should match", t)
+	qr = qrs.getAction(sql, map[string]interface{}{"id": float64(12)}, plan)
+	assertTrue(qr != nil && qr.Name == "r1", "r1 should match float", t)
+	qr = qrs.getAction(sql, map[string]interface{}{"id": uint64(1 << 63)}, plan)
+	assertTrue(qr != nil && qr.Name == "r1", "r1 should match uint64", t)
+	qr = qrs.getAction(sql, map[string]interface{}{"id": int64(9)}, plan)
+	assertTrue(qr == nil, "r1 should not match smaller id", t)
+	qr = qrs.getAction(sql, map[string]interface{}{"id": "12"}, plan)
+	assertTrue(qr == nil, "r1 should not match string", t)
+
+	plan.Reason = sqlparser.REASON_TABLE_NOINDEX
+	qr = qrs.getAction(sql, map[string]interface{}{}, plan)
+	assertTrue(qr != nil && qr.Name == "r2" && qr.errorType == FAIL, "r2 should match", t)
+
+	plan.Reason = sqlparser.REASON_DEFAULT
+	qr = qrs.getAction(sql, map[string]interface{}{"name": "badname"}, plan)
+	assertTrue(qr != nil && qr.Name == "r3", "r3 should match", t)
+	qr = qrs.getAction(sql, map[string]interface{}{"name": 1}, plan)
+	assertTrue(qr != nil && qr.Name == "r3", "r3 should match on mismatch", t)
+	qr = qrs.getAction(sql, map[string]interface{}{"name": "goodname"}, plan)
+	assertTrue(qr == nil, "r3 should not match", t)
+	qr = qrs.getAction(sql, map[string]interface{}{"name": "badname", "other": "y"}, plan)
+	assertTrue(qr == nil, "r3 should not match other", t)
+}
+
+func TestQueryRulesErrors(t *testing.T) {
+	invalid := []string{
+		`[{"Description": "no name"}]`,
+		`[{"Name": "r", "Query": "("}]`,
+		`[{"Name": "r", "Plans": ["NO_PLAN"]}]`,
+		`[{"Name": "r", "Reasons": ["NO_REASON"]}]`,
+		`[{"Name": "r", "Action": "IGNORE"}]`,
+		`[{"Name": "r", "BindVarConds": [{"Name": "a", "Operator": "~", "Value": 1}]}]`,
+		`[{"Name": "r", "BindVarConds": [{"Name": "a", "Operator": "==", "Value": 1.5}]}]`,
+		`[{"Name": "r", "BindVarConds": [{"Name": "a", "Operator": "MATCH", "Value": 1}]}]`,
+	}
+	for _, rules := range invalid {
+		if err := json.Unmarshal([]byte(rules), NewQueryRules()); err == nil {
+			t.Errorf("expecting error for %s", rules)
+		}
+	}
+}
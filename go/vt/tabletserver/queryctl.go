@@ -33,53 +33,170 @@ package tabletserver
 
 import (
 	"code.google.com/p/vitess/go/relog"
-	"net/rpc"
+	"code.google.com/p/vitess/go/rpcplus"
+	"time"
 )
 
-var SqlQueryRpcService *SqlQuery
+// SqlQueryRpcService serves the SqlQuery RPC API for all the
+// query services of the process.
+var SqlQueryRpcService *SqlQueryRouter
 
-func StartQueryService(poolSize, transactionCap int, transactionTimeout float64, maxResultSize, queryCacheSize int, schemaReloadTime, queryTimeout, idleTimeout float64) {
-	if SqlQueryRpcService != nil {
-		relog.Warning("RPC service already up %v", SqlQueryRpcService)
+// Config contains the settings of a query service.
+// Times are in seconds.
+type Config struct {
+	PoolSize            int
+	TransactionCap      int
+	ReservedCap         int
+	TransactionTimeout  float64
+	MaxResultSize       int
+	StreamBufferSize    int
+	DMLBatchSize        int
+	ResultBudget        int // In bytes, 0 for no budget
+	QueryCacheSize      int
+	SchemaReloadTime    float64
+	QueryTimeout        float64 // 0 for no timeout
+	IdleTimeout         float64
+	ReservedIdleTimeout float64
+	SlowQueryThreshold  float64
+	SlowQuerySampleRate float64
+}
+
+// StartQueryService creates the query service of dbname. The first
+// one keeps the plain debug pages and variables, the others get theirs
+// under their dbname.
+func StartQueryService(dbname string, config Config) {
+	name := dbname
+	if SqlQueryRpcService == nil {
+		SqlQueryRpcService = NewSqlQueryRouter()
+		rpcplus.RegisterName("SqlQuery", SqlQueryRpcService)
+		name = ""
+	}
+	if sqlQuery := SqlQueryRpcService.get(dbname); sqlQuery != nil {
+		relog.Warning("RPC service already up for %s: %v", dbname, sqlQuery)
 		return
 	}
-	SqlQueryRpcService = NewSqlQuery(poolSize, transactionCap, transactionTimeout, maxResultSize, queryCacheSize, schemaReloadTime, queryTimeout, idleTimeout)
-	rpc.Register(SqlQueryRpcService)
+	SqlQueryRpcService.add(dbname, NewSqlQuery(name, config))
+}
+
+// getQueryService panics if there's no query service for dbname.
+func getQueryService(dbname string) *SqlQuery {
+	sqlQuery := SqlQueryRpcService.get(dbname)
+	if sqlQuery == nil {
+		panic(NewTabletError(FAIL, "No query service for %s", dbname))
+	}
+	return sqlQuery
 }
 
-func AllowQueries(ConnFactory CreateConnectionFunc, cachingInfo map[string]uint64) {
+// SuperConnFactory is used by ExecuteDDL. DDLs are rejected if it's nil.
+func AllowQueries(dbname string, ConnFactory CreateConnectionFunc, cachingInfo map[string]uint64, RowCacheFactory CreateRowCacheFunc, SuperConnFactory CreateConnectionFunc) {
 	defer logError()
-	SqlQueryRpcService.allowQueries(ConnFactory, cachingInfo)
+	getQueryService(dbname).allowQueries(ConnFactory, cachingInfo, RowCacheFactory, SuperConnFactory)
+}
+
+// SetEventSource makes the query service invalidate the row cache
+// using the statements of the event source while queries are allowed.
+func SetEventSource(dbname string, sourceFactory CreateEventSourceFunc, positionFile string) {
+	getQueryService(dbname).invalidator.SetEventSource(sourceFactory, positionFile)
 }
 
+// SetCacheWarming sets the tables whose row cache is preloaded
+// every time queries are allowed.
+func SetCacheWarming(dbname string, specs map[string]WarmSpec, rowsPerSecond int) {
+	getQueryService(dbname).cacheWarmer.SetSpecs(specs, rowsPerSecond)
+}
+
+// SetCacheVerification sets how often sampleSize cached rows of every
+// table are compared with MySQL. An interval of 0 disables verification.
+func SetCacheVerification(dbname string, interval float64, sampleSize int, evict bool) {
+	getQueryService(dbname).cacheVerifier.SetParams(time.Duration(interval*1e9), sampleSize, evict)
+}
+
+// SetIndexCacheSize sets the number of entries of the caches of the
+// unique indexes of row cached tables. 0 disables them. It's applied
+// the next time queries are allowed.
+func SetIndexCacheSize(dbname string, size int) {
+	getQueryService(dbname).schemaInfo.SetIndexCacheSize(uint64(size))
+}
+
+// DisallowQueries stops all the query services.
 func DisallowQueries() {
-	defer logError()
-	SqlQueryRpcService.disallowQueries()
+	for _, sqlQuery := range SqlQueryRpcService.all() {
+		func() {
+			defer logError()
+			sqlQuery.disallowQueries()
+		}()
+	}
+}
+
+// SetQueryRules sets the query rules of all the query services.
+func SetQueryRules(qrs *QueryRules) {
+	for _, sqlQuery := range SqlQueryRpcService.all() {
+		sqlQuery.queryRuleInfo.SetRules(qrs)
+	}
+}
+
+// SetTableAcl sets the table ACL of all the query services.
+func SetTableAcl(acl *TableAcl) {
+	for _, sqlQuery := range SqlQueryRpcService.all() {
+		sqlQuery.tableAclInfo.SetAcl(acl)
+	}
 }
 
+// ReloadSchema reloads the schema of all the query services.
 func ReloadSchema() {
-	defer logError()
-	SqlQueryRpcService.reloadSchema()
+	for _, sqlQuery := range SqlQueryRpcService.all() {
+		func() {
+			defer logError()
+			sqlQuery.reloadSchema()
+		}()
+	}
 }
 
-func GetSessionId() int64 {
-	return SqlQueryRpcService.sessionId
+// SetTunable changes the vt_* setting key of the open query services
+// where it's not already value, as if it was set with a SET statement.
+// It returns the dbnames of the services that were changed, and of
+// those that were skipped because they're not open.
+func SetTunable(key string, value float64) (changed, skipped []string, err error) {
+	defer handleError(&err)
+	for _, dbname := range SqlQueryRpcService.dbnames() {
+		sqlQuery := SqlQueryRpcService.get(dbname)
+		if sqlQuery == nil {
+			continue
+		}
+		isChanged, isOpen := sqlQuery.changeTunable(key, value)
+		if isChanged {
+			changed = append(changed, dbname)
+		} else if !isOpen {
+			skipped = append(skipped, dbname)
+		}
+	}
+	return changed, skipped, nil
+}
+
+// GetSessionId returns the session id that identifies caller to the
+// query service of dbname. An empty caller is anonymous.
+func GetSessionId(dbname, caller string) (sessionId int64, err error) {
+	sqlQuery := SqlQueryRpcService.get(dbname)
+	if sqlQuery == nil {
+		return 0, NewTabletError(FAIL, "db name mismatch, expecting one of %v, received %v", SqlQueryRpcService.dbnames(), dbname)
+	}
+	return sqlQuery.CallerSessionId(caller), nil
 }
 
-func CreateTable(tableName string, cacheSize uint64) (err error) {
+func CreateTable(dbname, tableName string, cacheSize uint64) (err error) {
 	defer handleError(&err)
-	SqlQueryRpcService.createTable(tableName, cacheSize)
+	getQueryService(dbname).createTable(tableName, cacheSize)
 	return nil
 }
 
-func DropTable(tableName string) (err error) {
+func DropTable(dbname, tableName string) (err error) {
 	defer handleError(&err)
-	SqlQueryRpcService.dropTable(tableName)
+	getQueryService(dbname).dropTable(tableName)
 	return nil
 }
 
-func SetRowCache(tableName string, cacheSize uint64) (err error) {
+func SetRowCache(dbname, tableName string, cacheSize uint64) (err error) {
 	defer handleError(&err)
-	SqlQueryRpcService.setRowCache(tableName, cacheSize)
+	getQueryService(dbname).setRowCache(tableName, cacheSize)
 	return nil
 }
@@ -32,26 +32,54 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package tabletserver
 
 import (
+	"code.google.com/p/vitess/go/cache"
 	"code.google.com/p/vitess/go/pools"
+	"code.google.com/p/vitess/go/relog"
+	"code.google.com/p/vitess/go/timer"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// REAPED_HISTORY is the number of reaped connection ids remembered
+// to tell clients why their connection is gone.
+const REAPED_HISTORY = 1000
+
 type ReservedPool struct {
+	mu          sync.Mutex
 	pool        *pools.Numbered
+	connecting  int // Connections being created. Protected by mu
 	lastId      int64
 	connFactory CreateConnectionFunc
+	capacity    int64 // Use sync/atomic
+	idleTimeout int64 // Use sync/atomic
+	ticks       *timer.Timer
+	reaped      *cache.LRUCache
 }
 
-func NewReservedPool() *ReservedPool {
-	return &ReservedPool{pool: pools.NewNumbered(), lastId: 1}
+func NewReservedPool(name string, capacity int, idleTimeout time.Duration) *ReservedPool {
+	self := &ReservedPool{
+		pool:        pools.NewNumbered(),
+		lastId:      1,
+		capacity:    int64(capacity),
+		idleTimeout: int64(idleTimeout),
+		ticks:       timer.NewTimer(idleTimeout / 10),
+		reaped:      cache.NewLRUCache(REAPED_HISTORY),
+	}
+	http.Handle(debugPath(name, "reserved"), self)
+	return self
 }
 
 func (self *ReservedPool) Open(connFactory CreateConnectionFunc) {
 	self.connFactory = connFactory
+	go self.ConnectionReaper()
 }
 
 func (self *ReservedPool) Close() {
+	self.ticks.Close()
 	for _, v := range self.pool.GetTimedout(time.Duration(0)) {
 		conn := v.(*reservedConnection)
 		conn.Close()
@@ -59,17 +87,69 @@ func (self *ReservedPool) Close() {
 	}
 }
 
+// ConnectionReaper closes the connections that were not used
+// for longer than the idle timeout. A zero timeout disables it.
+func (self *ReservedPool) ConnectionReaper() {
+	for self.ticks.Next() {
+		idleTimeout := self.IdleTimeout()
+		if idleTimeout == 0 {
+			continue
+		}
+		for _, v := range self.pool.GetAll() {
+			conn := v.(*reservedConnection)
+			if conn.idleTime() < idleTimeout {
+				continue
+			}
+			// Get fails if the connection is being used. Once it's
+			// locked, it must still be idle.
+			if _, err := self.pool.Get(conn.connectionId); err != nil {
+				continue
+			}
+			if conn.idleTime() < idleTimeout {
+				self.pool.Put(conn.connectionId)
+				continue
+			}
+			relog.Info("reaping reserved connection %d", conn.connectionId)
+			killStats.Add("Reserved", 1)
+			self.reaped.Set(strconv.FormatInt(conn.connectionId, 10), reapedConnection(idleTimeout))
+			conn.Close()
+			self.pool.Unregister(conn.connectionId)
+		}
+	}
+}
+
 func (self *ReservedPool) CreateConnection() (connectionId int64) {
-	conn, err := self.connFactory()
+	self.reserveSlot()
+	defer self.releaseSlot()
+	conn, err := connectWithBackoff(self.connFactory)
 	if err != nil {
-		panic(NewTabletErrorSql(FATAL, err))
+		panic(connectError(err))
 	}
 	connectionId = atomic.AddInt64(&self.lastId, 1)
-	rconn := &reservedConnection{DBConnection: conn, connectionId: connectionId, pool: self}
+	now := time.Now()
+	rconn := &reservedConnection{DBConnection: conn, connectionId: connectionId, pool: self, createTime: now, lastUsed: now.UnixNano()}
 	self.pool.Register(connectionId, rconn)
 	return connectionId
 }
 
+// reserveSlot panics if the pool is full. Connections that are being
+// created count against the capacity, for concurrent callers not to
+// exceed it while they connect.
+func (self *ReservedPool) reserveSlot() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if int64(self.pool.Stats()+self.connecting) >= self.Capacity() {
+		panic(NewTabletError(FAIL, "Reserved connection limit exceeded"))
+	}
+	self.connecting++
+}
+
+func (self *ReservedPool) releaseSlot() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.connecting--
+}
+
 func (self *ReservedPool) CloseConnection(connectionId int64) {
 	conn := self.Get(connectionId).(*reservedConnection)
 	conn.Close()
@@ -80,30 +160,84 @@ func (self *ReservedPool) CloseConnection(connectionId int64) {
 func (self *ReservedPool) Get(connectionId int64) PoolConnection {
 	v, err := self.pool.Get(connectionId)
 	if err != nil {
+		if idleTimeout, ok := self.reaped.Get(strconv.FormatInt(connectionId, 10)); ok {
+			panic(NewTabletError(FAIL, "Reserved connection %d was closed after being idle for more than %v", connectionId, time.Duration(idleTimeout.(reapedConnection))))
+		}
 		panic(NewTabletError(FAIL, "Error getting connection %d: %v", connectionId, err))
 	}
 	return v.(*reservedConnection)
 }
 
+func (self *ReservedPool) Capacity() int64 {
+	return atomic.LoadInt64(&self.capacity)
+}
+
+func (self *ReservedPool) SetCapacity(capacity int) {
+	atomic.StoreInt64(&self.capacity, int64(capacity))
+}
+
+func (self *ReservedPool) IdleTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&self.idleTimeout))
+}
+
+func (self *ReservedPool) SetIdleTimeout(idleTimeout time.Duration) {
+	atomic.StoreInt64(&self.idleTimeout, int64(idleTimeout))
+	self.ticks.SetInterval(idleTimeout / 10)
+}
+
 func (self *ReservedPool) StatsJSON() string {
-	return self.pool.StatsJSON()
+	return fmt.Sprintf("{\"Size\": %v, \"Capacity\": %v, \"IdleTimeout\": %v}", self.Stats(), self.Capacity(), float64(self.IdleTimeout())/1e9)
 }
 
 func (self *ReservedPool) Stats() (size int) {
 	return self.pool.Stats()
 }
 
+// ServeHTTP lists the reserved connections with their age
+// and the time since they were last used.
+func (self *ReservedPool) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	vals := self.pool.GetAll()
+	response.Header().Set("Content-Type", "text/plain")
+	if len(vals) == 0 {
+		response.Write([]byte("empty\n"))
+		return
+	}
+	response.Write([]byte(fmt.Sprintf("Length: %d\n", len(vals))))
+	now := time.Now()
+	for _, v := range vals {
+		conn := v.(*reservedConnection)
+		response.Write([]byte(fmt.Sprintf("%v\t%.6f\t%.6f\n", conn.connectionId, now.Sub(conn.createTime).Seconds(), conn.idleTime().Seconds())))
+	}
+}
+
 type reservedConnection struct {
 	*DBConnection
 	connectionId int64
 	pool         *ReservedPool
 	inUse        bool
+	createTime   time.Time
+	lastUsed     int64 // Unix nanoseconds. Use sync/atomic
+}
+
+// idleTime returns the time since the connection was last recycled,
+// or created if it was never used.
+func (self *reservedConnection) idleTime() time.Duration {
+	return time.Now().Sub(time.Unix(0, atomic.LoadInt64(&self.lastUsed)))
 }
 
 func (self *reservedConnection) Recycle() {
+	atomic.StoreInt64(&self.lastUsed, time.Now().UnixNano())
 	if self.IsClosed() {
 		self.pool.pool.Unregister(self.connectionId)
 	} else {
 		self.pool.pool.Put(self.connectionId)
 	}
 }
+
+// reapedConnection remembers the idle timeout that
+// caused a connection to be reaped.
+type reapedConnection time.Duration
+
+func (self reapedConnection) Size() int {
+	return 1
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tabletserver
+
+import (
+	"code.google.com/p/vitess/go/cache"
+	"code.google.com/p/vitess/go/pools"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReservedPoolReaped(t *testing.T) {
+	// Not using NewReservedPool, which registers a debug page
+	rp := &ReservedPool{pool: pools.NewNumbered(), reaped: cache.NewLRUCache(REAPED_HISTORY)}
+	rp.reaped.Set("5", reapedConnection(time.Minute))
+	expectTabletError(t, "Reserved connection 5 was closed after being idle for more than 1m0s", func() { rp.Get(5) })
+	expectTabletError(t, "Error getting connection 6: not found", func() { rp.Get(6) })
+}
+
+func TestReservedPoolCapacity(t *testing.T) {
+	rp := &ReservedPool{pool: pools.NewNumbered(), capacity: 1}
+	connecting, done, failed := make(chan bool), make(chan bool), make(chan bool)
+	rp.connFactory = func() (*DBConnection, error) {
+		connecting <- true
+		<-done
+		return nil, errors.New("access denied")
+	}
+	go func() {
+		defer func() {
+			recover()
+			failed <- true
+		}()
+		rp.CreateConnection()
+	}()
+	// The connection being created counts against the capacity
+	<-connecting
+	expectTabletError(t, "Reserved connection limit exceeded", func() { rp.CreateConnection() })
+	done <- true
+	<-failed
+
+	// Failed connections give their slot back
+	go func() {
+		<-connecting
+		done <- true
+	}()
+	expectTabletError(t, "access denied", func() { rp.CreateConnection() })
+}
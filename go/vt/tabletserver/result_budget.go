@@ -0,0 +1,97 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tabletserver
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// ResultBudget limits the memory held by the results of the queries
+// in flight. Once it's exceeded, reads fail with RETRY until enough
+// results are released. A capacity of 0 disables the limit, but usage
+// is still tracked.
+//
+// The limit is soft: the size of a result is only known once it's
+// fetched, so the queries that passed Check concurrently can together
+// overshoot the capacity by up to their number times the max result size.
+type ResultBudget struct {
+	capacity int64 // Use sync/atomic
+	current  int64 // Use sync/atomic
+	peak     int64 // Use sync/atomic
+}
+
+func NewResultBudget(capacity int64) *ResultBudget {
+	return &ResultBudget{capacity: capacity}
+}
+
+// Check panics with a RETRY error if the budget is exhausted.
+func (self *ResultBudget) Check() {
+	capacity := self.Capacity()
+	if current := atomic.LoadInt64(&self.current); capacity != 0 && current >= capacity {
+		panic(NewTabletError(RETRY, "Result memory budget exceeded: %d bytes in flight", current))
+	}
+}
+
+func (self *ResultBudget) Reserve(size int64) {
+	current := atomic.AddInt64(&self.current, size)
+	for {
+		peak := atomic.LoadInt64(&self.peak)
+		if current <= peak || atomic.CompareAndSwapInt64(&self.peak, peak, current) {
+			return
+		}
+	}
+}
+
+func (self *ResultBudget) Release(size int64) {
+	atomic.AddInt64(&self.current, -size)
+}
+
+func (self *ResultBudget) Capacity() int64 {
+	return atomic.LoadInt64(&self.capacity)
+}
+
+func (self *ResultBudget) SetCapacity(capacity int64) {
+	atomic.StoreInt64(&self.capacity, capacity)
+}
+
+func (self *ResultBudget) StatsJSON() string {
+	return fmt.Sprintf("{\"Capacity\": %v, \"Current\": %v, \"Peak\": %v}", self.Capacity(), atomic.LoadInt64(&self.current), atomic.LoadInt64(&self.peak))
+}
+
+// resultSize is the number of bytes of data in qr.
+func resultSize(qr *QueryResult) (size int64) {
+	for _, row := range qr.Rows {
+		size += int64(DBResultRow(row).Size())
+	}
+	return size
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tabletserver
+
+import (
+	"testing"
+)
+
+func TestResultBudget(t *testing.T) {
+	budget := NewResultBudget(10)
+	budget.Reserve(6)
+	budget.Check()
+	budget.Reserve(4)
+	expectTabletError(t, "Result memory budget exceeded: 10 bytes in flight", budget.Check)
+	budget.Release(6)
+	budget.Check()
+	if got := budget.StatsJSON(); got != `{"Capacity": 10, "Current": 4, "Peak": 10}` {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestSharedResultRelease(t *testing.T) {
+	budget := NewResultBudget(0)
+	consolidator := &Consolidator{queries: make(map[string]*Result)}
+	q, _ := consolidator.Create("select 1")
+	shared, created := consolidator.Create("select 1")
+	if created || shared != q {
+		t.Fatalf("query was not consolidated")
+	}
+	q.Result = &QueryResult{Rows: [][]interface{}{{"abc", "de"}}}
+	q.size = resultSize(q.Result)
+	budget.Reserve(q.size)
+	q.Broadcast()
+
+	q.Release(budget)
+	if got := budget.StatsJSON(); got != `{"Capacity": 0, "Current": 5, "Peak": 5}` {
+		t.Errorf("after first release: got %s", got)
+	}
+	shared.Release(budget)
+	if got := budget.StatsJSON(); got != `{"Capacity": 0, "Current": 0, "Peak": 5}` {
+		t.Errorf("after last release: got %s", got)
+	}
+}
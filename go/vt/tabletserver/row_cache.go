@@ -0,0 +1,105 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tabletserver
+
+import (
+	"code.google.com/p/vitess/go/cache"
+)
+
+// RowCache is the cache of the rows of a table. Keys are built by
+// buildKey, and values are full rows of the table.
+type RowCache interface {
+	Get(key string) (row DBResultRow, ok bool)
+	Set(key string, row DBResultRow)
+	// SetIfAbsent adds the row only if the key is not present. Backends
+	// should avoid filling the cache with a row that was read before
+	// the key got invalidated by Delete.
+	SetIfAbsent(key string, row DBResultRow)
+	// Peek is like Get, but it's not a use of the row: its
+	// recency is unchanged, and misses don't prepare a Set.
+	Peek(key string) (row DBResultRow, ok bool)
+	Delete(key string) bool
+	// SampleKeys returns up to count keys that are likely
+	// to be in the cache, for verification.
+	SampleKeys(count int) []string
+	SetCapacity(capacity uint64)
+	StatsJSON() string
+}
+
+// CreateRowCacheFunc creates the row cache of a table.
+type CreateRowCacheFunc func(tableInfo *TableInfo, cacheSize uint64) RowCache
+
+// GenericRowCacheCreator returns a CreateRowCacheFunc for the
+// in-process LRU cache if address is empty. Otherwise, rows are
+// cached by the memcached server at address.
+func GenericRowCacheCreator(address string, poolSize int, keyPrefix string) CreateRowCacheFunc {
+	if address == "" {
+		return NewLRURowCache
+	}
+	pool := NewMemcachePool(address, poolSize)
+	return func(tableInfo *TableInfo, cacheSize uint64) RowCache {
+		return NewMemcacheRowCache(pool, keyPrefix, tableInfo)
+	}
+}
+
+// LRURowCache caches rows in-process.
+type LRURowCache struct {
+	*cache.LRUCache
+}
+
+func NewLRURowCache(tableInfo *TableInfo, cacheSize uint64) RowCache {
+	return LRURowCache{cache.NewLRUCache(cacheSize)}
+}
+
+func (self LRURowCache) Get(key string) (row DBResultRow, ok bool) {
+	v, ok := self.LRUCache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return v.(DBResultRow), true
+}
+
+func (self LRURowCache) Set(key string, row DBResultRow) {
+	self.LRUCache.Set(key, row)
+}
+
+func (self LRURowCache) SetIfAbsent(key string, row DBResultRow) {
+	self.LRUCache.SetIfAbsent(key, row)
+}
+
+func (self LRURowCache) Peek(key string) (row DBResultRow, ok bool) {
+	v, ok := self.LRUCache.Peek(key)
+	if !ok {
+		return nil, false
+	}
+	return v.(DBResultRow), true
+}
@@ -37,35 +37,46 @@ import (
 	"code.google.com/p/vitess/go/timer"
 	"code.google.com/p/vitess/go/vt/schema"
 	"code.google.com/p/vitess/go/vt/sqlparser"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Query stats are kept for more queries than the plan cache can hold,
+// so they're still around for a while after a plan gets evicted.
+const QUERY_STATS_FACTOR = 2
+
 type SchemaInfo struct {
 	sync.Mutex
 	Tables           map[string]*TableInfo
 	QueryCacheSize   int
 	Queries          *cache.LRUCache
+	QueryStats       *cache.LRUCache
 	ConnFactory      CreateConnectionFunc
+	RowCacheFactory  CreateRowCacheFunc
+	indexCacheSize   uint64
 	SchemaReloadTime time.Duration
 	LastReload       time.Time
 	ticks            *timer.Timer
 }
 
-func NewSchemaInfo(queryCacheSize int, schemaReloadTime time.Duration) *SchemaInfo {
+func NewSchemaInfo(name string, queryCacheSize int, schemaReloadTime time.Duration) *SchemaInfo {
 	self := &SchemaInfo{
 		QueryCacheSize:   queryCacheSize,
+		QueryStats:       cache.NewLRUCache(uint64(QUERY_STATS_FACTOR * queryCacheSize)),
 		SchemaReloadTime: schemaReloadTime,
 		ticks:            timer.NewTimer(schemaReloadTime),
 	}
-	http.Handle("/debug/query_cache", self)
+	http.Handle(debugPath(name, "query_cache"), self)
+	http.Handle(debugPath(name, "query_stats"), http.HandlerFunc(self.ServeQueryStats))
 	return self
 }
 
-func (self *SchemaInfo) Open(ConnFactory CreateConnectionFunc, cachingInfo map[string]uint64) {
-	conn, err := ConnFactory()
+func (self *SchemaInfo) Open(ConnFactory CreateConnectionFunc, cachingInfo map[string]uint64, RowCacheFactory CreateRowCacheFunc) {
+	conn, err := connectWithBackoff(ConnFactory)
 	if err != nil {
 		panic(NewTabletError(FATAL, "Could not get connection: %v", err))
 	}
@@ -80,10 +91,10 @@ func (self *SchemaInfo) Open(ConnFactory CreateConnectionFunc, cachingInfo map[s
 		panic(NewTabletError(FATAL, "Could not get table list: %v", err))
 	}
 	self.Tables = make(map[string]*TableInfo, len(tables.Rows))
-	self.Tables["dual"] = NewTableInfo(conn, "dual", 0)
+	self.Tables["dual"] = NewTableInfo(conn, "dual", 0, 0, RowCacheFactory)
 	for _, row := range tables.Rows {
 		tableName := row[0].(string)
-		tableInfo := NewTableInfo(conn, tableName, cachingInfo[tableName])
+		tableInfo := NewTableInfo(conn, tableName, cachingInfo[tableName], self.IndexCacheSize(), RowCacheFactory)
 		if tableInfo == nil {
 			continue
 		}
@@ -91,6 +102,7 @@ func (self *SchemaInfo) Open(ConnFactory CreateConnectionFunc, cachingInfo map[s
 	}
 	self.Queries = cache.NewLRUCache(uint64(self.QueryCacheSize))
 	self.ConnFactory = ConnFactory
+	self.RowCacheFactory = RowCacheFactory
 	go self.SchemaReloader()
 }
 
@@ -99,6 +111,15 @@ func (self *SchemaInfo) Close() {
 	self.Tables = nil
 	self.Queries = nil
 	self.ConnFactory = nil
+	self.RowCacheFactory = nil
+}
+
+func (self *SchemaInfo) SetIndexCacheSize(size uint64) {
+	atomic.StoreUint64(&self.indexCacheSize, size)
+}
+
+func (self *SchemaInfo) IndexCacheSize() uint64 {
+	return atomic.LoadUint64(&self.indexCacheSize)
 }
 
 func (self *SchemaInfo) SchemaReloader() {
@@ -145,7 +166,7 @@ func (self *SchemaInfo) CreateTable(tableName string, cacheSize uint64) {
 	}
 	defer conn.Close()
 
-	tableInfo := NewTableInfo(conn, tableName, cacheSize)
+	tableInfo := NewTableInfo(conn, tableName, cacheSize, self.IndexCacheSize(), self.RowCacheFactory)
 	if tableInfo == nil {
 		panic(NewTabletError(FATAL, "Could not create table %s", tableName))
 	}
@@ -177,6 +198,63 @@ func (self *SchemaInfo) AlterTable(tableName string, cacheSize uint64) {
 	self.CreateTable(tableName, cacheSize)
 }
 
+// ApplyDDL brings the schema up to date after ddlPlan was executed.
+// The new table is loaded before taking the lock, so queries never
+// find it missing while it's being replaced. Row cache sizes are kept.
+func (self *SchemaInfo) ApplyDDL(ddlPlan *sqlparser.DDLPlan) {
+	cacheSize := uint64(0)
+	if tableInfo := self.GetTable(ddlPlan.TableName); tableInfo != nil {
+		cacheSize = tableInfo.CacheSize
+		self.Put(tableInfo)
+	}
+	newName := ""
+	switch ddlPlan.Action {
+	case sqlparser.CREATE, sqlparser.ALTER:
+		newName = ddlPlan.TableName
+	case sqlparser.RENAME:
+		newName = ddlPlan.NewName
+	}
+	var newTableInfo *TableInfo
+	if newName != "" {
+		newTableInfo = self.loadTable(newName, cacheSize)
+	}
+
+	self.Lock()
+	defer self.Unlock()
+	self.removeTable(ddlPlan.TableName)
+	if newTableInfo != nil {
+		self.removeTable(newName)
+		self.Tables[newName] = newTableInfo
+	}
+	self.Queries.Clear()
+}
+
+func (self *SchemaInfo) loadTable(tableName string, cacheSize uint64) *TableInfo {
+	conn, err := self.ConnFactory()
+	if err != nil {
+		panic(NewTabletError(FATAL, "Could not get connection to load table %s: %v", tableName, err))
+	}
+	defer conn.Close()
+
+	tableInfo := NewTableInfo(conn, tableName, cacheSize, self.IndexCacheSize(), self.RowCacheFactory)
+	if tableInfo == nil {
+		panic(NewTabletError(FATAL, "Could not load table %s", tableName))
+	}
+	return tableInfo
+}
+
+// removeTable waits for the table to be released by in-flight queries.
+// Caller must hold the lock on SchemaInfo.
+func (self *SchemaInfo) removeTable(tableName string) {
+	tableInfo, ok := self.Tables[tableName]
+	if !ok {
+		return
+	}
+	delete(self.Tables, tableName)
+	tableInfo.Lock()
+	tableInfo.Unlock()
+}
+
 func (self *SchemaInfo) SetRowCache(tableName string, cacheSize uint64) {
 	if self.simpleSetRowCache(tableName, cacheSize) {
 		return
@@ -255,6 +333,7 @@ func (self *SchemaInfo) SetQueryCacheSize(size int) {
 	}
 	self.QueryCacheSize = size
 	self.Queries.SetCapacity(uint64(size))
+	self.QueryStats.SetCapacity(uint64(QUERY_STATS_FACTOR * size))
 }
 
 func (self *SchemaInfo) SetSchemaReloadTime(reload_time time.Duration) {
@@ -275,3 +354,115 @@ func (self *SchemaInfo) ServeHTTP(response http.ResponseWriter, request *http.Re
 		response.Write([]byte(fmt.Sprintf("%s\n", v)))
 	}
 }
+
+// AddQueryStats records the execution of a query whose plan is cached.
+func (self *SchemaInfo) AddQueryStats(sql string, elapsed, mysqlTime, waitTime time.Duration, rowCount int64, failed bool) {
+	v, ok := self.QueryStats.Get(sql)
+	if !ok {
+		self.QueryStats.SetIfAbsent(sql, &QueryStats{})
+		if v, ok = self.QueryStats.Get(sql); !ok {
+			return
+		}
+	}
+	v.(*QueryStats).Add(elapsed, mysqlTime, waitTime, rowCount, failed)
+}
+
+func (self *SchemaInfo) ResetQueryStats() {
+	self.QueryStats.Clear()
+}
+
+// ServeQueryStats shows the stats of every query in text, or in
+// JSON if format=json is specified. A POST resets the stats.
+func (self *SchemaInfo) ServeQueryStats(response http.ResponseWriter, request *http.Request) {
+	if request.Method == "POST" {
+		self.ResetQueryStats()
+		response.Write([]byte("query stats reset\n"))
+		return
+	}
+	items := self.QueryStats.Items()
+	if request.FormValue("format") == "json" {
+		list := make([]QueryStatsJSON, len(items))
+		for i, item := range items {
+			list[i] = item.Value.(*QueryStats).toJSON(item.Key)
+		}
+		data, err := json.MarshalIndent(list, "", "  ")
+		if err != nil {
+			http.Error(response, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response.Header().Set("Content-Type", "application/json")
+		response.Write(data)
+		return
+	}
+	response.Header().Set("Content-Type", "text/plain")
+	if len(items) == 0 {
+		response.Write([]byte("empty\n"))
+		return
+	}
+	response.Write([]byte(fmt.Sprintf("Length: %d\n", len(items))))
+	response.Write([]byte("Count\tTime\tMaxTime\tMysqlTime\tWaitTime\tRows\tErrors\tQuery\n"))
+	for _, item := range items {
+		qs := item.Value.(*QueryStats).toJSON(item.Key)
+		response.Write([]byte(fmt.Sprintf("%v\t%.6f\t%.6f\t%.6f\t%.6f\t%v\t%v\t%s\n",
+			qs.Count, qs.Time, qs.MaxTime, qs.MysqlTime, qs.WaitTime, qs.RowCount, qs.ErrorCount, qs.Query)))
+	}
+}
+
+// QueryStats accumulates the execution stats of a query.
+type QueryStats struct {
+	mu         sync.Mutex
+	count      int64
+	time       time.Duration
+	maxTime    time.Duration
+	mysqlTime  time.Duration
+	waitTime   time.Duration
+	rowCount   int64
+	errorCount int64
+}
+
+func (self *QueryStats) Size() int {
+	return 1
+}
+
+func (self *QueryStats) Add(elapsed, mysqlTime, waitTime time.Duration, rowCount int64, failed bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.count++
+	self.time += elapsed
+	if elapsed > self.maxTime {
+		self.maxTime = elapsed
+	}
+	self.mysqlTime += mysqlTime
+	self.waitTime += waitTime
+	self.rowCount += rowCount
+	if failed {
+		self.errorCount++
+	}
+}
+
+// QueryStatsJSON is a snapshot of QueryStats. Times are in seconds.
+type QueryStatsJSON struct {
+	Query      string
+	Count      int64
+	Time       float64
+	MaxTime    float64
+	MysqlTime  float64
+	WaitTime   float64
+	RowCount   int64
+	ErrorCount int64
+}
+
+func (self *QueryStats) toJSON(query string) QueryStatsJSON {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return QueryStatsJSON{
+		Query:      query,
+		Count:      self.count,
+		Time:       self.time.Seconds(),
+		MaxTime:    self.maxTime.Seconds(),
+		MysqlTime:  self.mysqlTime.Seconds(),
+		WaitTime:   self.waitTime.Seconds(),
+		RowCount:   self.rowCount,
+		ErrorCount: self.errorCount,
+	}
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tabletserver
+
+import (
+	"code.google.com/p/vitess/go/relog"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SlowQueryLogger receives the slow query log. There's no slow
+// query log if it's nil.
+var SlowQueryLogger *relog.Logger
+
+// SlowQueryLog decides which queries and transactions go to
+// SlowQueryLogger: those that took longer than the threshold, and
+// a random sample of the others, for comparison.
+type SlowQueryLog struct {
+	threshold  int64  // Use sync/atomic
+	sampleRate uint64 // math.Float64bits of the rate. Use sync/atomic
+}
+
+func NewSlowQueryLog(threshold time.Duration, sampleRate float64) *SlowQueryLog {
+	self := &SlowQueryLog{}
+	self.SetThreshold(threshold)
+	self.SetSampleRate(sampleRate)
+	return self
+}
+
+func (self *SlowQueryLog) Threshold() time.Duration {
+	return time.Duration(atomic.LoadInt64(&self.threshold))
+}
+
+// SetThreshold changes the duration above which queries are logged.
+// 0 disables the slow query log.
+func (self *SlowQueryLog) SetThreshold(threshold time.Duration) {
+	if threshold < 0 {
+		panic(NewTabletError(FAIL, "slow query threshold out of range %v", threshold))
+	}
+	atomic.StoreInt64(&self.threshold, int64(threshold))
+}
+
+func (self *SlowQueryLog) SampleRate() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&self.sampleRate))
+}
+
+// SetSampleRate changes the fraction of the queries under the
+// threshold that are logged anyway.
+func (self *SlowQueryLog) SetSampleRate(sampleRate float64) {
+	if sampleRate < 0 || sampleRate > 1 {
+		panic(NewTabletError(FAIL, "slow query sample rate out of range %v", sampleRate))
+	}
+	atomic.StoreUint64(&self.sampleRate, math.Float64bits(sampleRate))
+}
+
+// reason returns why something that took duration should be logged:
+// "slow" or "sampled", or "" if it shouldn't.
+func (self *SlowQueryLog) reason(duration time.Duration) string {
+	if SlowQueryLogger == nil {
+		return ""
+	}
+	if threshold := self.Threshold(); threshold > 0 && duration >= threshold {
+		return "slow"
+	}
+	if sampleRate := self.SampleRate(); sampleRate > 0 && rand.Float64() < sampleRate {
+		return "sampled"
+	}
+	return ""
+}
+
+// logQuery logs the query of stats if it qualifies, with the reason
+// of its plan. Its wait time is broken down into the time spent
+// waiting for a pool connection and for consolidated queries. The
+// query is normalized, so that the queries that only differ by their
+// values can be grouped. Queries that couldn't be parsed are logged
+// as they were received.
+func (self *SlowQueryLog) logQuery(stats *SqlQueryStats, plan *CompiledPlan) {
+	why := self.reason(stats.TotalTime())
+	if why == "" {
+		return
+	}
+	sql := stats.OriginalSql
+	var planReason string
+	var poolWaitTime, consolidatorWaitTime time.Duration
+	if plan != nil {
+		sql = plan.NormalizedQuery
+		planReason = plan.Reason.String()
+		poolWaitTime = plan.poolWaitTime
+		consolidatorWaitTime = plan.consolidatorWaitTime
+	}
+	SlowQueryLogger.Info(
+		"query\t%v\t%.6f\t%v\t%v\t%v\t%v\t%v\t%.6f\t%.6f\t%.6f\t%v\t%q\t%q",
+		why,
+		stats.TotalTime().Seconds(),
+		stats.SessionId,
+		stats.TransactionId,
+		stats.PlanType,
+		planReason,
+		stats.RowsAffected,
+		stats.MysqlTime.Seconds(),
+		poolWaitTime.Seconds(),
+		consolidatorWaitTime.Seconds(),
+		stats.TableName,
+		sql,
+		stats.Error,
+	)
+}
+
+// logTransaction logs conn if it qualifies, with its normalized queries.
+func (self *SlowQueryLog) logTransaction(conn *TxConnection) {
+	duration := conn.endTime.Sub(conn.startTime)
+	why := self.reason(duration)
+	if why == "" {
+		return
+	}
+	conn.queriesMu.Lock()
+	queries := strings.Join(conn.normalizedQueries, ";")
+	count := len(conn.normalizedQueries)
+	conn.queriesMu.Unlock()
+	SlowQueryLogger.Info(
+		"transaction\t%v\t%.6f\t%v\t%v\t%v\t%q",
+		why,
+		duration.Seconds(),
+		conn.transactionId,
+		conn.conclusion,
+		count,
+		queries,
+	)
+}
+
+func (self *SlowQueryLog) StatsJSON() string {
+	return fmt.Sprintf("{\"Threshold\": %v, \"SampleRate\": %v}", self.Threshold().Seconds(), self.SampleRate())
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tabletserver
+
+import (
+	"bytes"
+	"code.google.com/p/vitess/go/relog"
+	"code.google.com/p/vitess/go/vt/sqlparser"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlowQueryLog(t *testing.T) {
+	buf := &bytes.Buffer{}
+	SlowQueryLogger = relog.New(buf, "", 0, relog.DEBUG)
+	defer func() { SlowQueryLogger = nil }()
+
+	sl := NewSlowQueryLog(100*time.Millisecond, 0)
+	if why := sl.reason(50 * time.Millisecond); why != "" {
+		t.Errorf("want fast queries skipped, got %q", why)
+	}
+	if why := sl.reason(100 * time.Millisecond); why != "slow" {
+		t.Errorf("want slow, got %q", why)
+	}
+	sl.SetSampleRate(1)
+	if why := sl.reason(50 * time.Millisecond); why != "sampled" {
+		t.Errorf("want sampled, got %q", why)
+	}
+	sl.SetThreshold(0)
+	sl.SetSampleRate(0)
+	if why := sl.reason(time.Hour); why != "" {
+		t.Errorf("want nothing logged with a 0 threshold, got %q", why)
+	}
+	expectTabletError(t, "slow query sample rate out of range 2", func() { sl.SetSampleRate(2) })
+
+	sl.SetThreshold(time.Millisecond)
+	start := time.Now()
+	stats := &SqlQueryStats{StartTime: start, EndTime: start.Add(time.Second), PlanType: "PASS_SELECT", OriginalSql: "select 1 from a where b = 'c'"}
+	plan := &CompiledPlan{ExecPlan: &sqlparser.ExecPlan{Reason: sqlparser.REASON_SELECT, NormalizedQuery: "select ? from a where b = ?"}, poolWaitTime: 2 * time.Millisecond}
+	sl.logQuery(stats, plan)
+	line := buf.String()
+	for _, want := range []string{"query\tslow\t1.000000\t", "PASS_SELECT\tSELECT\t", "\t0.002000\t", "\"select ? from a where b = ?\""} {
+		if !strings.Contains(line, want) {
+			t.Errorf("want %q in %q", want, line)
+		}
+	}
+
+	// Without a plan, there's only the original query
+	buf.Reset()
+	stats.OriginalSql = "select"
+	sl.logQuery(stats, nil)
+	if line = buf.String(); !strings.Contains(line, "\"select\"") {
+		t.Errorf("want the original query in %q", line)
+	}
+
+	// Transactions are logged with their normalized queries
+	buf.Reset()
+	conn := &TxConnection{transactionId: 1, startTime: start, endTime: start.Add(time.Second), conclusion: TX_COMMIT}
+	conn.RecordQuery("update a set b = 'secret'", "update a set b = ?")
+	sl.logTransaction(conn)
+	if line = buf.String(); !strings.Contains(line, "\"update a set b = ?\"") || strings.Contains(line, "secret") {
+		t.Errorf("want the normalized query in %q", line)
+	}
+}
@@ -22,8 +22,8 @@ LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
 A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
 OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
 SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
-LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
-DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
 THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
 (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
 OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
@@ -40,6 +40,7 @@ import (
 	"expvar"
 	"fmt"
 	"math/rand"
+	"net/http"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -60,22 +61,48 @@ const (
 //-----------------------------------------------
 // RPC API
 type SqlQuery struct {
-	mu            sync.RWMutex
-	state         int32 // Use sync/atomic to acces this variable
-	sessionId     int64
-	schemaInfo    *SchemaInfo
-	connPool      *ConnectionPool
-	reservedPool  *ReservedPool
-	txPool        *ConnectionPool
-	activeTxPool  *ActiveTxPool
-	activePool    *ActivePool
-	consolidator  *Consolidator
-	maxResultSize int32 // Use sync/atomic
-}
-
-// stats are globals to allow anybody to set them
+	mu               sync.RWMutex
+	name             string
+	state            int32 // Use sync/atomic to acces this variable
+	sessionId        int64 // Use sync/atomic
+	callers          callerSessions
+	schemaInfo       *SchemaInfo
+	superConnFactory CreateConnectionFunc
+	ddlMu            sync.Mutex // serializes DDLs
+	connPool         *ConnectionPool
+	reservedPool     *ReservedPool
+	txPool           *ConnectionPool
+	activeTxPool     *ActiveTxPool
+	activePool       *ActivePool
+	consolidator     *Consolidator
+	queryRuleInfo    *QueryRuleInfo
+	tableAclInfo     *TableAclInfo
+	invalidator      *Invalidator
+	cacheWarmer      *CacheWarmer
+	cacheVerifier    *CacheVerifier
+	maxResultSize    int32 // Use sync/atomic
+	streamBufferSize int32 // Use sync/atomic
+	dmlBatchSize     int32 // Use sync/atomic
+	resultBudget     *ResultBudget
+	slowQueryLog     *SlowQueryLog
+
+	// retryDone is non-nil while allowQueries is being retried
+	// in the background. Protected by mu.
+	retryDone chan struct{}
+
+	// opened is true from the time open has opened the schema and
+	// the pools until disallowQueries closes them. Protected by mu.
+	opened bool
+}
+
+// PK_BATCH_SIZE is the maximum number of rows fetched by one
+// query on row cache misses.
+const PK_BATCH_SIZE = 100
+
+// stats are globals to allow anybody to set them. They're shared
+// by all the query services of the process.
 var queryStats, waitStats *stats.Timings
-var killStats, errorStats *stats.Counters
+var killStats, errorStats, ruleHitStats, aclDeniedStats *stats.Counters
 var resultStats *stats.Histogram
 
 var resultBuckets = []int64{0, 1, 5, 10, 50, 100, 500, 1000, 5000, 10000}
@@ -86,24 +113,58 @@ type CacheInvalidator interface {
 	Delete(key string) bool
 }
 
-func NewSqlQuery(poolSize, transactionCap int, transactionTimeout float64, maxResultSize, queryCacheSize int, schemaReloadTime, queryTimeout, idleTimeout float64) *SqlQuery {
-	self := &SqlQuery{}
-	self.schemaInfo = NewSchemaInfo(queryCacheSize, time.Duration(schemaReloadTime*1e9))
-	self.connPool = NewConnectionPool(poolSize, time.Duration(idleTimeout*1e9))
-	self.reservedPool = NewReservedPool()
-	self.txPool = NewConnectionPool(transactionCap, time.Duration(idleTimeout*1e9)) // connections in pool has to be > transactionCap
-	self.activeTxPool = NewActiveTxPool(time.Duration(transactionTimeout * 1e9))
-	self.activePool = NewActivePool(time.Duration(queryTimeout*1e9), time.Duration(idleTimeout*1e9))
-	self.consolidator = NewConsolidator()
-	self.maxResultSize = int32(maxResultSize)
-	expvar.Publish("Voltron", stats.StrFunc(func() string { return self.statsJSON() }))
+// NewSqlQuery creates a query service. name tells apart the debug pages
+// and variables of the query services of a process. The unnamed one
+// uses the plain ones.
+func NewSqlQuery(name string, config Config) *SqlQuery {
+	self := &SqlQuery{name: name}
+	self.schemaInfo = NewSchemaInfo(name, config.QueryCacheSize, time.Duration(config.SchemaReloadTime*1e9))
+	self.connPool = NewConnectionPool(config.PoolSize, time.Duration(config.IdleTimeout*1e9))
+	self.reservedPool = NewReservedPool(name, config.ReservedCap, time.Duration(config.ReservedIdleTimeout*1e9))
+	self.txPool = NewConnectionPool(config.TransactionCap, time.Duration(config.IdleTimeout*1e9)) // connections in pool has to be > transactionCap
+	self.slowQueryLog = NewSlowQueryLog(time.Duration(config.SlowQueryThreshold*1e9), config.SlowQuerySampleRate)
+	self.activeTxPool = NewActiveTxPool(name, time.Duration(config.TransactionTimeout*1e9), self.slowQueryLog)
+	self.activePool = NewActivePool(time.Duration(config.QueryTimeout*1e9), time.Duration(config.IdleTimeout*1e9))
+	self.consolidator = NewConsolidator(name)
+	self.queryRuleInfo = NewQueryRuleInfo(name)
+	self.tableAclInfo = NewTableAclInfo(name)
+	self.invalidator = NewInvalidator(self)
+	self.cacheWarmer = NewCacheWarmer(self)
+	self.cacheVerifier = NewCacheVerifier(self)
+	self.maxResultSize = int32(config.MaxResultSize)
+	self.streamBufferSize = int32(config.StreamBufferSize)
+	self.dmlBatchSize = int32(config.DMLBatchSize)
+	if self.dmlBatchSize < 1 {
+		self.dmlBatchSize = 1
+	}
+	self.resultBudget = NewResultBudget(int64(config.ResultBudget))
+	voltron := "Voltron"
+	if name != "" {
+		voltron += "-" + name
+	}
+	expvar.Publish(voltron, stats.StrFunc(func() string { return self.statsJSON() }))
+	http.Handle(debugPath(name, "query_plans"), http.HandlerFunc(self.ServeQueryPlans))
+	return self
+}
+
+func init() {
 	queryStats = stats.NewTimings("Queries")
 	stats.NewRates("QPS", queryStats, 15, 60e9)
 	waitStats = stats.NewTimings("Waits")
 	killStats = stats.NewCounters("Kills")
 	errorStats = stats.NewCounters("Errors")
+	ruleHitStats = stats.NewCounters("QueryRuleHits")
+	aclDeniedStats = stats.NewCounters("TableAclDenied")
 	resultStats = stats.NewHistogram("Results", resultBuckets)
-	return self
+}
+
+// debugPath returns the path of a debug page of the query service
+// called name. The unnamed query service serves the plain /debug pages.
+func debugPath(name, page string) string {
+	if name == "" {
+		return "/debug/" + page
+	}
+	return "/debug/" + name + "/" + page
 }
 
 type CompiledPlan struct {
@@ -112,31 +173,165 @@ type CompiledPlan struct {
 	BindVars      map[string]interface{}
 	TransactionId int64
 	ConnectionId  int64
+	Timeout       time.Duration
+
+	// Time spent in MySQL and waiting for connections or consolidated
+	// queries, for query stats
+	MysqlTime time.Duration
+	WaitTime  time.Duration
+
+	// WaitTime broken down for the slow query log
+	poolWaitTime         time.Duration
+	consolidatorWaitTime time.Duration
+
+	// Results counted against the ResultBudget until the query is done
+	results []*Result
+
+	// For the query log
+	rewrittenSqls []string
+	cacheHits     int
+	cacheMisses   int
 }
 
-func (self *SqlQuery) allowQueries(ConnFactory CreateConnectionFunc, cachingInfo map[string]uint64) {
+func (self *CompiledPlan) holdResult(r *Result) {
+	self.results = append(self.results, r)
+}
+
+func (self *CompiledPlan) releaseResults(budget *ResultBudget) {
+	for _, r := range self.results {
+		r.Release(budget)
+	}
+	self.results = nil
+}
+
+const (
+	// If allowQueries fails, it's retried in the background with
+	// exponential backoff, between these delays.
+	ALLOW_RETRY_MIN_DELAY = 1 * time.Second
+	ALLOW_RETRY_MAX_DELAY = 30 * time.Second
+)
+
+type allowArgs struct {
+	ConnFactory      CreateConnectionFunc
+	cachingInfo      map[string]uint64
+	RowCacheFactory  CreateRowCacheFunc
+	SuperConnFactory CreateConnectionFunc
+}
+
+// allowQueries opens the query service. If MySQL is unreachable,
+// the error is returned to the caller as usual, and the service keeps
+// retrying in the background until it succeeds or disallowQueries
+// is called.
+func (self *SqlQuery) allowQueries(ConnFactory CreateConnectionFunc, cachingInfo map[string]uint64, RowCacheFactory CreateRowCacheFunc, SuperConnFactory CreateConnectionFunc) {
 	self.mu.Lock()
 	defer self.mu.Unlock()
+	self.stopRetries()
+	args := &allowArgs{ConnFactory, cachingInfo, RowCacheFactory, SuperConnFactory}
+	defer func() {
+		if x := recover(); x != nil {
+			self.startRetries(args)
+			panic(x)
+		}
+	}()
+	self.open(args)
+}
+
+// open must be called with mu locked.
+func (self *SqlQuery) open(args *allowArgs) {
 	atomic.StoreInt32(&self.state, INIT_FAILED)
 
 	start := time.Now().UnixNano()
-	self.schemaInfo.Open(ConnFactory, cachingInfo)
+	self.schemaInfo.Open(args.ConnFactory, args.cachingInfo, args.RowCacheFactory)
 	relog.Info("Time taken to load the schema: %v ms", (time.Now().UnixNano()-start)/1e6)
-	self.connPool.Open(ConnFactory)
-	self.reservedPool.Open(ConnFactory)
-	self.txPool.Open(ConnFactory)
+	self.connPool.Open(args.ConnFactory)
+	self.reservedPool.Open(args.ConnFactory)
+	self.txPool.Open(args.ConnFactory)
 	self.activeTxPool.Open()
-	self.activePool.Open(ConnFactory)
-	self.sessionId = Rand()
-	relog.Info("Session id: %d", self.sessionId)
+	self.activePool.Open(args.ConnFactory)
+	self.opened = true
+	self.superConnFactory = args.SuperConnFactory
+	self.callers.reset()
+	atomic.StoreInt64(&self.sessionId, Rand())
+	relog.Info("Session id: %d", self.SessionId())
 	atomic.StoreInt32(&self.state, OPEN)
+	self.invalidator.Open()
+	self.cacheWarmer.Open()
+	self.cacheVerifier.Open()
+}
+
+// startRetries must be called with mu locked.
+func (self *SqlQuery) startRetries(args *allowArgs) {
+	done := make(chan struct{})
+	self.retryDone = done
+	go func() {
+		delay := ALLOW_RETRY_MIN_DELAY
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(delay):
+			}
+			if self.tryReopen(done, args) {
+				return
+			}
+			if delay *= 2; delay > ALLOW_RETRY_MAX_DELAY {
+				delay = ALLOW_RETRY_MAX_DELAY
+			}
+		}
+	}()
+}
+
+// stopRetries must be called with mu locked.
+func (self *SqlQuery) stopRetries() {
+	if self.retryDone != nil {
+		close(self.retryDone)
+		self.retryDone = nil
+	}
+}
+
+// tryReopen returns true if the retries should stop.
+func (self *SqlQuery) tryReopen(done chan struct{}, args *allowArgs) (finished bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	select {
+	case <-done:
+		return true
+	default:
+	}
+	defer func() {
+		if x := recover(); x != nil {
+			reconnectStats.Add("AllowQueries", 1)
+			relog.Warning("Retrying allowQueries failed: %v", x)
+		}
+	}()
+	self.open(args)
+	relog.Info("Query service reopened after retry")
+	self.retryDone = nil
+	return true
 }
 
 func (self *SqlQuery) disallowQueries() {
+	// A background retry could otherwise reopen the invalidator
+	// after it's closed below
+	self.mu.Lock()
+	self.stopRetries()
+	opened := self.opened
+	self.mu.Unlock()
+	if !opened {
+		// The retries never got far enough to open anything,
+		// and closing what's not open would wait forever.
+		atomic.StoreInt32(&self.state, CLOSED)
+		return
+	}
+
 	// set this before obtaining lock so new incoming requests
 	// can serve "unavailable" immediately
 	atomic.StoreInt32(&self.state, SHUTTING_DOWN)
-	relog.Info("Stopping query service: %d", self.sessionId)
+	relog.Info("Stopping query service: %d", self.SessionId())
+	// The invalidator, the cache warmer and the verifier need the lock below
+	self.invalidator.Close()
+	self.cacheWarmer.Close()
+	self.cacheVerifier.Close()
 	self.activeTxPool.WaitForEmpty()
 
 	self.mu.Lock()
@@ -148,13 +343,88 @@ func (self *SqlQuery) disallowQueries() {
 	self.txPool.Close()
 	self.reservedPool.Close()
 	self.connPool.Close()
-	self.sessionId = 0
+	self.opened = false
+	self.superConnFactory = nil
+	atomic.StoreInt64(&self.sessionId, 0)
+	self.callers.reset()
+}
+
+func (self *SqlQuery) SessionId() int64 {
+	return atomic.LoadInt64(&self.sessionId)
+}
+
+// CallerSessionId returns the session id that identifies caller,
+// or the anonymous one if caller is empty.
+func (self *SqlQuery) CallerSessionId(caller string) int64 {
+	sessionId := self.SessionId()
+	if caller == "" || sessionId == 0 {
+		return sessionId
+	}
+	return self.callers.sessionId(caller)
+}
+
+// validSession returns true if sessionId is the anonymous session id,
+// or one of the caller session ids.
+func (self *SqlQuery) validSession(sessionId int64) bool {
+	if sessionId == self.SessionId() {
+		return true
+	}
+	_, ok := self.callers.caller(sessionId)
+	return ok
+}
+
+// checkRules panics if the query matches a query rule.
+func (self *SqlQuery) checkRules(query *Query, plan *sqlparser.ExecPlan) {
+	if qr := self.queryRuleInfo.GetRules().getAction(query.Sql, query.BindVariables, plan); qr != nil {
+		ruleHitStats.Add(qr.Name, 1)
+		panic(NewTabletError(qr.errorType, "Query disallowed due to rule: %s", qr.Name))
+	}
+}
+
+// checkPlanAccess panics if the caller of sessionId is not allowed
+// to execute plan. The table a DML changes needs write access, and
+// all the other tables of the statement need read access. Changing
+// a vt_* setting affects every table, so it needs admin access to all.
+func (self *SqlQuery) checkPlanAccess(sessionId int64, plan *sqlparser.ExecPlan) {
+	if plan.PlanId == sqlparser.PLAN_SET && strings.HasPrefix(plan.SetKey, "vt_") {
+		caller, _ := self.callers.caller(sessionId)
+		if self.tableAclInfo.GetAcl().globalAccess(caller) < ACL_ADMIN {
+			aclDeniedStats.Add(plan.SetKey, 1)
+			relog.Warning("Table ACL: caller %q denied setting %s", caller, plan.SetKey)
+			panic(NewTabletError(FAIL, "Table ACL: admin access to %s denied", plan.SetKey))
+		}
+		return
+	}
+	level := planAccess(plan.PlanId)
+	for i, tableName := range plan.TableNames {
+		if i == 0 {
+			self.checkAccess(sessionId, tableName, level)
+		} else {
+			self.checkAccess(sessionId, tableName, ACL_READ)
+		}
+	}
+}
+
+// checkAccess panics if the caller of sessionId is not allowed
+// to access tableName at the given level.
+func (self *SqlQuery) checkAccess(sessionId int64, tableName string, level int) {
+	if level == ACL_NONE {
+		return
+	}
+	caller, _ := self.callers.caller(sessionId)
+	if self.tableAclInfo.GetAcl().access(caller, tableName) >= level {
+		return
+	}
+	aclDeniedStats.Add(tableName, 1)
+	relog.Warning("Table ACL: caller %q denied %s access to %s", caller, aclNames[level], tableName)
+	panic(NewTabletError(FAIL, "Table ACL: %s access to %s denied", aclNames[level], tableName))
 }
 
 func (self *SqlQuery) checkState(sessionId int64, allowShutdown bool) {
 	switch atomic.LoadInt32(&self.state) {
 	case INIT_FAILED:
-		panic(NewTabletError(FATAL, "init failed"))
+		// allowQueries is being retried in the background
+		panic(NewTabletError(RETRY, "unavailable: waiting for mysql"))
 	case CLOSED:
 		panic(NewTabletError(RETRY, "unavailable"))
 	case SHUTTING_DOWN:
@@ -162,7 +432,7 @@ func (self *SqlQuery) checkState(sessionId int64, allowShutdown bool) {
 			panic(NewTabletError(RETRY, "unavailable"))
 		}
 	}
-	if sessionId != self.sessionId {
+	if !self.validSession(sessionId) {
 		panic(NewTabletError(RETRY, "Invalid session Id %v", sessionId))
 	}
 }
@@ -176,6 +446,25 @@ func (self *SqlQuery) reloadSchema() {
 	self.schemaInfo.Reload()
 }
 
+// changeTunable is setTunable for callers outside of a query. The
+// setting is left alone if it already has value, or if the query
+// service is not open. It panics if key is unknown.
+func (self *SqlQuery) changeTunable(key string, value float64) (changed, open bool) {
+	if atomic.LoadInt32(&self.state) != OPEN {
+		return false, false
+	}
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	current, ok := self.getTunable(key)
+	if !ok {
+		panic(NewTabletError(FAIL, "unknown variable %s", key))
+	}
+	if current == value {
+		return false, true
+	}
+	return self.setTunable(key, value), true
+}
+
 type DBResultRow []interface{}
 
 func (self DBResultRow) Size() int {
@@ -226,6 +515,26 @@ func (self *SqlQuery) Rollback(session *Session, noOutput *string) (err error) {
 	return nil
 }
 
+func (self *SqlQuery) Savepoint(savepoint *Savepoint, noOutput *string) (err error) {
+	defer handleError(&err)
+	self.checkState(savepoint.SessionId, true)
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	*noOutput = ""
+	self.activeTxPool.Savepoint(savepoint.TransactionId, savepoint.Name)
+	return nil
+}
+
+func (self *SqlQuery) RollbackToSavepoint(savepoint *Savepoint, noOutput *string) (err error) {
+	defer handleError(&err)
+	self.checkState(savepoint.SessionId, true)
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	*noOutput = ""
+	self.activeTxPool.RollbackToSavepoint(savepoint.TransactionId, savepoint.Name)
+	return nil
+}
+
 func (self *SqlQuery) CreateReserved(session *Session, connectionId *int64) (err error) {
 	defer handleError(&err)
 	self.checkState(session.SessionId, false)
@@ -246,8 +555,18 @@ func (self *SqlQuery) CloseReserved(session *Session, noOutput *string) (err err
 }
 
 func (self *SqlQuery) Execute(query *Query, reply *QueryResult) (err error) {
+	var plan *CompiledPlan
+	mustCache := false
+	start := time.Now()
 	defer func() {
-		if x := recover(); x != nil {
+		x := recover()
+		if plan != nil && mustCache {
+			self.schemaInfo.AddQueryStats(query.Sql, time.Now().Sub(start), plan.MysqlTime, plan.WaitTime, int64(reply.RowsAffected), x != nil)
+		}
+		logStats := newSqlQueryStats(query, plan, start, reply.RowsAffected, x)
+		SqlQueryLogger.Send(logStats)
+		self.slowQueryLog.logQuery(logStats, plan)
+		if x != nil {
 			terr := x.(*TabletError)
 			err = terr
 			terr.RecordStats()
@@ -269,14 +588,24 @@ func (self *SqlQuery) Execute(query *Query, reply *QueryResult) (err error) {
 	}
 	// cheap hack: strip trailing comment into a special bind var
 	stripTrailing(query)
-	basePlan, tableInfo := self.schemaInfo.GetPlan(query.Sql, len(query.BindVariables) != 0)
+	mustCache = len(query.BindVariables) != 0
+	basePlan, tableInfo := self.schemaInfo.GetPlan(query.Sql, mustCache)
 	defer self.schemaInfo.Put(tableInfo)
-	plan := &CompiledPlan{basePlan, tableInfo, query.BindVariables, query.TransactionId, query.ConnectionId}
+	self.checkRules(query, basePlan)
+	self.checkPlanAccess(query.SessionId, basePlan)
+	plan = &CompiledPlan{ExecPlan: basePlan, TableInfo: tableInfo, BindVars: query.BindVariables, TransactionId: query.TransactionId, ConnectionId: query.ConnectionId, Timeout: time.Duration(query.Timeout)}
+	defer plan.releaseResults(self.resultBudget)
+	// Checked once before any work: DMLs can't fail midway
+	// after some of their batches were applied.
+	if plan.PlanId.IsSelect() {
+		self.resultBudget.Check()
+	}
 
 	// Need upfront connection for DMLs and transactions
 	if query.TransactionId != 0 {
 		conn := self.activeTxPool.Get(query.TransactionId)
 		defer conn.Recycle()
+		conn.RecordQuery(query.Sql, plan.NormalizedQuery)
 		var invalidator CacheInvalidator
 		if tableInfo != nil && tableInfo.CacheType != 0 {
 			invalidator = conn.DirtyKeys(plan.TableName)
@@ -284,7 +613,7 @@ func (self *SqlQuery) Execute(query *Query, reply *QueryResult) (err error) {
 		switch plan.PlanId {
 		case sqlparser.PLAN_PASS_DML:
 			defer queryStats.Record("PASS_DML", time.Now())
-			*reply = *self.directFetch(conn, plan.FullQuery, plan.BindVars, nil, nil)
+			*reply = *self.directFetch(conn, plan, plan.FullQuery, nil, nil)
 		case sqlparser.PLAN_INSERT_PK:
 			defer queryStats.Record("PLAN_INSERT_PK", time.Now())
 			*reply = *self.execInsertPK(conn, plan, invalidator)
@@ -297,9 +626,15 @@ func (self *SqlQuery) Execute(query *Query, reply *QueryResult) (err error) {
 		case sqlparser.PLAN_DML_SUBQUERY:
 			defer queryStats.Record("DML_SUBQUERY", time.Now())
 			*reply = *self.execDMLSubquery(conn, plan, invalidator)
+		case sqlparser.PLAN_SAVEPOINT:
+			defer queryStats.Record("SAVEPOINT", time.Now())
+			conn.Savepoint(plan.SavepointName)
+		case sqlparser.PLAN_ROLLBACK_SAVEPOINT:
+			defer queryStats.Record("ROLLBACK_SAVEPOINT", time.Now())
+			conn.RollbackToSavepoint(plan.SavepointName)
 		default: // select or set in a transaction, just count as select
 			defer queryStats.Record("PASS_SELECT", time.Now())
-			*reply = *self.directFetch(conn, plan.FullQuery, plan.BindVars, nil, nil)
+			*reply = *self.directFetch(conn, plan, plan.FullQuery, nil, nil)
 		}
 	} else {
 		switch plan.PlanId {
@@ -321,6 +656,8 @@ func (self *SqlQuery) Execute(query *Query, reply *QueryResult) (err error) {
 		case sqlparser.PLAN_SET:
 			defer queryStats.Record("SET", time.Now())
 			*reply = *self.execSet(plan)
+		case sqlparser.PLAN_SAVEPOINT, sqlparser.PLAN_ROLLBACK_SAVEPOINT:
+			panic(NewTabletError(FAIL, "Savepoints not allowed outside of transactions"))
 		default:
 			panic(NewTabletError(FAIL, "DMLs not allowed outside of transactions"))
 		}
@@ -331,6 +668,61 @@ func (self *SqlQuery) Execute(query *Query, reply *QueryResult) (err error) {
 	return nil
 }
 
+// StreamExecute executes the query and streams its result.
+// The first QueryResult will have Fields set (and Rows nil).
+// The subsequent QueryResult will have Rows set (and Fields nil).
+func (self *SqlQuery) StreamExecute(query *Query, sendReply func(reply interface{}) error) (err error) {
+	var plan *CompiledPlan
+	start := time.Now()
+	defer func() {
+		x := recover()
+		self.slowQueryLog.logQuery(newSqlQueryStats(query, plan, start, 0, x), plan)
+		if x != nil {
+			terr := x.(*TabletError)
+			err = terr
+			terr.RecordStats()
+			if terr.ErrorType == RETRY || terr.SqlError == DUPLICATE_KEY { // suppress these errors in logs
+				return
+			}
+			relog.Error("%s: %v", terr.Message, query)
+		}
+	}()
+	if query.TransactionId != 0 {
+		panic(NewTabletError(FAIL, "Transactions not supported with streaming"))
+	}
+	self.checkState(query.SessionId, false)
+
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+
+	if query.BindVariables == nil { // will help us avoid repeated nil checks
+		query.BindVariables = make(map[string]interface{})
+	}
+	// cheap hack: strip trailing comment into a special bind var
+	stripTrailing(query)
+	fullQuery, perr := sqlparser.StreamExecParse(query.Sql)
+	if perr != nil {
+		panic(NewTabletError(FAIL, "%s", perr))
+	}
+	basePlan, tableInfo := self.schemaInfo.GetPlan(query.Sql, false)
+	self.schemaInfo.Put(tableInfo)
+	plan = &CompiledPlan{ExecPlan: basePlan, BindVars: query.BindVariables, ConnectionId: query.ConnectionId, Timeout: time.Duration(query.Timeout)}
+	self.checkRules(query, basePlan)
+	self.checkPlanAccess(query.SessionId, basePlan)
+
+	defer queryStats.Record("STREAM", time.Now())
+	var conn PoolConnection
+	if query.ConnectionId != 0 {
+		conn = self.reservedPool.Get(query.ConnectionId)
+	} else {
+		conn = self.connPool.Get()
+	}
+	defer conn.Recycle()
+	sql := self.generateFinalSql(fullQuery, query.BindVariables, nil, nil)
+	self.executeStreamSql(conn, sql, time.Duration(query.Timeout), sendReply)
+	return nil
+}
+
 type QueryList []Query
 
 func (self *SqlQuery) ExecuteBatch(queryList *QueryList, reply *QueryResult) (err error) {
@@ -391,13 +783,15 @@ func (self *SqlQuery) ExecuteBatch(queryList *QueryList, reply *QueryResult) (er
 }
 
 type CacheInvalidate struct {
-	Table string
-	Keys  []interface{}
+	// Dbname can be left empty if vtocc serves only one database
+	Dbname string
+	Table  string
+	Keys   []interface{}
 }
 
 func (self *SqlQuery) Invalidate(cacheInvalidate *CacheInvalidate, noOutput *string) (err error) {
 	defer handleError(&err)
-	self.checkState(self.sessionId, false)
+	self.checkState(self.SessionId(), false)
 	*noOutput = ""
 	self.mu.RLock()
 	defer self.mu.RUnlock()
@@ -416,8 +810,202 @@ func (self *SqlQuery) Invalidate(cacheInvalidate *CacheInvalidate, noOutput *str
 			}
 		}
 		key := buildKey(tableInfo, cacheInvalidate.Keys)
-		tableInfo.RowCache.Delete(key)
+		tableInfo.invalidateRow(key)
+	}
+	return nil
+}
+
+// highestPKs returns up to count pks of tableName, highest first.
+func (self *SqlQuery) highestPKs(tableName string, count int) [][]interface{} {
+	tableInfo, conn := self.getCachedTable(tableName)
+	defer self.mu.RUnlock()
+	defer self.schemaInfo.Put(tableInfo)
+	defer conn.Recycle()
+	pkColumns := tableInfo.Indexes[0].Columns
+	sql := fmt.Sprintf("select %s from %s order by %s desc limit %d",
+		strings.Join(pkColumns, ", "), tableName, strings.Join(pkColumns, " desc, "), count)
+	result, err := conn.ExecuteFetch([]byte(sql), count)
+	if err != nil {
+		panic(NewTabletErrorSql(FAIL, err))
+	}
+	return result.Rows
+}
+
+// warmRows loads the rows of pkRows into the row cache
+// of tableName, and returns how many were found.
+func (self *SqlQuery) warmRows(tableName string, pkRows [][]interface{}) int {
+	tableInfo, conn := self.getCachedTable(tableName)
+	defer self.mu.RUnlock()
+	defer self.schemaInfo.Put(tableInfo)
+	defer conn.Recycle()
+	normalizePKRows(tableInfo, pkRows)
+	result, err := conn.ExecuteFetch(buildWarmQuery(tableInfo, pkRows), len(pkRows))
+	if err != nil {
+		panic(NewTabletErrorSql(FAIL, err))
+	}
+	for _, row := range result.Rows {
+		pkRow := applyFilter(tableInfo.PKColumns, row)
+		tableInfo.RowCache.SetIfAbsent(buildKey(tableInfo, pkRow), DBResultRow(row))
+	}
+	return len(result.Rows)
+}
+
+// verifyRows compares up to sampleSize cached rows of tableName
+// with MySQL, and returns how many were compared, and the mismatches.
+func (self *SqlQuery) verifyRows(tableName string, sampleSize int, evict bool) (checked int, mismatches []*CacheMismatch) {
+	tableInfo, conn := self.getCachedTable(tableName)
+	defer self.mu.RUnlock()
+	defer self.schemaInfo.Put(tableInfo)
+	defer conn.Recycle()
+	cachedRows := make(map[string]DBResultRow)
+	pkRows := make([][]interface{}, 0, sampleSize)
+	for _, key := range tableInfo.RowCache.SampleKeys(sampleSize) {
+		if row, ok := tableInfo.RowCache.Peek(key); ok {
+			cachedRows[key] = row
+			pkRows = append(pkRows, applyFilter(tableInfo.PKColumns, row))
+		}
+	}
+	if len(pkRows) == 0 {
+		return 0, nil
 	}
+	normalizePKRows(tableInfo, pkRows)
+	result, err := conn.ExecuteFetch(buildWarmQuery(tableInfo, pkRows), len(pkRows))
+	if err != nil {
+		panic(NewTabletErrorSql(FAIL, err))
+	}
+	actualRows := make(map[string][]interface{}, len(result.Rows))
+	for _, row := range result.Rows {
+		actualRows[buildKey(tableInfo, applyFilter(tableInfo.PKColumns, row))] = row
+	}
+	for key, cachedRow := range cachedRows {
+		actualRow := actualRows[key]
+		if actualRow != nil && rowsEqual(cachedRow, actualRow) {
+			continue
+		}
+		// Skip rows that were invalidated after they were read
+		if row, ok := tableInfo.RowCache.Peek(key); !ok || !rowsEqual(row, cachedRow) {
+			continue
+		}
+		mismatch := &CacheMismatch{Time: time.Now(), Table: tableName, Key: key, Cached: cachedRow, Actual: actualRow}
+		if evict {
+			mismatch.Evicted = tableInfo.RowCache.Delete(key)
+		}
+		mismatches = append(mismatches, mismatch)
+	}
+	return len(cachedRows), mismatches
+}
+
+// cachedTables returns the names of the tables that have a row cache.
+func (self *SqlQuery) cachedTables() []string {
+	if atomic.LoadInt32(&self.state) != OPEN {
+		return nil
+	}
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	self.schemaInfo.Lock()
+	defer self.schemaInfo.Unlock()
+	tableNames := make([]string, 0, len(self.schemaInfo.Tables))
+	for tableName, tableInfo := range self.schemaInfo.Tables {
+		if tableInfo.RowCache != nil {
+			tableNames = append(tableNames, tableName)
+		}
+	}
+	return tableNames
+}
+
+// getCachedTable returns a cached table and a connection, with mu
+// read-locked. The caller must release all three.
+func (self *SqlQuery) getCachedTable(tableName string) (tableInfo *TableInfo, conn PoolConnection) {
+	self.mu.RLock()
+	if atomic.LoadInt32(&self.state) != OPEN {
+		self.mu.RUnlock()
+		panic(NewTabletError(RETRY, "unavailable"))
+	}
+	tableInfo = self.schemaInfo.GetTable(tableName)
+	if tableInfo == nil || tableInfo.RowCache == nil {
+		self.schemaInfo.Put(tableInfo)
+		self.mu.RUnlock()
+		panic(NewTabletError(FAIL, "table %s is not cached", tableName))
+	}
+	defer func() {
+		if x := recover(); x != nil {
+			self.schemaInfo.Put(tableInfo)
+			self.mu.RUnlock()
+			panic(x)
+		}
+	}()
+	return tableInfo, self.connPool.Get()
+}
+
+// invalidateRows deletes the rows listed by a _stream comment
+// from the row cache. columns are the names of the pk columns.
+func (self *SqlQuery) invalidateRows(tableName string, columns []string, pkValueList [][]interface{}) {
+	if atomic.LoadInt32(&self.state) != OPEN {
+		return
+	}
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	tableInfo := self.schemaInfo.GetTable(tableName)
+	if tableInfo == nil {
+		return
+	}
+	defer self.schemaInfo.Put(tableInfo)
+	if tableInfo.RowCache == nil {
+		return
+	}
+	// Inserts into auto-increment tables don't list the pk:
+	// such rows can't be in the cache.
+	if len(columns) != len(tableInfo.PKColumns) {
+		return
+	}
+	for i, pkColumn := range tableInfo.PKColumns {
+		if tableInfo.Columns[pkColumn] != columns[i] {
+			panic(NewTabletError(FAIL, "pk mismatch for %s: %v", tableName, columns))
+		}
+	}
+	for _, pkValues := range pkValueList {
+		if len(pkValues) != len(columns) {
+			continue
+		}
+		tableInfo.invalidateRow(buildKey(tableInfo, pkValues))
+		invalidationStats.Add(tableName, 1)
+	}
+}
+
+// ExecuteDDL executes a DDL using a super user connection, and
+// updates the schema and the plan cache accordingly.
+func (self *SqlQuery) ExecuteDDL(query *Query, reply *QueryResult) (err error) {
+	defer handleError(&err)
+	self.checkState(query.SessionId, false)
+	ddlPlan := sqlparser.DDLParse(query.Sql)
+	if ddlPlan.Action == 0 {
+		panic(NewTabletError(FAIL, "DDL is not understood: %s", query.Sql))
+	}
+	self.checkRules(query, &sqlparser.ExecPlan{PlanId: sqlparser.PLAN_DDL, TableName: ddlPlan.TableName})
+	self.checkAccess(query.SessionId, ddlPlan.TableName, ACL_ADMIN)
+	if ddlPlan.NewName != "" {
+		self.checkAccess(query.SessionId, ddlPlan.NewName, ACL_ADMIN)
+	}
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	// The schema must be updated in the same order as the DDLs were applied
+	self.ddlMu.Lock()
+	defer self.ddlMu.Unlock()
+
+	if self.superConnFactory == nil {
+		panic(NewTabletError(FAIL, "DDLs are not enabled"))
+	}
+	conn, err := self.superConnFactory()
+	if err != nil {
+		panic(NewTabletErrorSql(FATAL, err))
+	}
+	defer conn.Close()
+	result, err := conn.ExecuteFetch([]byte(query.Sql), int(atomic.LoadInt32(&self.maxResultSize)))
+	if err != nil {
+		panic(NewTabletErrorSql(FAIL, err))
+	}
+	self.schemaInfo.ApplyDDL(ddlPlan)
+	*reply = *result
 	return nil
 }
 
@@ -461,45 +1049,140 @@ func (self *SqlQuery) setRowCache(tableName string, cacheSize uint64) {
 
 func (self *SqlQuery) execPK(plan *CompiledPlan) (result *QueryResult) {
 	pkRows := buildValueList(plan.PKValues, plan.BindVars)
-	return self.fetchPKRows(plan, pkRows)
+	return self.fetchPKRows(plan, plan.ColumnNumbers, pkRows)
 }
 
 func (self *SqlQuery) execSubquery(plan *CompiledPlan) (result *QueryResult) {
+	if indexCache := plan.TableInfo.IndexCaches[plan.IndexUsed]; indexCache != nil && plan.IndexValues != nil {
+		return self.execIndexLookup(plan, indexCache)
+	}
 	innerResult := self.qFetch(plan, plan.Subquery, nil)
-	return self.fetchPKRows(plan, innerResult.Rows)
+	return self.fetchPKRows(plan, plan.ColumnNumbers, innerResult.Rows)
 }
 
-func (self *SqlQuery) fetchPKRows(plan *CompiledPlan, pkRows [][]interface{}) (result *QueryResult) {
-	result = &QueryResult{}
+// execIndexLookup runs a subquery on a unique index. If all the values
+// are in the index cache, their rows are fetched by pk. Otherwise, the
+// subquery is run, and the index cache filled with its rows.
+func (self *SqlQuery) execIndexLookup(plan *CompiledPlan, indexCache *IndexCache) (result *QueryResult) {
 	tableInfo := plan.TableInfo
-	result.Fields = applyFieldFilter(plan.ColumnNumbers, tableInfo.Fields)
-	normalizePKRows(plan.TableInfo, pkRows)
+	allColumns := make([]int, len(tableInfo.Columns))
+	for i := range allColumns {
+		allColumns[i] = i
+	}
+	indexRows := buildValueList(plan.IndexValues, plan.BindVars)
+	normalizeRows(tableInfo, indexCache.Columns, indexRows)
+	if pkRows, keys := indexCache.Lookup(tableInfo, indexRows); pkRows != nil {
+		result = self.fetchPKRows(plan, allColumns, pkRows)
+		if !indexCache.Verify(tableInfo, keys, result.Rows) {
+			result = nil
+		}
+	}
+	if result == nil {
+		innerResult := self.qFetch(plan, plan.Subquery, nil)
+		result = self.fetchPKRows(plan, allColumns, innerResult.Rows)
+		indexCache.Fill(tableInfo, result.Rows)
+	}
+	result.Fields = applyFieldFilter(plan.ColumnNumbers, result.Fields)
+	for i, row := range result.Rows {
+		result.Rows[i] = applyFilter(plan.ColumnNumbers, row)
+	}
+	return result
+}
+
+// fetchPKRows returns the columnNumbers of the rows for pkRows, in the
+// same order. Row cache misses are fetched from MySQL in batches.
+func (self *SqlQuery) fetchPKRows(plan *CompiledPlan, columnNumbers []int, pkRows [][]interface{}) (result *QueryResult) {
+	result, hits := fetchRowsByPK(plan.TableInfo, columnNumbers, pkRows, self.pkBatchSize(), func(pkRows [][]interface{}) *QueryResult {
+		return self.qFetch(plan, plan.OuterQuery, []interface{}{buildPKList(plan.TableInfo, pkRows)})
+	})
+	plan.cacheHits += hits
+	plan.cacheMisses += len(pkRows) - hits
+	return result
+}
+
+// pkBatchSize is the number of rows fetched by one outer query.
+// It's capped by maxResultSize for the fetch not to fail.
+func (self *SqlQuery) pkBatchSize() int {
+	if maxResultSize := int(atomic.LoadInt32(&self.maxResultSize)); maxResultSize < PK_BATCH_SIZE {
+		return maxResultSize
+	}
+	return PK_BATCH_SIZE
+}
+
+// fetchRowsByPK also returns the number of rows found in the row cache.
+func fetchRowsByPK(tableInfo *TableInfo, columnNumbers []int, pkRows [][]interface{}, batchSize int, fetch func(pkRows [][]interface{}) *QueryResult) (result *QueryResult, hits int) {
+	result = &QueryResult{}
+	result.Fields = applyFieldFilter(columnNumbers, tableInfo.Fields)
+	normalizePKRows(tableInfo, pkRows)
+	// rows has a slot for every pk. The slots of misses are
+	// filled after the fetch, and dropped if the row doesn't exist.
+	rows := make([][]interface{}, len(pkRows))
+	missing := make(map[string][]int)
 	notFoundRows := make([][]interface{}, 0, len(pkRows))
-	rows := make([][]interface{}, 0, len(pkRows))
-	for _, pk := range pkRows {
+	for i, pk := range pkRows {
 		key := buildKey(tableInfo, pk)
 		if cacheRow, ok := tableInfo.RowCache.Get(key); ok {
-			rows = append(rows, applyFilter(plan.ColumnNumbers, cacheRow.(DBResultRow)))
-		} else {
+			rows[i] = applyFilter(columnNumbers, cacheRow)
+			hits++
+			continue
+		}
+		if _, ok := missing[key]; !ok {
 			notFoundRows = append(notFoundRows, pk)
 		}
+		missing[key] = append(missing[key], i)
 	}
-	atomic.AddInt64(&tableInfo.hits, int64(len(rows)))
-	if len(notFoundRows) != 0 {
-		atomic.AddInt64(&tableInfo.misses, int64(len(notFoundRows)))
-		for _, notFoundRow := range notFoundRows {
-			resultFromdb := self.qFetch(plan, plan.OuterQuery, notFoundRow)
-			for _, row := range resultFromdb.Rows {
-				pkRow := applyFilter(tableInfo.PKColumns, row)
-				key := buildKey(tableInfo, pkRow)
-				tableInfo.RowCache.SetIfAbsent(key, DBResultRow(row))
-				rows = append(rows, applyFilter(plan.ColumnNumbers, row))
+	atomic.AddInt64(&tableInfo.hits, int64(hits))
+	atomic.AddInt64(&tableInfo.misses, int64(len(pkRows)-hits))
+
+	// MySQL can return a pk that doesn't encode like the one
+	// requested, like with case insensitive collations. Such rows
+	// are returned at the end.
+	var unmatchedRows [][]interface{}
+	for start := 0; start < len(notFoundRows); start += batchSize {
+		end := start + batchSize
+		if end > len(notFoundRows) {
+			end = len(notFoundRows)
+		}
+		resultFromdb := fetch(notFoundRows[start:end])
+		for _, row := range resultFromdb.Rows {
+			pkRow := applyFilter(tableInfo.PKColumns, row)
+			key := buildKey(tableInfo, pkRow)
+			tableInfo.RowCache.SetIfAbsent(key, DBResultRow(row))
+			filteredRow := applyFilter(columnNumbers, row)
+			slots, ok := missing[key]
+			if !ok {
+				unmatchedRows = append(unmatchedRows, filteredRow)
+				continue
+			}
+			for _, slot := range slots {
+				rows[slot] = filteredRow
 			}
 		}
 	}
+	count := 0
+	for _, row := range rows {
+		if row != nil {
+			rows[count] = row
+			count++
+		}
+	}
+	rows = append(rows[:count], unmatchedRows...)
 	result.RowsAffected = uint64(len(rows))
 	result.Rows = rows
-	return result
+	return result, hits
+}
+
+// buildPKList returns the list variable of the outer query for pkRows:
+// a list of values for single column pks, or a TupleEqualityList.
+func buildPKList(tableInfo *TableInfo, pkRows [][]interface{}) interface{} {
+	if len(pkRows[0]) != 1 {
+		return &sqlparser.TupleEqualityList{Columns: tableInfo.Indexes[0].Columns, Rows: pkRows}
+	}
+	pkList := make([]interface{}, len(pkRows))
+	for i, pkRow := range pkRows {
+		pkList[i] = pkRow[0]
+	}
+	return pkList
 }
 
 func (self *SqlQuery) execCacheResult(plan *CompiledPlan) (result *QueryResult) {
@@ -522,7 +1205,7 @@ func (self *SqlQuery) execInsertPK(conn PoolConnection, plan *CompiledPlan, inva
 }
 
 func (self *SqlQuery) execInsertSubquery(conn PoolConnection, plan *CompiledPlan, invalidator CacheInvalidator) (result *QueryResult) {
-	innerResult := self.directFetch(conn, plan.Subquery, plan.BindVars, nil, nil)
+	innerResult := self.directFetch(conn, plan, plan.Subquery, nil, nil)
 	innerRows := innerResult.Rows
 	if len(innerRows) == 0 {
 		return &QueryResult{RowsAffected: 0}
@@ -542,7 +1225,7 @@ func (self *SqlQuery) execInsertSubquery(conn PoolConnection, plan *CompiledPlan
 func (self *SqlQuery) execInsertPKRows(conn PoolConnection, plan *CompiledPlan, pkRows [][]interface{}, invalidator CacheInvalidator) (result *QueryResult) {
 	secondaryList := buildSecondaryList(pkRows, plan.SecondaryPKValues, plan.BindVars)
 	bsc := buildStreamComment(plan.TableInfo, pkRows, secondaryList)
-	result = self.directFetch(conn, plan.OuterQuery, plan.BindVars, nil, bsc)
+	result = self.directFetch(conn, plan, plan.OuterQuery, nil, bsc)
 	if invalidator != nil && secondaryList != nil {
 		for _, pk := range secondaryList {
 			key := buildKey(plan.TableInfo, pk)
@@ -557,7 +1240,7 @@ func (self *SqlQuery) execDMLPK(conn PoolConnection, plan *CompiledPlan, invalid
 	normalizePKRows(plan.TableInfo, pkRows)
 	secondaryList := buildSecondaryList(pkRows, plan.SecondaryPKValues, plan.BindVars)
 	bsc := buildStreamComment(plan.TableInfo, pkRows, secondaryList)
-	result = self.directFetch(conn, plan.OuterQuery, plan.BindVars, nil, bsc)
+	result = self.directFetch(conn, plan, plan.OuterQuery, nil, bsc)
 	if invalidator != nil {
 		for _, pk := range pkRows {
 			key := buildKey(plan.TableInfo, pk)
@@ -568,79 +1251,181 @@ func (self *SqlQuery) execDMLPK(conn PoolConnection, plan *CompiledPlan, invalid
 }
 
 func (self *SqlQuery) execDMLSubquery(conn PoolConnection, plan *CompiledPlan, invalidator CacheInvalidator) (result *QueryResult) {
-	innerResult := self.directFetch(conn, plan.Subquery, plan.BindVars, nil, nil)
+	innerResult := self.directFetch(conn, plan, plan.Subquery, nil, nil)
 	return self.execDMLPKRows(conn, plan, innerResult.Rows, invalidator)
 }
 
+// execDMLPKRows applies the DML to pkRows in batches of dmlBatchSize rows.
 func (self *SqlQuery) execDMLPKRows(conn PoolConnection, plan *CompiledPlan, pkRows [][]interface{}, invalidator CacheInvalidator) (result *QueryResult) {
 	if len(pkRows) == 0 {
 		return &QueryResult{RowsAffected: 0}
 	}
 	normalizePKRows(plan.TableInfo, pkRows)
+	batchSize := int(atomic.LoadInt32(&self.dmlBatchSize))
 	rowsAffected := uint64(0)
-	singleRow := make([][]interface{}, 1)
-	for _, pkRow := range pkRows {
-		singleRow[0] = pkRow
-		secondaryList := buildSecondaryList(singleRow, plan.SecondaryPKValues, plan.BindVars)
-		bsc := buildStreamComment(plan.TableInfo, singleRow, secondaryList)
-		rowsAffected += self.directFetch(conn, plan.OuterQuery, plan.BindVars, pkRow, bsc).RowsAffected
+	for start := 0; start < len(pkRows); start += batchSize {
+		end := start + batchSize
+		if end > len(pkRows) {
+			end = len(pkRows)
+		}
+		batch := pkRows[start:end]
+		secondaryList := buildSecondaryList(batch, plan.SecondaryPKValues, plan.BindVars)
+		bsc := buildStreamComment(plan.TableInfo, batch, secondaryList)
+		rowsAffected += self.directFetch(conn, plan, plan.OuterQuery, []interface{}{buildPKList(plan.TableInfo, batch)}, bsc).RowsAffected
 		if invalidator != nil {
-			key := buildKey(plan.TableInfo, pkRow)
-			invalidator.Delete(key)
+			for _, pkRow := range batch {
+				key := buildKey(plan.TableInfo, pkRow)
+				invalidator.Delete(key)
+			}
 		}
 	}
 	return &QueryResult{RowsAffected: rowsAffected}
 }
 
 func (self *SqlQuery) execSet(plan *CompiledPlan) (result *QueryResult) {
-	switch plan.SetKey {
-	case "vt_pool_size":
-		self.connPool.SetCapacity(int(plan.SetValue.(float64)))
+	if self.setTunable(plan.SetKey, plan.SetValue) {
 		return &QueryResult{}
+	}
+	return self.qFetch(plan, plan.FullQuery, nil)
+}
+
+// getTunable returns the current value of the vt_* setting key,
+// and false if key is not one of them.
+func (self *SqlQuery) getTunable(key string) (value float64, ok bool) {
+	switch key {
+	case "vt_pool_size":
+		_, capacity, _, _, _, _ := self.connPool.Stats()
+		return float64(capacity), true
 	case "vt_transaction_cap":
-		self.txPool.SetCapacity(int(plan.SetValue.(float64)))
-		return &QueryResult{}
+		_, capacity, _, _, _, _ := self.txPool.Stats()
+		return float64(capacity), true
+	case "vt_reserved_cap":
+		return float64(self.reservedPool.Capacity()), true
+	case "vt_reserved_idle_timeout":
+		return self.reservedPool.IdleTimeout().Seconds(), true
 	case "vt_transaction_timeout":
-		self.activeTxPool.SetTimeout(time.Duration(plan.SetValue.(float64) * 1e9))
-		return &QueryResult{}
+		return self.activeTxPool.Timeout().Seconds(), true
 	case "vt_query_cache_size":
-		self.schemaInfo.SetQueryCacheSize(int(plan.SetValue.(float64)))
-		return &QueryResult{}
+		return float64(self.schemaInfo.QueryCacheSize), true
 	case "vt_schema_reload_time":
-		self.schemaInfo.SetSchemaReloadTime(time.Duration(plan.SetValue.(float64) * 1e9))
-		return &QueryResult{}
+		return self.schemaInfo.SchemaReloadTime.Seconds(), true
+	case "vt_max_result_size":
+		return float64(atomic.LoadInt32(&self.maxResultSize)), true
+	case "vt_stream_buffer_size":
+		return float64(atomic.LoadInt32(&self.streamBufferSize)), true
+	case "vt_dml_batch_size":
+		return float64(atomic.LoadInt32(&self.dmlBatchSize)), true
+	case "vt_result_budget":
+		return float64(self.resultBudget.Capacity()), true
+	case "vt_query_timeout":
+		return self.activePool.Timeout().Seconds(), true
+	case "vt_slow_query_threshold":
+		return self.slowQueryLog.Threshold().Seconds(), true
+	case "vt_slow_query_sample_rate":
+		return self.slowQueryLog.SampleRate(), true
+	case "vt_idle_timeout":
+		_, _, _, _, _, idleTimeout := self.connPool.Stats()
+		return idleTimeout.Seconds(), true
+	}
+	return 0, false
+}
+
+// setTunable changes the vt_* setting key to value, and returns
+// false if key is not one of them.
+func (self *SqlQuery) setTunable(key string, value interface{}) bool {
+	switch key {
+	case "vt_pool_size":
+		self.connPool.SetCapacity(int(value.(float64)))
+		return true
+	case "vt_transaction_cap":
+		self.txPool.SetCapacity(int(value.(float64)))
+		return true
+	case "vt_reserved_cap":
+		self.reservedPool.SetCapacity(int(value.(float64)))
+		return true
+	case "vt_reserved_idle_timeout":
+		self.reservedPool.SetIdleTimeout(time.Duration(value.(float64) * 1e9))
+		return true
+	case "vt_transaction_timeout":
+		self.activeTxPool.SetTimeout(time.Duration(value.(float64) * 1e9))
+		return true
+	case "vt_query_cache_size":
+		self.schemaInfo.SetQueryCacheSize(int(value.(float64)))
+		return true
+	case "vt_schema_reload_time":
+		self.schemaInfo.SetSchemaReloadTime(time.Duration(value.(float64) * 1e9))
+		return true
 	case "vt_max_result_size":
-		val := int32(plan.SetValue.(float64))
+		val := int32(value.(float64))
 		if val < 1 {
 			panic(NewTabletError(FAIL, "max result size out of range %v", val))
 		}
 		atomic.StoreInt32(&self.maxResultSize, val)
-		return &QueryResult{}
+		return true
+	case "vt_stream_buffer_size":
+		val := int32(value.(float64))
+		if val < 1024 {
+			panic(NewTabletError(FAIL, "stream buffer size out of range %v", val))
+		}
+		atomic.StoreInt32(&self.streamBufferSize, val)
+		return true
+	case "vt_dml_batch_size":
+		val := int32(value.(float64))
+		if val < 1 {
+			panic(NewTabletError(FAIL, "dml batch size out of range %v", val))
+		}
+		atomic.StoreInt32(&self.dmlBatchSize, val)
+		return true
+	case "vt_result_budget":
+		val := int64(value.(float64))
+		if val < 0 {
+			panic(NewTabletError(FAIL, "result budget out of range %v", val))
+		}
+		self.resultBudget.SetCapacity(val)
+		return true
 	case "vt_query_timeout":
-		self.activePool.SetTimeout(time.Duration(plan.SetValue.(float64) * 1e9))
-		return &QueryResult{}
+		self.activePool.SetTimeout(time.Duration(value.(float64) * 1e9))
+		return true
+	case "vt_slow_query_threshold":
+		self.slowQueryLog.SetThreshold(time.Duration(value.(float64) * 1e9))
+		return true
+	case "vt_slow_query_sample_rate":
+		self.slowQueryLog.SetSampleRate(value.(float64))
+		return true
 	case "vt_idle_timeout":
-		self.connPool.SetIdleTimeout(time.Duration(plan.SetValue.(float64) * 1e9))
-		self.txPool.SetIdleTimeout(time.Duration(plan.SetValue.(float64) * 1e9))
-		self.activePool.SetIdleTimeout(time.Duration(plan.SetValue.(float64) * 1e9))
-		return &QueryResult{}
+		self.connPool.SetIdleTimeout(time.Duration(value.(float64) * 1e9))
+		self.txPool.SetIdleTimeout(time.Duration(value.(float64) * 1e9))
+		self.activePool.SetIdleTimeout(time.Duration(value.(float64) * 1e9))
+		return true
 	}
-	return self.qFetch(plan, plan.FullQuery, nil)
+	return false
 }
 
 func (self *SqlQuery) qFetch(plan *CompiledPlan, parsed_query *sqlparser.ParsedQuery, listVars []interface{}) (result *QueryResult) {
 	sql := self.generateFinalSql(parsed_query, plan.BindVars, listVars, nil)
+	plan.rewrittenSqls = append(plan.rewrittenSqls, string(sql))
+	if plan.Timeout != 0 {
+		// A query with its own timeout can get killed early. It must
+		// not be consolidated, or the other callers would fail with it.
+		q := &Result{refs: 1}
+		plan.holdResult(q)
+		result, err := self.readWithRetry(plan, sql)
+		if err != nil {
+			panic(err)
+		}
+		q.size = resultSize(result)
+		self.resultBudget.Reserve(q.size)
+		return result
+	}
 	q, ok := self.consolidator.Create(string(sql))
+	plan.holdResult(q)
 	if ok {
-		var conn PoolConnection
-		if plan.ConnectionId != 0 {
-			conn = self.reservedPool.Get(plan.ConnectionId)
-		} else {
-			conn = self.connPool.Get()
-		}
-		defer conn.Recycle()
 		var err *TabletError
-		result, err = self.executeSql(conn, sql)
+		result, err = self.readWithRetry(plan, sql)
+		if result != nil {
+			q.size = resultSize(result)
+			self.resultBudget.Reserve(q.size)
+		}
 		q.Result = result
 		q.Err = err
 		q.Broadcast()
@@ -648,7 +1433,11 @@ func (self *SqlQuery) qFetch(plan *CompiledPlan, parsed_query *sqlparser.ParsedQ
 			panic(err)
 		}
 	} else {
+		waitStart := time.Now()
 		q.Wait()
+		waitTime := time.Now().Sub(waitStart)
+		plan.WaitTime += waitTime
+		plan.consolidatorWaitTime += waitTime
 		if q.Err != nil {
 			panic(q.Err)
 		}
@@ -657,12 +1446,50 @@ func (self *SqlQuery) qFetch(plan *CompiledPlan, parsed_query *sqlparser.ParsedQ
 	return result
 }
 
-func (self *SqlQuery) directFetch(conn PoolConnection, parsed_query *sqlparser.ParsedQuery, bindVars map[string]interface{}, listVars []interface{}, buildStreamComment []byte) (result *QueryResult) {
-	sql := self.generateFinalSql(parsed_query, bindVars, listVars, buildStreamComment)
-	result, err := self.executeSql(conn, sql)
+// readWithRetry executes a read. If the connection to MySQL was
+// lost, the read is retried once on a new connection, since MySQL
+// may have been restarted.
+func (self *SqlQuery) readWithRetry(plan *CompiledPlan, sql []byte) (result *QueryResult, err *TabletError) {
+	// Errors must be returned for the consolidator to broadcast them
+	defer func() {
+		if x := recover(); x != nil {
+			err = x.(*TabletError)
+		}
+	}()
+	for attempt := 1; ; attempt++ {
+		waitStart := time.Now()
+		var conn PoolConnection
+		if plan.ConnectionId != 0 {
+			conn = self.reservedPool.Get(plan.ConnectionId)
+		} else {
+			conn = self.connPool.Get()
+		}
+		waitTime := time.Now().Sub(waitStart)
+		plan.WaitTime += waitTime
+		plan.poolWaitTime += waitTime
+		result, err = self.executeSql(conn, plan, sql)
+		conn.Recycle()
+		// Killed queries are not RETRY errors.
+		// Reserved connections can't be replaced.
+		if err == nil || attempt > 1 || plan.ConnectionId != 0 || err.ErrorType != RETRY || !err.IsConnectionError() {
+			return result, err
+		}
+		reconnectStats.Add("Query", 1)
+		relog.Warning("Retrying after lost connection: %s", err.Message)
+	}
+	panic("unreachable")
+}
+
+func (self *SqlQuery) directFetch(conn PoolConnection, plan *CompiledPlan, parsed_query *sqlparser.ParsedQuery, listVars []interface{}, buildStreamComment []byte) (result *QueryResult) {
+	sql := self.generateFinalSql(parsed_query, plan.BindVars, listVars, buildStreamComment)
+	plan.rewrittenSqls = append(plan.rewrittenSqls, string(sql))
+	result, err := self.executeSql(conn, plan, sql)
 	if err != nil {
 		panic(err)
 	}
+	r := &Result{Result: result, size: resultSize(result), refs: 1}
+	self.resultBudget.Reserve(r.size)
+	plan.holdResult(r)
 	return result
 }
 
@@ -680,17 +1507,50 @@ func (self *SqlQuery) generateFinalSql(parsed_query *sqlparser.ParsedQuery, bind
 	return sql
 }
 
-func (self *SqlQuery) executeSql(conn PoolConnection, sql []byte) (*QueryResult, *TabletError) {
+func (self *SqlQuery) executeSql(conn PoolConnection, plan *CompiledPlan, sql []byte) (*QueryResult, *TabletError) {
 	connid := conn.Id()
-	self.activePool.Put(connid)
-	defer self.activePool.Remove(connid)
+	aq := self.activePool.Put(connid, plan.Timeout)
+	defer self.activePool.Remove(aq)
+	start := time.Now()
 	result, err := conn.ExecuteFetch(sql, int(atomic.LoadInt32(&self.maxResultSize)))
+	plan.MysqlTime += time.Now().Sub(start)
 	if err != nil {
-		return nil, NewTabletErrorSql(FAIL, err)
+		return nil, queryError(aq, err)
 	}
 	return result, nil
 }
 
+func (self *SqlQuery) executeStreamSql(conn PoolConnection, sql []byte, timeout time.Duration, sendReply func(reply interface{}) error) {
+	connid := conn.Id()
+	aq := self.activePool.Put(connid, timeout)
+	defer self.activePool.Remove(aq)
+	callback := func(qr *QueryResult) error {
+		err := sendReply(qr)
+		if err != nil {
+			// The client is gone. Kill the connection for MySQL
+			// to stop sending the rows that are left.
+			self.activePool.KillConnection(connid)
+		}
+		return err
+	}
+	if err := conn.ExecuteStreamFetch(sql, callback, int(atomic.LoadInt32(&self.streamBufferSize))); err != nil {
+		panic(queryError(aq, err))
+	}
+}
+
+// queryError makes it clear to the client if the query
+// failed because it was killed for exceeding its timeout.
+// Otherwise, losing the connection to MySQL is a RETRY error.
+func queryError(aq *ActiveQuery, err error) *TabletError {
+	terr := NewTabletErrorSql(FAIL, err)
+	if aq.IsKilled() {
+		terr.Message = fmt.Sprintf("Query killed: timeout exceeded: %s", terr.Message)
+	} else if terr.IsConnectionError() {
+		terr.ErrorType = RETRY
+	}
+	return terr
+}
+
 func (self *SqlQuery) statsJSON() string {
 	self.mu.RLock()
 	defer self.mu.RUnlock()
@@ -707,6 +1567,12 @@ func (self *SqlQuery) statsJSON() string {
 	fmt.Fprintf(buf, "\n \"ActiveTxPool\": %v,", self.activeTxPool.StatsJSON())
 	fmt.Fprintf(buf, "\n \"ActivePool\": %v,", self.activePool.StatsJSON())
 	fmt.Fprintf(buf, "\n \"MaxResultSize\": %v,", atomic.LoadInt32(&self.maxResultSize))
+	fmt.Fprintf(buf, "\n \"StreamBufferSize\": %v,", atomic.LoadInt32(&self.streamBufferSize))
+	fmt.Fprintf(buf, "\n \"DMLBatchSize\": %v,", atomic.LoadInt32(&self.dmlBatchSize))
+	fmt.Fprintf(buf, "\n \"ResultBudget\": %v,", self.resultBudget.StatsJSON())
+	fmt.Fprintf(buf, "\n \"SlowQueryLog\": %v,", self.slowQueryLog.StatsJSON())
+	fmt.Fprintf(buf, "\n \"Invalidator\": %v,", self.invalidator.StatsJSON())
+	fmt.Fprintf(buf, "\n \"CacheWarmer\": %v,", self.cacheWarmer.StatsJSON())
 	fmt.Fprintf(buf, "\n \"ReservedPool\": %v", self.reservedPool.StatsJSON())
 	fmt.Fprintf(buf, "\n}")
 	return buf.String()
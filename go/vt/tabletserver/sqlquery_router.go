@@ -0,0 +1,185 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tabletserver
+
+import (
+	"sync"
+)
+
+// SqlQueryRouter serves the SqlQuery RPC API for the query services
+// of several databases. Every query service has its own session id,
+// which is what requests are routed by.
+type SqlQueryRouter struct {
+	mu       sync.RWMutex
+	services map[string]*SqlQuery // by dbname
+}
+
+func NewSqlQueryRouter() *SqlQueryRouter {
+	return &SqlQueryRouter{services: make(map[string]*SqlQuery)}
+}
+
+func (self *SqlQueryRouter) add(dbname string, sqlQuery *SqlQuery) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.services[dbname] = sqlQuery
+}
+
+// get returns the query service of dbname, or nil.
+func (self *SqlQueryRouter) get(dbname string) *SqlQuery {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	return self.services[dbname]
+}
+
+// only returns the query service if there's only one, or nil.
+func (self *SqlQueryRouter) only() *SqlQuery {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if len(self.services) != 1 {
+		return nil
+	}
+	for _, sqlQuery := range self.services {
+		return sqlQuery
+	}
+	panic("unreachable")
+}
+
+func (self *SqlQueryRouter) all() []*SqlQuery {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	services := make([]*SqlQuery, 0, len(self.services))
+	for _, sqlQuery := range self.services {
+		services = append(services, sqlQuery)
+	}
+	return services
+}
+
+func (self *SqlQueryRouter) dbnames() []string {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	dbnames := make([]string, 0, len(self.services))
+	for dbname := range self.services {
+		dbnames = append(dbnames, dbname)
+	}
+	return dbnames
+}
+
+func (self *SqlQueryRouter) route(sessionId int64) *SqlQuery {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	for _, sqlQuery := range self.services {
+		if sqlQuery.validSession(sessionId) {
+			return sqlQuery
+		}
+	}
+	panic(NewTabletError(RETRY, "Invalid session Id %v", sessionId))
+}
+
+func (self *SqlQueryRouter) Begin(session *Session, transactionId *int64) (err error) {
+	defer handleError(&err)
+	return self.route(session.SessionId).Begin(session, transactionId)
+}
+
+func (self *SqlQueryRouter) Commit(session *Session, noOutput *string) (err error) {
+	defer handleError(&err)
+	return self.route(session.SessionId).Commit(session, noOutput)
+}
+
+func (self *SqlQueryRouter) Rollback(session *Session, noOutput *string) (err error) {
+	defer handleError(&err)
+	return self.route(session.SessionId).Rollback(session, noOutput)
+}
+
+func (self *SqlQueryRouter) Savepoint(savepoint *Savepoint, noOutput *string) (err error) {
+	defer handleError(&err)
+	return self.route(savepoint.SessionId).Savepoint(savepoint, noOutput)
+}
+
+func (self *SqlQueryRouter) RollbackToSavepoint(savepoint *Savepoint, noOutput *string) (err error) {
+	defer handleError(&err)
+	return self.route(savepoint.SessionId).RollbackToSavepoint(savepoint, noOutput)
+}
+
+func (self *SqlQueryRouter) CreateReserved(session *Session, connectionId *int64) (err error) {
+	defer handleError(&err)
+	return self.route(session.SessionId).CreateReserved(session, connectionId)
+}
+
+func (self *SqlQueryRouter) CloseReserved(session *Session, noOutput *string) (err error) {
+	defer handleError(&err)
+	return self.route(session.SessionId).CloseReserved(session, noOutput)
+}
+
+func (self *SqlQueryRouter) Execute(query *Query, reply *QueryResult) (err error) {
+	defer handleError(&err)
+	return self.route(query.SessionId).Execute(query, reply)
+}
+
+func (self *SqlQueryRouter) StreamExecute(query *Query, sendReply func(reply interface{}) error) (err error) {
+	defer handleError(&err)
+	return self.route(query.SessionId).StreamExecute(query, sendReply)
+}
+
+func (self *SqlQueryRouter) ExecuteBatch(queryList *QueryList, reply *QueryResult) (err error) {
+	defer handleError(&err)
+	if len(*queryList) == 0 {
+		panic(NewTabletError(FAIL, "Empty query list"))
+	}
+	return self.route((*queryList)[0].SessionId).ExecuteBatch(queryList, reply)
+}
+
+func (self *SqlQueryRouter) ExecuteDDL(query *Query, reply *QueryResult) (err error) {
+	defer handleError(&err)
+	return self.route(query.SessionId).ExecuteDDL(query, reply)
+}
+
+func (self *SqlQueryRouter) Explain(query *Query, reply *QueryPlan) (err error) {
+	defer handleError(&err)
+	return self.route(query.SessionId).Explain(query, reply)
+}
+
+func (self *SqlQueryRouter) Invalidate(cacheInvalidate *CacheInvalidate, noOutput *string) (err error) {
+	defer handleError(&err)
+	sqlQuery := self.get(cacheInvalidate.Dbname)
+	if cacheInvalidate.Dbname == "" {
+		sqlQuery = self.only()
+	}
+	if sqlQuery == nil {
+		panic(NewTabletError(FAIL, "Unknown dbname %#v", cacheInvalidate.Dbname))
+	}
+	return sqlQuery.Invalidate(cacheInvalidate, noOutput)
+}
+
+func (self *SqlQueryRouter) Ping(query *string, reply *string) error {
+	*reply = "pong: " + *query
+	return nil
+}
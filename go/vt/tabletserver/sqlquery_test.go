@@ -0,0 +1,160 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tabletserver
+
+import (
+	"code.google.com/p/vitess/go/mysql"
+	"code.google.com/p/vitess/go/vt/schema"
+	"code.google.com/p/vitess/go/vt/sqlparser"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newPKTable() *TableInfo {
+	tableInfo := &TableInfo{Table: schema.NewTable("t")}
+	tableInfo.AddColumn("id", "int")
+	tableInfo.AddColumn("val", "varchar")
+	tableInfo.AddIndex("PRIMARY").AddColumn("id")
+	tableInfo.PKColumns = []int{0}
+	tableInfo.Fields = []mysql.Field{{Name: "id", Type: 3}, {Name: "val", Type: 253}}
+	tableInfo.RowCache = NewLRURowCache(tableInfo, 1000)
+	return tableInfo
+}
+
+// fakeFetch returns the rows of pkRows that exist, in reverse,
+// and counts round trips.
+type fakeFetch struct {
+	exists    func(id string) bool
+	latency   time.Duration
+	fetches   int
+	batchLens []int
+}
+
+func (self *fakeFetch) fetch(pkRows [][]interface{}) *QueryResult {
+	self.fetches++
+	self.batchLens = append(self.batchLens, len(pkRows))
+	time.Sleep(self.latency)
+	qr := &QueryResult{}
+	for i := len(pkRows) - 1; i >= 0; i-- {
+		id := fmt.Sprintf("%v", pkRows[i][0])
+		if self.exists(id) {
+			qr.Rows = append(qr.Rows, []interface{}{id, "v" + id})
+		}
+	}
+	return qr
+}
+
+func TestFetchRowsByPK(t *testing.T) {
+	tableInfo := newPKTable()
+	tableInfo.RowCache.Set("2,", DBResultRow{"2", "cached"})
+	ff := &fakeFetch{exists: func(id string) bool { return id != "4" }}
+	pkRows := [][]interface{}{{"5"}, {"2"}, {"1"}, {"4"}, {"3"}, {"1"}}
+	qr, hits := fetchRowsByPK(tableInfo, []int{1}, pkRows, 2, ff.fetch)
+
+	want := "[[v5] [cached] [v1] [v3] [v1]]"
+	if got := fmt.Sprintf("%v", qr.Rows); got != want {
+		t.Errorf("want %s, got %s", want, got)
+	}
+	if qr.RowsAffected != 5 {
+		t.Errorf("want 5 rows affected, got %d", qr.RowsAffected)
+	}
+	// 5, 1, 4, 3 are misses
+	if got := fmt.Sprintf("%v", ff.batchLens); got != "[2 2]" {
+		t.Errorf("want batches [2 2], got %s", got)
+	}
+	if hits != 1 || tableInfo.hits != 1 || tableInfo.misses != 5 {
+		t.Errorf("want 1 hit 5 misses, got %d(%d) %d", tableInfo.hits, hits, tableInfo.misses)
+	}
+	if _, ok := tableInfo.RowCache.Get("3,"); !ok {
+		t.Errorf("3 was not cached")
+	}
+
+	ff.fetches = 0
+	qr, _ = fetchRowsByPK(tableInfo, []int{0, 1}, [][]interface{}{{"3"}, {"1"}}, 2, ff.fetch)
+	if ff.fetches != 0 {
+		t.Errorf("want no fetches, got %d", ff.fetches)
+	}
+	if got := fmt.Sprintf("%v", qr.Rows); got != "[[3 v3] [1 v1]]" {
+		t.Errorf("want [[3 v3] [1 v1]], got %s", got)
+	}
+}
+
+func TestBuildPKList(t *testing.T) {
+	tableInfo := newPKTable()
+	if got := fmt.Sprintf("%v", buildPKList(tableInfo, [][]interface{}{{1}, {2}})); got != "[1 2]" {
+		t.Errorf("want [1 2], got %s", got)
+	}
+
+	// Multi-column pks are looked up with equalities, not tuples
+	tableInfo = &TableInfo{Table: schema.NewTable("t")}
+	tableInfo.AddColumn("eid", "int")
+	tableInfo.AddColumn("id", "varchar")
+	pkIndex := tableInfo.AddIndex("PRIMARY")
+	pkIndex.AddColumn("eid")
+	pkIndex.AddColumn("id")
+	tree, err := sqlparser.Parse("select * from t")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	outerQuery := tree.GenerateSelectOuterQuery(pkIndex)
+	sql, err := outerQuery.GenerateQuery(map[string]interface{}{}, []interface{}{buildPKList(tableInfo, [][]interface{}{{1, "a"}, {2, "b"}})})
+	want := "select * from t where (eid = 1 and id = 'a') or (eid = 2 and id = 'b')"
+	if err != nil || string(sql) != want {
+		t.Errorf("want %s, got %s, %v", want, sql, err)
+	}
+}
+
+// benchmarkColdFetch fetches 500 pks with an empty row cache,
+// with a simulated MySQL round trip of 100us.
+func benchmarkColdFetch(b *testing.B, batchSize int) {
+	pkRows := make([][]interface{}, 500)
+	ff := &fakeFetch{exists: func(id string) bool { return true }, latency: 100 * time.Microsecond}
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		tableInfo := newPKTable()
+		for j := range pkRows {
+			pkRows[j] = []interface{}{int64(j)}
+		}
+		b.StartTimer()
+		fetchRowsByPK(tableInfo, []int{0, 1}, pkRows, batchSize, ff.fetch)
+	}
+}
+
+// BenchmarkColdFetchPerPK is the cost of fetching one pk per query.
+func BenchmarkColdFetchPerPK(b *testing.B) {
+	benchmarkColdFetch(b, 1)
+}
+
+func BenchmarkColdFetchBatched(b *testing.B) {
+	benchmarkColdFetch(b, PK_BATCH_SIZE)
+}
@@ -0,0 +1,262 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tabletserver
+
+import (
+	"code.google.com/p/vitess/go/vt/sqlparser"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Access levels. Each one includes the ones before it.
+const (
+	ACL_NONE = iota
+	ACL_READ
+	ACL_WRITE
+	ACL_ADMIN
+)
+
+var aclNames = []string{"none", "read", "write", "admin"}
+
+// planAccess returns the access level needed to execute plans of type planId.
+func planAccess(planId sqlparser.PlanType) int {
+	switch {
+	case planId.IsSelect():
+		return ACL_READ
+	case planId == sqlparser.PLAN_PASS_DML,
+		planId == sqlparser.PLAN_DML_PK,
+		planId == sqlparser.PLAN_DML_SUBQUERY,
+		planId == sqlparser.PLAN_INSERT_PK,
+		planId == sqlparser.PLAN_INSERT_SUBQUERY:
+		return ACL_WRITE
+	}
+	return ACL_NONE
+}
+
+//-----------------------------------------------
+// TableAclInfo holds the current table ACL.
+// The ACL can be replaced at any time while queries are being served.
+type TableAclInfo struct {
+	mu  sync.Mutex
+	acl *TableAcl
+}
+
+func NewTableAclInfo(name string) *TableAclInfo {
+	self := &TableAclInfo{acl: NewTableAcl()}
+	http.Handle(debugPath(name, "table_acl"), self)
+	return self
+}
+
+func (self *TableAclInfo) SetAcl(acl *TableAcl) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.acl = acl
+}
+
+// GetAcl returns the current ACL. A TableAcl is never modified
+// once set, so the returned value can be used without locking.
+func (self *TableAclInfo) GetAcl() *TableAcl {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.acl
+}
+
+// ServeHTTP shows the current ACL. It can only be changed
+// through the SetTableAcl RPC, which is restricted to admins.
+func (self *TableAclInfo) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		http.Error(response, "table ACL is read-only", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := json.MarshalIndent(self.GetAcl(), "", "  ")
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response.Header().Set("Content-Type", "text/plain")
+	response.Write(data)
+	response.Write([]byte("\n"))
+}
+
+//-----------------------------------------------
+// TableAcl is an ordered list of entries. The first entry that
+// matches a table decides who can access it. Tables that match
+// no entry can be accessed by everybody.
+type TableAcl struct {
+	entries []*TableAclEntry
+}
+
+func NewTableAcl() *TableAcl {
+	return &TableAcl{}
+}
+
+func (self *TableAcl) Add(entry *TableAclEntry) error {
+	if err := entry.compile(); err != nil {
+		return err
+	}
+	self.entries = append(self.entries, entry)
+	return nil
+}
+
+func (self *TableAcl) MarshalJSON() ([]byte, error) {
+	if self.entries == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(self.entries)
+}
+
+func (self *TableAcl) UnmarshalJSON(data []byte) (err error) {
+	var entries []*TableAclEntry
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err = entry.compile(); err != nil {
+			return err
+		}
+	}
+	self.entries = entries
+	return nil
+}
+
+// access returns the access level of caller to tableName.
+func (self *TableAcl) access(caller, tableName string) int {
+	for _, entry := range self.entries {
+		if entry.matches(tableName) {
+			return entry.access(caller)
+		}
+	}
+	return ACL_ADMIN
+}
+
+// globalAccess returns the access level caller has on every table,
+// which is what the settings of the whole service require.
+func (self *TableAcl) globalAccess(caller string) int {
+	level := ACL_ADMIN
+	for _, entry := range self.entries {
+		if access := entry.access(caller); access < level {
+			level = access
+		}
+	}
+	return level
+}
+
+//-----------------------------------------------
+// TableAclEntry grants access to the tables that match Table, which
+// is either a table name, or a prefix followed by "*". Readers, Writers
+// and Admins are the callers that have the corresponding access.
+// "*" in any of them stands for every caller, including those
+// that didn't identify themselves.
+type TableAclEntry struct {
+	Table   string
+	Readers []string
+	Writers []string
+	Admins  []string
+}
+
+func (self *TableAclEntry) compile() error {
+	if self.Table == "" {
+		return fmt.Errorf("Table ACL entry has no table")
+	}
+	if i := strings.Index(self.Table, "*"); i != -1 && i != len(self.Table)-1 {
+		return fmt.Errorf("Table ACL entry %s: * is only allowed at the end", self.Table)
+	}
+	return nil
+}
+
+func (self *TableAclEntry) matches(tableName string) bool {
+	if strings.HasSuffix(self.Table, "*") {
+		return strings.HasPrefix(tableName, self.Table[:len(self.Table)-1])
+	}
+	return tableName == self.Table
+}
+
+func (self *TableAclEntry) access(caller string) int {
+	switch {
+	case callerMatches(caller, self.Admins):
+		return ACL_ADMIN
+	case callerMatches(caller, self.Writers):
+		return ACL_WRITE
+	case callerMatches(caller, self.Readers):
+		return ACL_READ
+	}
+	return ACL_NONE
+}
+
+func callerMatches(caller string, callers []string) bool {
+	for _, name := range callers {
+		if name == "*" || (name == caller && caller != "") {
+			return true
+		}
+	}
+	return false
+}
+
+//-----------------------------------------------
+// callerSessions hands out one session id per identified caller,
+// which is how requests are attributed to them. The ids are only
+// valid until the next reset.
+type callerSessions struct {
+	mu       sync.Mutex
+	callers  map[int64]string
+	sessions map[string]int64
+}
+
+func (self *callerSessions) reset() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.callers = make(map[int64]string)
+	self.sessions = make(map[string]int64)
+}
+
+func (self *callerSessions) sessionId(caller string) int64 {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if sessionId, ok := self.sessions[caller]; ok {
+		return sessionId
+	}
+	sessionId := Rand()
+	self.callers[sessionId] = caller
+	self.sessions[caller] = sessionId
+	return sessionId
+}
+
+// caller returns the caller of sessionId, if there's one.
+func (self *callerSessions) caller(sessionId int64) (caller string, ok bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	caller, ok = self.callers[sessionId]
+	return caller, ok
+}
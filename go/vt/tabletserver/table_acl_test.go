@@ -0,0 +1,124 @@
+/*
+Copyright 2012, Google Inc.
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+    * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+    * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,           
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY           
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tabletserver
+
+import (
+	"code.google.com/p/vitess/go/vt/sqlparser"
+	"encoding/json"
+	"testing"
+)
+
+var testAcl = `[{
+	"Table": "secret",
+	"Readers": ["auditor"],
+	"Admins": ["dba"]
+}, {
+	"Table": "user_*",
+	"Readers": ["*"],
+	"Writers": ["app"]
+}]`
+
+func TestTableAcl(t *testing.T) {
+	acl := NewTableAcl()
+	if err := json.Unmarshal([]byte(testAcl), acl); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	cases := []struct {
+		caller, table string
+		want          int
+	}{
+		{"auditor", "secret", ACL_READ},
+		{"dba", "secret", ACL_ADMIN},
+		{"app", "secret", ACL_NONE},
+		{"", "secret", ACL_NONE},
+		{"app", "user_info", ACL_WRITE},
+		{"auditor", "user_info", ACL_READ},
+		{"", "user_info", ACL_READ},
+		{"app", "other", ACL_ADMIN},
+	}
+	for _, c := range cases {
+		if got := acl.access(c.caller, c.table); got != c.want {
+			t.Errorf("access(%q, %q) = %s, want %s", c.caller, c.table, aclNames[got], aclNames[c.want])
+		}
+	}
+
+	if err := acl.Add(&TableAclEntry{Table: "a*b"}); err == nil {
+		t.Errorf("want error for a misplaced *")
+	}
+	if err := acl.Add(&TableAclEntry{}); err == nil {
+		t.Errorf("want error for a missing table")
+	}
+}
+
+func TestTableAclGlobalAccess(t *testing.T) {
+	acl := NewTableAcl()
+	if got := acl.globalAccess(""); got != ACL_ADMIN {
+		t.Errorf("empty ACL: %s, want admin", aclNames[got])
+	}
+	if err := json.Unmarshal([]byte(testAcl), acl); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if got := acl.globalAccess("dba"); got != ACL_READ {
+		t.Errorf("dba: %s, want read", aclNames[got])
+	}
+	if got := acl.globalAccess("app"); got != ACL_NONE {
+		t.Errorf("app: %s, want none", aclNames[got])
+	}
+}
+
+func TestPlanAccess(t *testing.T) {
+	if got := planAccess(sqlparser.PLAN_SELECT_PK); got != ACL_READ {
+		t.Errorf("SELECT_PK: %s, want read", aclNames[got])
+	}
+	if got := planAccess(sqlparser.PLAN_INSERT_PK); got != ACL_WRITE {
+		t.Errorf("INSERT_PK: %s, want write", aclNames[got])
+	}
+	if got := planAccess(sqlparser.PLAN_SET); got != ACL_NONE {
+		t.Errorf("SET: %s, want none", aclNames[got])
+	}
+}
+
+func TestCallerSessions(t *testing.T) {
+	var cs callerSessions
+	cs.reset()
+	a := cs.sessionId("a")
+	if cs.sessionId("a") != a {
+		t.Errorf("want the same session id for the same caller")
+	}
+	if caller, ok := cs.caller(a); !ok || caller != "a" {
+		t.Errorf("caller(%d) = %q, %v, want a", a, caller, ok)
+	}
+	cs.reset()
+	if _, ok := cs.caller(a); ok {
+		t.Errorf("want session id %d to be invalid after reset", a)
+	}
+}
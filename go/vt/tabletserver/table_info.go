@@ -32,27 +32,33 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package tabletserver
 
 import (
-	"code.google.com/p/vitess/go/cache"
+	"bytes"
 	"code.google.com/p/vitess/go/mysql"
 	"code.google.com/p/vitess/go/relog"
 	"code.google.com/p/vitess/go/vt/schema"
 	"fmt"
+	"sort"
 	"sync"
 )
 
 type TableInfo struct {
 	sync.RWMutex
 	*schema.Table
-	RowCache *cache.LRUCache
-	Fields   []mysql.Field
+	RowCache RowCache
+	// IndexCaches are by index name. Only unique indexes have one.
+	IndexCaches map[string]*IndexCache
+	Fields      []mysql.Field
 	// stats updated by sqlquery.go
 	hits, misses int64
 }
 
-func NewTableInfo(conn *DBConnection, tableName string, cacheSize uint64) (self *TableInfo) {
+func NewTableInfo(conn *DBConnection, tableName string, cacheSize, indexCacheSize uint64, rowCacheFactory CreateRowCacheFunc) (self *TableInfo) {
 	self = loadTableInfo(conn, tableName)
 	if cacheSize != 0 {
-		self.initRowCache(conn, cacheSize)
+		self.initRowCache(conn, cacheSize, rowCacheFactory)
+		if self.RowCache != nil && indexCacheSize != 0 {
+			self.initIndexCaches(indexCacheSize)
+		}
 	}
 	return self
 }
@@ -95,6 +101,7 @@ func (self *TableInfo) fetchIndexes(conn *DBConnection) bool {
 		indexName := row[2].(string)
 		if currentName != indexName {
 			currentIndex = self.AddIndex(indexName)
+			currentIndex.Unique = row[1].(string) == "0" // Non_unique
 			currentName = indexName
 		}
 		currentIndex.AddColumn(row[4].(string))
@@ -113,7 +120,7 @@ func (self *TableInfo) fetchIndexes(conn *DBConnection) bool {
 	return true
 }
 
-func (self *TableInfo) initRowCache(conn *DBConnection, cacheSize uint64) {
+func (self *TableInfo) initRowCache(conn *DBConnection, cacheSize uint64, rowCacheFactory CreateRowCacheFunc) {
 	if self.PKColumns == nil {
 		relog.Warning("Table %s has no primary key. Will not be cached.", self.Name)
 		return
@@ -126,16 +133,52 @@ func (self *TableInfo) initRowCache(conn *DBConnection, cacheSize uint64) {
 	self.Fields = rowInfo.Fields
 	self.CacheType = 1
 	self.CacheSize = cacheSize
-	self.RowCache = cache.NewLRUCache(self.CacheSize)
+	self.RowCache = rowCacheFactory(self, self.CacheSize)
+}
+
+func (self *TableInfo) initIndexCaches(indexCacheSize uint64) {
+	self.IndexCaches = make(map[string]*IndexCache)
+	for _, index := range self.Indexes[1:] {
+		if index.Unique {
+			self.IndexCaches[index.Name] = NewIndexCache(self, index, indexCacheSize)
+		}
+	}
+}
+
+// invalidateRow deletes the row of key from the row cache, and
+// the index cache entries that point to it.
+func (self *TableInfo) invalidateRow(key string) {
+	self.RowCache.Delete(key)
+	for _, indexCache := range self.IndexCaches {
+		indexCache.DeletePK(key)
+	}
 }
 
 func (self *TableInfo) String() string {
 	if self.RowCache == nil {
 		return fmt.Sprintf("{}")
 	}
-	return fmt.Sprintf("{\"RowCache\": %v, \"Hits\": %v, \"Misses\": %v}",
-		self.RowCache,
+	buf := bytes.NewBuffer(make([]byte, 0, 128))
+	fmt.Fprintf(buf, "{\"RowCache\": %v, \"Hits\": %v, \"Misses\": %v",
+		self.RowCache.StatsJSON(),
 		&self.hits,
 		&self.misses,
 	)
+	if len(self.IndexCaches) != 0 {
+		buf.WriteString(", \"IndexCaches\": {")
+		indexNames := make([]string, 0, len(self.IndexCaches))
+		for indexName := range self.IndexCaches {
+			indexNames = append(indexNames, indexName)
+		}
+		sort.Strings(indexNames)
+		for i, indexName := range indexNames {
+			if i != 0 {
+				buf.WriteString(", ")
+			}
+			fmt.Fprintf(buf, "\"%s\": %v", indexName, self.IndexCaches[indexName].StatsJSON())
+		}
+		buf.WriteString("}")
+	}
+	buf.WriteString("}")
+	return buf.String()
 }
@@ -80,6 +80,12 @@ func (self *TabletError) Error() string {
 	return fmt.Sprintf(format, self.Message)
 }
 
+// IsConnectionError returns true if the error comes from
+// a lost or failed connection to MySQL.
+func (self *TabletError) IsConnectionError() bool {
+	return self.SqlError >= 2000 && self.SqlError <= 2018
+}
+
 func (self *TabletError) RecordStats() {
 	switch self.ErrorType {
 	case RETRY:
@@ -363,8 +363,7 @@ exec_cases = [
     [],
     [
       'select eid, id from vtocc_a where eid in (1) and id in (1, 2) limit 10001 for update',
-      "update /* pk */ vtocc_a set foo = 'bar' where eid = 1 and id = 1 /* _stream vtocc_a (eid id ) (1 1 ); */",
-      "update /* pk */ vtocc_a set foo = 'bar' where eid = 1 and id = 2 /* _stream vtocc_a (eid id ) (1 2 ); */",
+      "update /* pk */ vtocc_a set foo = 'bar' where (eid = 1 and id = 1) or (eid = 1 and id = 2) /* _stream vtocc_a (eid id ) (1 1 ) (1 2 ); */",
     ],
   ],
   ['commit'],
@@ -378,8 +377,7 @@ exec_cases = [
     [],
     [
       'select eid, id from vtocc_a where eid in (1, 2) and id in (1, 2) limit 10001 for update',
-      "update /* pk */ vtocc_a set foo = 'bar' where eid = 1 and id = 1 /* _stream vtocc_a (eid id ) (1 1 ); */",
-      "update /* pk */ vtocc_a set foo = 'bar' where eid = 1 and id = 2 /* _stream vtocc_a (eid id ) (1 2 ); */",
+      "update /* pk */ vtocc_a set foo = 'bar' where (eid = 1 and id = 1) or (eid = 1 and id = 2) /* _stream vtocc_a (eid id ) (1 1 ) (1 2 ); */",
     ],
   ],
   ['commit'],
@@ -437,7 +435,7 @@ exec_cases = [
     [],
     [
       "select eid, id from vtocc_a where id = 1 limit 10001 for update",
-      "update /* pk */ vtocc_a set foo = 'bar' where eid = 1 and id = 1 /* _stream vtocc_a (eid id ) (1 1 ); */",
+      "update /* pk */ vtocc_a set foo = 'bar' where (eid = 1 and id = 1) /* _stream vtocc_a (eid id ) (1 1 ); */",
     ],
   ],
   ['commit'],
@@ -451,7 +449,7 @@ exec_cases = [
     [],
     [
       "select eid, id from vtocc_a where eid = 1 limit 1 for update",
-      "update /* pk */ vtocc_a set foo = 'bar' where eid = 1 and id = 1 /* _stream vtocc_a (eid id ) (1 1 ); */",
+      "update /* pk */ vtocc_a set foo = 'bar' where (eid = 1 and id = 1) /* _stream vtocc_a (eid id ) (1 1 ); */",
     ],
   ],
   ['commit'],
@@ -465,7 +463,7 @@ exec_cases = [
     [],
     [
       "select eid, id from vtocc_a where eid = 1 order by id desc limit 1 for update",
-      "update /* pk */ vtocc_a set foo = 'bar' where eid = 1 and id = 2 /* _stream vtocc_a (eid id ) (1 2 ); */",
+      "update /* pk */ vtocc_a set foo = 'bar' where (eid = 1 and id = 2) /* _stream vtocc_a (eid id ) (1 2 ); */",
     ],
   ],
   ['commit'],
@@ -479,8 +477,7 @@ exec_cases = [
     [],
     [
       "select eid, id from vtocc_a limit 10001 for update",
-      "update vtocc_a set foo = 'bar' where eid = 1 and id = 1 /* _stream vtocc_a (eid id ) (1 1 ); */",
-      "update vtocc_a set foo = 'bar' where eid = 1 and id = 2 /* _stream vtocc_a (eid id ) (1 2 ); */",
+      "update vtocc_a set foo = 'bar' where (eid = 1 and id = 1) or (eid = 1 and id = 2) /* _stream vtocc_a (eid id ) (1 1 ) (1 2 ); */",
     ],
   ],
   ['commit'],
@@ -529,7 +526,7 @@ exec_cases = [
     [],
     [
       'select eid, id from vtocc_a where eid in (2) and id in (1, 2) limit 10001 for update',
-      'delete /* pk */ from vtocc_a where eid = 2 and id = 1 /* _stream vtocc_a (eid id ) (2 1 ); */',
+      'delete /* pk */ from vtocc_a where (eid = 2 and id = 1) /* _stream vtocc_a (eid id ) (2 1 ); */',
     ],
   ],
   ['commit'],
@@ -543,7 +540,7 @@ exec_cases = [
     [],
     [
       'select eid, id from vtocc_a where eid in (2, 3) and id in (1, 2) limit 10001 for update',
-      'delete /* pk */ from vtocc_a where eid = 2 and id = 1 /* _stream vtocc_a (eid id ) (2 1 ); */'
+      'delete /* pk */ from vtocc_a where (eid = 2 and id = 1) /* _stream vtocc_a (eid id ) (2 1 ); */'
     ],
   ],
   ['commit'],
@@ -568,7 +565,7 @@ exec_cases = [
     [],
     [
       'select eid, id from vtocc_a where eid = 1+1 and id = 1 limit 10001 for update',
-      "delete from vtocc_a where eid = 2 and id = 1 /* _stream vtocc_a (eid id ) (2 1 ); */",
+      "delete from vtocc_a where (eid = 2 and id = 1) /* _stream vtocc_a (eid id ) (2 1 ); */",
     ],
   ],
   ['commit'],
@@ -582,7 +579,7 @@ exec_cases = [
     [],
     [
       'select eid, id from vtocc_a where eid = 2 limit 10001 for update',
-      "delete from vtocc_a where eid = 2 and id = 1 /* _stream vtocc_a (eid id ) (2 1 ); */",
+      "delete from vtocc_a where (eid = 2 and id = 1) /* _stream vtocc_a (eid id ) (2 1 ); */",
     ],
   ],
   ['commit'],
@@ -596,7 +593,7 @@ exec_cases = [
     [],
     [
       'select eid, id from vtocc_a where eid = 2 limit 1 for update',
-      "delete from vtocc_a where eid = 2 and id = 1 /* _stream vtocc_a (eid id ) (2 1 ); */",
+      "delete from vtocc_a where (eid = 2 and id = 1) /* _stream vtocc_a (eid id ) (2 1 ); */",
     ],
   ],
   ['commit'],
@@ -610,7 +607,7 @@ exec_cases = [
     [],
     [
       'select eid, id from vtocc_a order by eid desc limit 1 for update',
-      "delete from vtocc_a where eid = 2 and id = 1 /* _stream vtocc_a (eid id ) (2 1 ); */",
+      "delete from vtocc_a where (eid = 2 and id = 1) /* _stream vtocc_a (eid id ) (2 1 ); */",
     ],
   ],
   ['commit'],
@@ -623,13 +620,26 @@ exec_cases = [
     [],
     [
       'select eid, id from vtocc_a limit 10001 for update',
-      "delete from vtocc_a where eid = 1 and id = 1 /* _stream vtocc_a (eid id ) (1 1 ); */",
-      "delete from vtocc_a where eid = 1 and id = 2 /* _stream vtocc_a (eid id ) (1 2 ); */",
+      "delete from vtocc_a where (eid = 1 and id = 1) or (eid = 1 and id = 2) /* _stream vtocc_a (eid id ) (1 1 ) (1 2 ); */",
     ],
   ],
   ['rollback'],
   ['select * from vtocc_a', {}, [(1L, 1L, 'abcd', 'efgh'), (1L, 2L, 'bcde', 'fghi')]],
 
+  # single column pk
+  ['begin'],
+  ["insert into vtocc_test(intval) values (4), (5)"],
+  [
+    "delete from vtocc_test where intval > 3", {},
+    [],
+    [
+      'select intval from vtocc_test where intval > 3 limit 10001 for update',
+      "delete from vtocc_test where intval in (4, 5) /* _stream vtocc_test (intval ) (4 ) (5 ); */",
+    ],
+  ],
+  ['commit'],
+  ['select * from vtocc_test where intval > 3', {}, []],
+
   # no index
   ['begin'],
   ['insert into vtocc_d values (1, 1)'],